@@ -0,0 +1,216 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// aggregationFlushInterval is how often the windows closed by the wall clock
+// are flushed.
+const aggregationFlushInterval = time.Second
+
+// seriesAggregate holds the aggregation of the samples of a series within a
+// window.
+type seriesAggregate struct {
+	labels    []*prompb.Label
+	window    int64
+	timestamp int64
+	last      float64
+	min       float64
+	max       float64
+	sum       float64
+	count     int
+}
+
+func (a *seriesAggregate) add(timestamp int64, value float64) {
+	if a.count == 0 || timestamp >= a.timestamp {
+		a.timestamp = timestamp
+		a.last = value
+	}
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.sum += value
+	a.count++
+}
+
+// series returns the aggregate as a series with a single sample, timestamped
+// as the last sample of the window.
+func (a *seriesAggregate) series(function string) *prompb.TimeSeries {
+	var value float64
+	switch function {
+	case "min":
+		value = a.min
+	case "max":
+		value = a.max
+	case "avg":
+		value = a.sum / float64(a.count)
+	default:
+		value = a.last
+	}
+	return &prompb.TimeSeries{
+		Labels:  a.labels,
+		Samples: []prompb.Sample{{Timestamp: a.timestamp, Value: value}},
+	}
+}
+
+// aggregator reduces the samples of each series to a single sample per
+// window, aligned to the sample timestamps. A window is closed when a sample
+// of a later window arrives or once the wall clock passes its end. At most
+// maxSeries series are aggregated at once, samples of new series beyond it
+// are dropped.
+type aggregator struct {
+	mu        sync.Mutex
+	window    int64
+	function  string
+	maxSeries int
+	series    map[uint64]*seriesAggregate
+}
+
+func newAggregator(window time.Duration, function string, maxSeries int) *aggregator {
+	return &aggregator{
+		window:    window.Milliseconds(),
+		function:  function,
+		maxSeries: maxSeries,
+		series:    make(map[uint64]*seriesAggregate),
+	}
+}
+
+// Add folds the sample into the window of its series, returning the series
+// closed by the sample if it starts a later window. It reports false if the
+// sample is dropped for exceeding the max series.
+func (g *aggregator) Add(fingerprint uint64, labels []*prompb.Label, timestamp int64, value float64) (*prompb.TimeSeries, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	window := timestamp - timestamp%g.window
+	if timestamp < 0 && timestamp%g.window != 0 {
+		window -= g.window
+	}
+
+	var closed *prompb.TimeSeries
+	a, ok := g.series[fingerprint]
+	if ok && window > a.window {
+		closed = a.series(g.function)
+		ok = false
+	}
+	if !ok {
+		if closed == nil && len(g.series) >= g.maxSeries {
+			return nil, false
+		}
+		a = &seriesAggregate{labels: labels, window: window}
+		g.series[fingerprint] = a
+	}
+	a.add(timestamp, value)
+	return closed, true
+}
+
+// Flush removes and returns the series whose window ended before now.
+func (g *aggregator) Flush(now time.Time) []*prompb.TimeSeries {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var closed []*prompb.TimeSeries
+	for fingerprint, a := range g.series {
+		if a.window+g.window <= now.UnixNano()/int64(time.Millisecond) {
+			closed = append(closed, a.series(g.function))
+			delete(g.series, fingerprint)
+		}
+	}
+	return closed
+}
+
+// Len returns the number of series currently aggregated.
+func (g *aggregator) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.series)
+}
+
+// serializeAggregates serializes the aggregated series as they would have
+// been received, without aggregating, deduplicating, limiting or counting
+// them again. The aggregated values were already transformed when received.
+func serializeAggregates(s Serializer, series []*prompb.TimeSeries, cfg serializeConfig) (map[string][]Message, error) {
+	cfg.aggregation = nil
+	cfg.dedup = nil
+	cfg.cardinality = nil
+	cfg.rateLimit = nil
+	cfg.stats = nil
+	cfg.transformed = true
+	cfg.aggregated = true
+	return serializeMessages(s, &prompb.WriteRequest{Timeseries: series}, cfg)
+}
+
+// flushAggregates periodically produces the series whose window was closed by
+// the wall clock, until the process exits.
+func flushAggregates(g *aggregator, producer Producer, serializer Serializer) {
+	for range time.Tick(aggregationFlushInterval) {
+		if closed := g.Flush(time.Now()); len(closed) > 0 {
+			produceAggregates(closed, producer, serializer)
+		}
+	}
+}
+
+// produceAggregates serializes and produces the series whose window was
+// closed, keeping the priority of the series matching PRIORITY_MATCH.
+func produceAggregates(closed []*prompb.TimeSeries, producer Producer, serializer Serializer) {
+	metricsPerTopic, err := serializeAggregates(serializer, closed, defaultSerializeConfig())
+	var serializeErr *SerializeError
+	if err != nil && !errors.As(err, &serializeErr) {
+		logrus.WithError(err).Error("couldn't serialize aggregated series")
+		return
+	}
+
+	for _, topicMessages := range SortedByTopic(metricsPerTopic) {
+		topic := topicMessages.Topic
+		for _, metric := range topicMessages.Messages {
+			objectsWritten.Add(float64(1))
+			msg := &kafka.Message{
+				TopicPartition: kafka.TopicPartition{
+					Partition: metric.Partition,
+					Topic:     &topic,
+				},
+				Key:       metric.Key,
+				Value:     metric.Value,
+				Headers:   metric.Headers,
+				Timestamp: metric.Timestamp,
+			}
+			if metric.HighPriority {
+				msg.Opaque = highPriority
+			}
+			messageExpiry.Apply(msg, time.Now())
+			err := messageSequence.Produce(msg, func() error {
+				return producer.Produce(msg, nil)
+			})
+			if err != nil {
+				objectsFailed.Add(float64(1))
+				logrus.WithError(err).Error(fmt.Sprintf("couldn't produce aggregated message in kafka topic %v", topic))
+				continue
+			}
+			countProduced(topic, metric.Value)
+		}
+	}
+}
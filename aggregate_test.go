@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func aggregationRequest(samples ...prompb.Sample) *prompb.WriteRequest {
+	return &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}, {Name: "instance", Value: "a"}},
+			Samples: samples,
+		}},
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	g := newAggregator(time.Minute, "max", 1)
+	labels := []*prompb.Label{{Name: "__name__", Value: "foo"}}
+
+	closed, ok := g.Add(1, labels, 1000, 3)
+	assert.True(t, ok)
+	assert.Nil(t, closed)
+	closed, ok = g.Add(1, labels, 2000, 5)
+	assert.True(t, ok)
+	assert.Nil(t, closed)
+
+	_, ok = g.Add(2, labels, 1000, 1)
+	assert.False(t, ok, "new series beyond the max series should be dropped")
+
+	closed, ok = g.Add(1, labels, 61000, 1)
+	assert.True(t, ok)
+	assert.Equal(t, []prompb.Sample{{Timestamp: 2000, Value: 5}}, closed.Samples, "a sample of a later window should close the window")
+
+	assert.Empty(t, g.Flush(time.Unix(119, 0)))
+	flushed := g.Flush(time.Unix(120, 0))
+	assert.Len(t, flushed, 1)
+	assert.Equal(t, []prompb.Sample{{Timestamp: 61000, Value: 1}}, flushed[0].Samples)
+	assert.Equal(t, 0, g.Len())
+}
+
+func TestSerializeAggregation(t *testing.T) {
+	aggregation = newAggregator(time.Minute, "avg", 10)
+	defer func() { aggregation = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, aggregationRequest(
+		prompb.Sample{Timestamp: 1000, Value: 1},
+		prompb.Sample{Timestamp: 20000, Value: 2},
+		prompb.Sample{Timestamp: 40000, Value: 6},
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countMessages(output), "samples should be held until the window closes")
+
+	output, err = serializeAggregates(serializer, aggregation.Flush(time.Unix(60, 0)), defaultSerializeConfig())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output))
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			var metric map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+			assert.Equal(t, "3", metric["value"])
+			assert.Equal(t, "1970-01-01T00:00:40Z", metric["timestamp"])
+		}
+	}
+}
+
+func TestSerializeAggregationClosedBySample(t *testing.T) {
+	aggregation = newAggregator(time.Minute, "last", 10)
+	defer func() { aggregation = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, aggregationRequest(
+		prompb.Sample{Timestamp: 1000, Value: 1},
+		prompb.Sample{Timestamp: 2000, Value: 2},
+		prompb.Sample{Timestamp: 61000, Value: 3},
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output))
+	for _, msgs := range output {
+		assert.Contains(t, string(msgs[0].Value), `"value":"2"`)
+	}
+	assert.Equal(t, 1, aggregation.Len())
+}
+
+func TestSerializeAggregationTransformedOnce(t *testing.T) {
+	aggregation = newAggregator(time.Minute, "avg", 10)
+	valueTransforms, _ = parseValueTransforms(`[{metric: "foo", multiplier: 10, offset: 1}]`)
+	defer func() { aggregation, valueTransforms = nil, nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	// the window closed by the last sample, and the one flushed by the clock
+	output, err := SerializeMessages(serializer, aggregationRequest(
+		prompb.Sample{Timestamp: 1000, Value: 1},
+		prompb.Sample{Timestamp: 2000, Value: 3},
+		prompb.Sample{Timestamp: 61000, Value: 5},
+	))
+	assert.Nil(t, err)
+	flushed, err := serializeAggregates(serializer, aggregation.Flush(time.Unix(120, 0)), defaultSerializeConfig())
+	assert.Nil(t, err)
+
+	var values []string
+	for _, messages := range []map[string][]Message{output, flushed} {
+		for _, msgs := range messages {
+			for _, msg := range msgs {
+				var metric map[string]interface{}
+				assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+				values = append(values, metric["value"].(string))
+			}
+		}
+	}
+	assert.Equal(t, []string{"21", "51"}, values)
+}
+
+func TestSerializeAggregationNotLimitedTwice(t *testing.T) {
+	aggregation = newAggregator(time.Minute, "last", 10)
+	// room for the two samples of the request only
+	seriesRateLimit = newRateLimiter(0.001, 2, 10)
+	defer func() { aggregation, seriesRateLimit = nil, nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	stats := &filterStats{}
+	cfg := defaultSerializeConfig()
+	cfg.stats = stats
+	output, err := serializeMessages(serializer, aggregationRequest(
+		prompb.Sample{Timestamp: 1000, Value: 1},
+		prompb.Sample{Timestamp: 61000, Value: 2},
+	), cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "the closed window shouldn't be rate limited again")
+	assert.Equal(t, 1, stats.received, "the closed window shouldn't be counted again")
+}
+
+func TestSerializeAggregatesLateWindow(t *testing.T) {
+	maxSampleAge, timeWindowLast = time.Minute, time.Minute
+	defer func() { maxSampleAge, timeWindowLast = 0, 0 }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	// a window closing long after its samples were received
+	closed := []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}},
+		Samples: []prompb.Sample{{Timestamp: time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond), Value: 1}},
+	}}
+	output, err := serializeAggregates(serializer, closed, defaultSerializeConfig())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "closed windows shouldn't be checked against the time window again")
+}
@@ -0,0 +1,484 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/linkedin/goavro"
+)
+
+// avroFingerprintHeader is the kafka header carrying the CRC-64-AVRO
+// fingerprint of the schema a message was written with, as 8 little-endian
+// bytes like in the avro single object encoding.
+const avroFingerprintHeader = "avro-schema-fingerprint"
+
+// avroNameHeader is the kafka header carrying the full name of the schema a
+// message was written with, its namespace included, which is the name the
+// schema is registered with, e.g: as subject of the record name strategy.
+const avroNameHeader = "avro-schema-name"
+
+// rabinEmpty is the CRC-64-AVRO fingerprint of an empty input
+const rabinEmpty = 0xc15d213aa4d7a795
+
+var rabinTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (rabinEmpty & -(fp & 1))
+		}
+		table[i] = fp
+	}
+	return table
+}()
+
+// rabinFingerprint returns the CRC-64-AVRO fingerprint of the data.
+func rabinFingerprint(data []byte) uint64 {
+	fp := uint64(rabinEmpty)
+	for _, b := range data {
+		fp = (fp >> 8) ^ rabinTable[byte(fp)^b]
+	}
+	return fp
+}
+
+// avroSchemaFingerprint returns the CRC-64-AVRO fingerprint of the parsing
+// canonical form of the schema.
+func avroSchemaFingerprint(schema string) (uint64, error) {
+	canonical, err := avroCanonicalForm(schema)
+	if err != nil {
+		return 0, err
+	}
+	return rabinFingerprint([]byte(canonical)), nil
+}
+
+// avroFingerprintHeaders returns the message headers telling the schema
+// fingerprint.
+func avroFingerprintHeaders(fp uint64) []kafka.Header {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, fp)
+	return []kafka.Header{{Key: avroFingerprintHeader, Value: value}}
+}
+
+// avroSchemaName returns the full name of the named schema, qualified with
+// its namespace unless the name is already a full name.
+func avroSchemaName(schema string) (string, error) {
+	var node struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	}
+	if err := json.Unmarshal([]byte(schema), &node); err != nil {
+		return "", err
+	}
+	if node.Name == "" {
+		return "", fmt.Errorf("avro schema has no name")
+	}
+	return avroFullName(node.Name, node.Namespace), nil
+}
+
+// avroSchemaHeaders returns the message headers telling the fingerprint and
+// the full name of the schema.
+func avroSchemaHeaders(schema string) ([]kafka.Header, error) {
+	fp, err := avroSchemaFingerprint(schema)
+	if err != nil {
+		return nil, err
+	}
+	name, err := avroSchemaName(schema)
+	if err != nil {
+		return nil, err
+	}
+	return append(avroFingerprintHeaders(fp), kafka.Header{Key: avroNameHeader, Value: []byte(name)}), nil
+}
+
+// avroWithStringField returns the record schema with a string field added
+// after its fields.
+func avroWithStringField(schema, field string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(schema))
+	decoder.UseNumber()
+
+	var record map[string]interface{}
+	if err := decoder.Decode(&record); err != nil {
+		return "", err
+	}
+	fields, ok := record["fields"].([]interface{})
+	if !ok {
+		return "", fmt.Errorf("avro schema %v isn't a record", record["name"])
+	}
+	record["fields"] = append(fields, map[string]interface{}{"name": field, "type": "string"})
+
+	data, err := json.Marshal(record)
+	return string(data), err
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// avroCanonicalForm returns the parsing canonical form of the schema, as
+// defined by the avro specification.
+func avroCanonicalForm(schema string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(schema))
+	decoder.UseNumber()
+
+	var node interface{}
+	if err := decoder.Decode(&node); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := writeAvroCanonical(&buf, node, ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func writeAvroCanonical(buf *bytes.Buffer, node interface{}, namespace string) error {
+	switch n := node.(type) {
+	case string:
+		if avroPrimitives[n] {
+			writeAvroString(buf, n)
+		} else {
+			writeAvroString(buf, avroFullName(n, namespace))
+		}
+		return nil
+
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, branch := range n {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeAvroCanonical(buf, branch, namespace); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+
+	case map[string]interface{}:
+		typ, ok := n["type"].(string)
+		if !ok {
+			return writeAvroCanonical(buf, n["type"], namespace)
+		}
+		if avroPrimitives[typ] {
+			writeAvroString(buf, typ)
+			return nil
+		}
+
+		buf.WriteByte('{')
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			name, _ := n["name"].(string)
+			if name == "" {
+				return fmt.Errorf("avro %s schema has no name", typ)
+			}
+			if ns, ok := n["namespace"].(string); ok && !strings.Contains(name, ".") {
+				namespace = ns
+			}
+			name = avroFullName(name, namespace)
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				namespace = name[:i]
+			} else {
+				namespace = ""
+			}
+
+			buf.WriteString(`"name":`)
+			writeAvroString(buf, name)
+			buf.WriteString(`,"type":`)
+			writeAvroString(buf, typ)
+
+			switch typ {
+			case "record", "error":
+				fields, _ := n["fields"].([]interface{})
+				buf.WriteString(`,"fields":[`)
+				for i, f := range fields {
+					field, ok := f.(map[string]interface{})
+					if !ok {
+						return fmt.Errorf("invalid field in avro record %s", name)
+					}
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fieldName, _ := field["name"].(string)
+					buf.WriteString(`{"name":`)
+					writeAvroString(buf, fieldName)
+					buf.WriteString(`,"type":`)
+					if err := writeAvroCanonical(buf, field["type"], namespace); err != nil {
+						return err
+					}
+					buf.WriteByte('}')
+				}
+				buf.WriteByte(']')
+			case "enum":
+				symbols, _ := n["symbols"].([]interface{})
+				buf.WriteString(`,"symbols":[`)
+				for i, s := range symbols {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					symbol, _ := s.(string)
+					writeAvroString(buf, symbol)
+				}
+				buf.WriteByte(']')
+			case "fixed":
+				size, _ := n["size"].(json.Number)
+				buf.WriteString(`,"size":`)
+				buf.WriteString(size.String())
+			}
+
+		case "array":
+			buf.WriteString(`"type":"array","items":`)
+			if err := writeAvroCanonical(buf, n["items"], namespace); err != nil {
+				return err
+			}
+
+		case "map":
+			buf.WriteString(`"type":"map","values":`)
+			if err := writeAvroCanonical(buf, n["values"], namespace); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("unknown avro type %q", typ)
+		}
+		buf.WriteByte('}')
+		return nil
+
+	default:
+		return fmt.Errorf("invalid avro schema node %v", node)
+	}
+}
+
+// avroFullName qualifies the name with the namespace, unless it's already
+// a full name.
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func writeAvroString(buf *bytes.Buffer, s string) {
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	// Encode appends a newline
+	buf.Truncate(buf.Len() - 1)
+}
+
+// avroRecordOrder rewrites Avro-JSON data with the fields of its records in
+// the order declared by the schema, as goavro writes them in the Go map
+// iteration order while some Avro tooling is order-sensitive. Map entries are
+// written sorted by key, so the output is stable.
+type avroRecordOrder struct {
+	schema interface{}
+	named  map[string]map[string]interface{}
+}
+
+// newAvroRecordOrder builds the record order of the schema, from its parsing
+// canonical form, where all the names are full names.
+func newAvroRecordOrder(schema string) (*avroRecordOrder, error) {
+	canonical, err := avroCanonicalForm(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &avroRecordOrder{named: make(map[string]map[string]interface{})}
+	if err := json.Unmarshal([]byte(canonical), &o.schema); err != nil {
+		return nil, err
+	}
+	o.collect(o.schema)
+	return o, nil
+}
+
+// collect indexes the named schemas, so references to them can be resolved.
+func (o *avroRecordOrder) collect(node interface{}) {
+	switch n := node.(type) {
+	case []interface{}:
+		for _, branch := range n {
+			o.collect(branch)
+		}
+	case map[string]interface{}:
+		if name, ok := n["name"].(string); ok {
+			o.named[name] = n
+		}
+		fields, _ := n["fields"].([]interface{})
+		for _, f := range fields {
+			if field, ok := f.(map[string]interface{}); ok {
+				o.collect(field["type"])
+			}
+		}
+		o.collect(n["items"])
+		o.collect(n["values"])
+	}
+}
+
+// Reorder returns the Avro-JSON data with its record fields in schema order.
+func (o *avroRecordOrder) Reorder(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	if err := o.write(&buf, o.schema, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (o *avroRecordOrder) write(buf *bytes.Buffer, node interface{}, data json.RawMessage) error {
+	if name, ok := node.(string); ok {
+		if named, ok := o.named[name]; ok {
+			node = named
+		}
+	}
+
+	switch n := node.(type) {
+	case []interface{}:
+		// a union value is either null or an object keyed by its branch
+		var branch map[string]json.RawMessage
+		if err := json.Unmarshal(data, &branch); err != nil || len(branch) != 1 {
+			break
+		}
+		for name, value := range branch {
+			buf.WriteByte('{')
+			writeAvroString(buf, name)
+			buf.WriteByte(':')
+			if err := o.write(buf, avroUnionBranch(n, name), value); err != nil {
+				return err
+			}
+			buf.WriteByte('}')
+		}
+		return nil
+
+	case map[string]interface{}:
+		switch n["type"] {
+		case "record", "error":
+			var values map[string]json.RawMessage
+			if err := json.Unmarshal(data, &values); err != nil {
+				return err
+			}
+			fields, _ := n["fields"].([]interface{})
+			buf.WriteByte('{')
+			written := 0
+			for _, f := range fields {
+				field, _ := f.(map[string]interface{})
+				name, _ := field["name"].(string)
+				value, ok := values[name]
+				if !ok {
+					continue
+				}
+				if written > 0 {
+					buf.WriteByte(',')
+				}
+				written++
+				writeAvroString(buf, name)
+				buf.WriteByte(':')
+				if err := o.write(buf, field["type"], value); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte('}')
+			return nil
+
+		case "array":
+			var items []json.RawMessage
+			if err := json.Unmarshal(data, &items); err != nil {
+				return err
+			}
+			buf.WriteByte('[')
+			for i, item := range items {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := o.write(buf, n["items"], item); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+			return nil
+
+		case "map":
+			var values map[string]json.RawMessage
+			if err := json.Unmarshal(data, &values); err != nil {
+				return err
+			}
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			buf.WriteByte('{')
+			for i, key := range keys {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				writeAvroString(buf, key)
+				buf.WriteByte(':')
+				if err := o.write(buf, n["values"], values[key]); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte('}')
+			return nil
+		}
+	}
+
+	// primitives, enums and fixed are written as is
+	buf.Write(data)
+	return nil
+}
+
+// avroUnionBranch returns the branch of the union with the given name, as
+// the Avro-JSON encoding keys union values: the full name of named schemas
+// and the type of the others.
+func avroUnionBranch(branches []interface{}, name string) interface{} {
+	for _, branch := range branches {
+		switch b := branch.(type) {
+		case string:
+			if b == name {
+				return b
+			}
+		case map[string]interface{}:
+			if b["name"] == name || b["type"] == name {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// avroSchemaOrder returns the record order of the schema, or nil when the
+// fields may be written in any order.
+func avroSchemaOrder(schema string) (*avroRecordOrder, error) {
+	if avroFieldOrder != "schema" {
+		return nil, nil
+	}
+	return newAvroRecordOrder(schema)
+}
+
+// avroTextual encodes the native datum as Avro-JSON, with the record fields
+// in schema order when an order is given.
+func avroTextual(codec *goavro.Codec, order *avroRecordOrder, native interface{}) ([]byte, error) {
+	data, err := codec.TextualFromNative(nil, native)
+	if err != nil || order == nil {
+		return data, err
+	}
+	return order.Reorder(data)
+}
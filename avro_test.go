@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRabinFingerprint(t *testing.T) {
+	// test vector from the avro specification
+	assert.Equal(t, uint64(0x63dd24e7cc258f8a), rabinFingerprint([]byte(`"null"`)))
+}
+
+func TestAvroCanonicalForm(t *testing.T) {
+	canonical, err := avroCanonicalForm(`{"type": "record", "name": "Sample", "namespace": "io.prometheus", "doc": "ignored",
+		"fields": [{"name": "value", "type": {"type": "double"}}, {"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["A", "B"]}}]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"io.prometheus.Sample","type":"record","fields":[{"name":"value","type":"double"},{"name":"kind","type":{"name":"io.prometheus.Kind","type":"enum","symbols":["A","B"]}}]}`, canonical)
+}
+
+func TestSerializeAvroFingerprintHeader(t *testing.T) {
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+
+	count := 0
+	for _, messages := range output {
+		for _, msg := range messages {
+			count++
+			assert.Len(t, msg.Headers, 2)
+			assert.Equal(t, avroFingerprintHeader, msg.Headers[0].Key)
+			assert.Equal(t, uint64(0xcb9bc5974df5e53e), binary.LittleEndian.Uint64(msg.Headers[0].Value))
+			assert.Equal(t, avroNameHeader, msg.Headers[1].Key)
+			assert.Equal(t, "io.prometheus.Metric", string(msg.Headers[1].Value))
+		}
+	}
+	assert.Equal(t, 2, count)
+}
+
+func TestAvroSchemaName(t *testing.T) {
+	for schema, expected := range map[string]string{
+		`{"type": "record", "name": "Metric", "namespace": "io.prometheus", "fields": []}`:             "io.prometheus.Metric",
+		`{"type": "record", "name": "com.example.Metric", "namespace": "io.prometheus", "fields": []}`: "com.example.Metric",
+		`{"type": "record", "name": "Metric", "fields": []}`:                                           "Metric",
+	} {
+		name, err := avroSchemaName(schema)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, name)
+	}
+
+	_, err := avroSchemaName(`{"type": "map", "values": "string"}`)
+	assert.NotNil(t, err)
+}
+
+func TestSerializeAvroNamespacedSchema(t *testing.T) {
+	serializer, err := NewAvroJSONSerializer("testdata/metric-namespaced.avsc")
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+
+	count := 0
+	for _, messages := range output {
+		for _, msg := range messages {
+			count++
+			assert.Equal(t, avroNameHeader, msg.Headers[1].Key)
+			assert.Equal(t, "com.example.telemetry.Metric", string(msg.Headers[1].Value))
+
+			native, _, err := serializer.codec.NativeFromTextual(msg.Value)
+			assert.Nil(t, err)
+			assert.Equal(t, "foo", native.(map[string]interface{})["name"])
+		}
+	}
+	assert.Equal(t, 2, count)
+}
+
+// assertFieldOrder asserts the record fields appear in the given order in the
+// Avro-JSON data.
+func assertFieldOrder(t *testing.T, data []byte, fields []string) {
+	last := -1
+	for _, field := range fields {
+		i := strings.Index(string(data), `"`+field+`":`)
+		assert.Greater(t, i, last, "field %s should follow the schema order in %s", field, data)
+		last = i
+	}
+}
+
+func TestAvroJSONSchemaFieldOrder(t *testing.T) {
+	for schema, fields := range map[string][]string{
+		"schemas/metric.avsc":            {"timestamp", "value", "name", "labels"},
+		"testdata/metric-reordered.avsc": {"name", "labels", "value", "timestamp"},
+	} {
+		serializer, err := NewAvroJSONSerializer(schema)
+		assert.Nil(t, err)
+
+		// the samples are maps, whose iteration order changes between runs
+		for i := 0; i < 20; i++ {
+			output, err := SerializeMessages(serializer, NewWriteRequest())
+			assert.Nil(t, err)
+			for _, msgs := range output {
+				for _, msg := range msgs {
+					assertFieldOrder(t, msg.Value, fields)
+				}
+			}
+		}
+	}
+}
+
+func TestAvroRecordOrderNested(t *testing.T) {
+	order, err := newAvroRecordOrder(`{
+		"type": "record", "name": "Outer", "namespace": "io.prometheus",
+		"fields": [
+			{"name": "b", "type": ["null", {"type": "record", "name": "Inner", "fields": [
+				{"name": "y", "type": "long"}, {"name": "x", "type": "string"}]}]},
+			{"name": "a", "type": {"type": "array", "items": "Inner"}},
+			{"name": "m", "type": {"type": "map", "values": "string"}}
+		]
+	}`)
+	assert.Nil(t, err)
+
+	output, err := order.Reorder([]byte(`{"m":{"z":"1","a":"2"},"a":[{"x":"s","y":1}],"b":{"io.prometheus.Inner":{"x":"t","y":2}}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"b":{"io.prometheus.Inner":{"y":2,"x":"t"}},"a":[{"y":1,"x":"s"}],"m":{"a":"2","z":"1"}}`, string(output))
+
+	output, err = order.Reorder([]byte(`{"a":[],"m":{},"b":null}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"b":null,"a":[],"m":{}}`, string(output))
+}
+
+func TestAvroJSONAnyFieldOrder(t *testing.T) {
+	defer func(previous string) { avroFieldOrder = previous }(avroFieldOrder)
+	avroFieldOrder = "any"
+
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+	assert.Nil(t, serializer.order)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			_, _, err := serializer.codec.NativeFromTextual(msg.Value)
+			assert.Nil(t, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	cache := newLRUCache(2)
+
+	assert.False(t, cache.Add(1, "a"))
+	assert.False(t, cache.Add(2, "b"))
+
+	_, ok := cache.Get(1)
+	assert.True(t, ok)
+
+	assert.True(t, cache.Add(3, "c"), "adding over the cap should evict")
+	assert.Equal(t, 2, cache.Len())
+
+	_, ok = cache.Get(2)
+	assert.False(t, ok, "least recently used entry should be evicted")
+	v, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, "a", v)
+}
+
+func TestTopicCacheEviction(t *testing.T) {
+	topicCache = newLRUCache(1)
+	defer func() { topicCache = nil }()
+
+	assert.Equal(t, topic(map[string]string{"__name__": "foo"}), topic(map[string]string{"__name__": "foo"}))
+	assert.Equal(t, 1, topicCache.Len())
+
+	topic(map[string]string{"__name__": "bar"})
+	assert.Equal(t, 1, topicCache.Len())
+	_, ok := topicCache.Get(fingerprint(map[string]string{"__name__": "foo"}))
+	assert.False(t, ok)
+}
+
+func TestFilterCache(t *testing.T) {
+	previous := defaultSerializeConfig()
+	rules, err := parseMatchList(`['up{job="node"}']`)
+	assert.Nil(t, err)
+	setRules(rules, previous.topicTemplate)
+	defer setRules(previous.match, previous.topicTemplate)
+
+	filterCache = newLRUCache(10)
+	defer func() { filterCache = nil }()
+
+	kept := map[string]string{"__name__": "up", "job": "node"}
+	dropped := map[string]string{"__name__": "up", "job": "api"}
+
+	cfg := defaultSerializeConfig()
+	for i := 0; i < 3; i++ {
+		assert.True(t, cfg.filter("up", kept, fingerprint(kept)))
+		assert.False(t, cfg.filter("up", dropped, fingerprint(dropped)))
+	}
+	assert.Equal(t, 2, filterCache.Len())
+	keep, ok := filterCache.Get(fingerprint(dropped))
+	assert.True(t, ok)
+	assert.Equal(t, false, keep)
+
+	rules, err = parseMatchList(`['up{job="api"}']`)
+	assert.Nil(t, err)
+	setRules(rules, previous.topicTemplate)
+	assert.Equal(t, 0, filterCache.Len(), "replacing the rules should clear the cache")
+
+	cfg = defaultSerializeConfig()
+	assert.False(t, cfg.filter("up", kept, fingerprint(kept)))
+	assert.True(t, cfg.filter("up", dropped, fingerprint(dropped)))
+}
+
+func benchmarkFilter(b *testing.B, cache *lruCache) {
+	rules, _ := parseMatchList(`['up{job="node"} and (up{env="prod"} or up{env="staging"})', 'http_requests_total{code>=500}', 'node_cpu_seconds_total{mode="idle"}']`)
+	cfg := serializeConfig{match: rules, filterCache: cache}
+
+	series := make([]map[string]string, 100)
+	fps := make([]uint64, len(series))
+	for i := range series {
+		series[i] = map[string]string{"__name__": "http_requests_total", "code": strconv.Itoa(200 + i*3), "job": "api", "instance": "host-" + strconv.Itoa(i)}
+		fps[i] = fingerprint(series[i])
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := n % len(series)
+		cfg.filter("http_requests_total", series[i], fps[i])
+	}
+}
+
+func BenchmarkFilter(b *testing.B) {
+	benchmarkFilter(b, nil)
+}
+
+func BenchmarkFilterCached(b *testing.B) {
+	benchmarkFilter(b, newLRUCache(1000))
+}
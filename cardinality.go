@@ -0,0 +1,117 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// cardinalityLimiter caps the number of distinct series produced to each
+// topic within a time window. Series are forgotten once they haven't been
+// seen for a whole window.
+type cardinalityLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	series    map[string]*topicSeries
+	lastSweep time.Time
+}
+
+// topicSeries holds the expiry of the series of a topic.
+type topicSeries struct {
+	expiries map[uint64]time.Time
+	// earliest is no later than the earliest expiry, telling when the
+	// series may have to be evicted to make room for new ones
+	earliest time.Time
+}
+
+func newCardinalityLimiter(limit int, window time.Duration) *cardinalityLimiter {
+	return &cardinalityLimiter{
+		limit:  limit,
+		window: window,
+		series: make(map[string]*topicSeries),
+	}
+}
+
+// Allow reports whether the series can be produced to the topic, which is
+// the case for series already known and for new series while the topic is
+// under the limit. The expired series of a topic at the limit are evicted
+// first, so they don't hold the place of new ones until the next sweep.
+func (c *cardinalityLimiter) Allow(topic string, fingerprint uint64, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) >= c.window {
+		c.sweep(now)
+	}
+
+	series, ok := c.series[topic]
+	if !ok {
+		series = &topicSeries{expiries: make(map[uint64]time.Time)}
+		c.series[topic] = series
+	}
+
+	if expiry, ok := series.expiries[fingerprint]; !ok || !now.Before(expiry) {
+		if len(series.expiries) >= c.limit && !now.Before(series.earliest) {
+			series.evict(now)
+		}
+		if len(series.expiries) >= c.limit {
+			return false
+		}
+	}
+	// the expiries only grow, the earliest one is kept by the later ones
+	expiry := now.Add(c.window)
+	if len(series.expiries) == 0 {
+		series.earliest = expiry
+	}
+	series.expiries[fingerprint] = expiry
+	return true
+}
+
+// Len returns the number of series currently tracked for the topic.
+func (c *cardinalityLimiter) Len(topic string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if series, ok := c.series[topic]; ok {
+		return len(series.expiries)
+	}
+	return 0
+}
+
+func (c *cardinalityLimiter) sweep(now time.Time) {
+	for topic, series := range c.series {
+		series.evict(now)
+		if len(series.expiries) == 0 {
+			delete(c.series, topic)
+		}
+	}
+	c.lastSweep = now
+}
+
+// evict removes the expired series, updating the earliest expiry.
+func (s *topicSeries) evict(now time.Time) {
+	s.earliest = time.Time{}
+	for fingerprint, expiry := range s.expiries {
+		if !now.Before(expiry) {
+			delete(s.expiries, fingerprint)
+			continue
+		}
+		if s.earliest.IsZero() || expiry.Before(s.earliest) {
+			s.earliest = expiry
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	limiter := newCardinalityLimiter(2, time.Minute)
+	now := time.Unix(1000, 0)
+
+	assert.True(t, limiter.Allow("metrics", 1, now))
+	assert.True(t, limiter.Allow("metrics", 2, now))
+	assert.False(t, limiter.Allow("metrics", 3, now), "new series beyond the cap should be dropped")
+	assert.True(t, limiter.Allow("metrics", 1, now.Add(30*time.Second)), "known series should keep flowing")
+	assert.True(t, limiter.Allow("other", 3, now), "the cap should apply per topic")
+
+	assert.True(t, limiter.Allow("metrics", 3, now.Add(90*time.Second)), "series not seen within the window should be evicted")
+	assert.Equal(t, 1, limiter.Len("metrics"), "expired series should be evicted")
+}
+
+func TestCardinalityLimiterExpiredBeforeSweep(t *testing.T) {
+	limiter := newCardinalityLimiter(2, time.Minute)
+	now := time.Unix(1000, 0)
+
+	assert.True(t, limiter.Allow("metrics", 1, now))
+	assert.True(t, limiter.Allow("metrics", 2, now.Add(30*time.Second)))
+	assert.True(t, limiter.Allow("metrics", 3, now.Add(60*time.Second)), "the sweep should make room")
+
+	// series 2 expired, while the next sweep is due in 25s
+	assert.True(t, limiter.Allow("metrics", 4, now.Add(95*time.Second)), "expired series shouldn't count against the limit")
+	assert.False(t, limiter.Allow("metrics", 5, now.Add(95*time.Second)))
+	assert.Equal(t, 2, limiter.Len("metrics"))
+}
+
+func TestSerializeCardinalityLimit(t *testing.T) {
+	cardinality = newCardinalityLimiter(1, time.Hour)
+	defer func() { cardinality = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	series := func(instance string) *prompb.TimeSeries {
+		return &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: "foo"},
+				{Name: "labelfoo", Value: "label-bar"},
+				{Name: "instance", Value: instance},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}
+	}
+
+	output, err := SerializeMessages(serializer, &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{series("a"), series("b")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "the second series should exceed the cap")
+
+	output, err = SerializeMessages(serializer, &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{series("a")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "the known series should pass")
+}
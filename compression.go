@@ -0,0 +1,136 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentEncodingHeader is the kafka header telling the compression applied
+// to the message payload
+const contentEncodingHeader = "content-encoding"
+
+// payloadCompressor represents a compression applied to the serialized
+// payload of each message, on top of the kafka batch compression
+type payloadCompressor interface {
+	Encoding() string
+	Compress(data []byte) []byte
+}
+
+// zstdCompressor compresses payloads with zstd, optionally using a
+// pre-trained dictionary
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+}
+
+func (c *zstdCompressor) Encoding() string {
+	return "zstd"
+}
+
+func (c *zstdCompressor) Compress(data []byte) []byte {
+	return c.encoder.EncodeAll(data, nil)
+}
+
+// newZstdCompressor builds a zstd compressor using the dictionary, trained
+// with `zstd --train`, if not empty. The level, from 1 to 22 as in the zstd
+// cli, is mapped to the closest level of the encoder, 0 uses its default.
+func newZstdCompressor(dict []byte, level int) (*zstdCompressor, error) {
+	if level < 0 || level > 22 {
+		return nil, fmt.Errorf("invalid zstd compression level %d, must be between 1 and 22", level)
+	}
+
+	var opts []zstd.EOption
+	if level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if len(dict) > 0 {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{encoder: encoder}, nil
+}
+
+// gzipCompressor compresses payloads with gzip, reusing the writers
+type gzipCompressor struct {
+	writers sync.Pool
+}
+
+func (c *gzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) Compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := c.writers.Get().(*gzip.Writer)
+	defer c.writers.Put(w)
+
+	w.Reset(&buf)
+	// writing to a bytes.Buffer can't fail
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// newGzipCompressor builds a gzip compressor with the level, from 1 (best
+// speed) to 9 (best compression), 0 uses the default level.
+func newGzipCompressor(level int) (*gzipCompressor, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level %d, must be between 1 and 9", level)
+	}
+
+	c := &gzipCompressor{}
+	c.writers.New = func() interface{} {
+		// the level is validated, so it can't fail
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+	return c, nil
+}
+
+func parsePayloadCompression(value, dictPath string, level int) (payloadCompressor, error) {
+	var dict []byte
+	if dictPath != "" {
+		var err error
+		if dict, err = ioutil.ReadFile(dictPath); err != nil {
+			return nil, err
+		}
+	}
+
+	switch value {
+	case "none":
+		return nil, nil
+	case "zstd":
+		return newZstdCompressor(dict, level)
+	case "gzip":
+		if dict != nil {
+			return nil, fmt.Errorf("the gzip payload compression doesn't support dictionaries")
+		}
+		return newGzipCompressor(level)
+	default:
+		return nil, fmt.Errorf("unknown payload compression %q", value)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePayloadCompression(t *testing.T) {
+	compressor, err := parsePayloadCompression("none", "", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, compressor)
+
+	compressor, err = parsePayloadCompression("zstd", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "zstd", compressor.Encoding())
+
+	_, err = parsePayloadCompression("lz4", "", 0)
+	assert.NotNil(t, err)
+
+	_, err = parsePayloadCompression("zstd", "testdata/missing.dict", 0)
+	assert.NotNil(t, err)
+}
+
+func TestPayloadCompressionLevels(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"name":"node_cpu_seconds_total","labels":{"job":"node"},"value":"456"}`), 32)
+
+	decoder, err := zstd.NewReader(nil)
+	assert.Nil(t, err)
+	defer decoder.Close()
+
+	for _, level := range []int{0, 1, 3, 22} {
+		compressor, err := parsePayloadCompression("zstd", "", level)
+		assert.Nil(t, err)
+		decompressed, err := decoder.DecodeAll(compressor.Compress(payload), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, decompressed, "zstd level %d", level)
+	}
+
+	for _, level := range []int{0, 1, 6, 9} {
+		compressor, err := parsePayloadCompression("gzip", "", level)
+		assert.Nil(t, err)
+		assert.Equal(t, "gzip", compressor.Encoding())
+		r, err := gzip.NewReader(bytes.NewReader(compressor.Compress(payload)))
+		assert.Nil(t, err)
+		decompressed, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, decompressed, "gzip level %d", level)
+	}
+
+	for _, tc := range []struct {
+		compression string
+		level       int
+	}{{"zstd", -1}, {"zstd", 23}, {"gzip", -1}, {"gzip", 10}} {
+		_, err := parsePayloadCompression(tc.compression, "", tc.level)
+		assert.NotNil(t, err, "%s level %d", tc.compression, tc.level)
+	}
+
+	_, err = parsePayloadCompression("gzip", "testdata/zstd.dict", 0)
+	assert.NotNil(t, err)
+}
+
+func TestZstdCompressorDictionary(t *testing.T) {
+	dict, err := ioutil.ReadFile("testdata/zstd.dict")
+	assert.Nil(t, err)
+
+	compressor, err := parsePayloadCompression("zstd", "testdata/zstd.dict", 0)
+	assert.Nil(t, err)
+
+	payload := []byte(`{"timestamp":"2026-01-01T00:00:00Z","value":"456","name":"node_cpu_seconds_total","labels":{"__name__":"node_cpu_seconds_total","env":"prod","instance":"host-1:9100","job":"node"}}`)
+	compressed := compressor.Compress(payload)
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict))
+	assert.Nil(t, err)
+	defer decoder.Close()
+
+	decompressed, err := decoder.DecodeAll(compressed, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, decompressed)
+
+	plain, err := zstd.NewReader(nil)
+	assert.Nil(t, err)
+	defer plain.Close()
+
+	_, err = plain.DecodeAll(compressed, nil)
+	assert.NotNil(t, err, "payload compressed with a dictionary should not decompress without it")
+}
+
+func TestSerializeCompressedPayload(t *testing.T) {
+	var err error
+	payloadCompression, err = parsePayloadCompression("zstd", "", 0)
+	assert.Nil(t, err)
+	defer func() { payloadCompression = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+
+	decoder, err := zstd.NewReader(nil)
+	assert.Nil(t, err)
+	defer decoder.Close()
+
+	count := 0
+	for _, messages := range output {
+		for _, msg := range messages {
+			count++
+			assert.Len(t, msg.Headers, 1)
+			assert.Equal(t, contentEncodingHeader, msg.Headers[0].Key)
+			assert.Equal(t, "zstd", string(msg.Headers[0].Value))
+
+			value, err := decoder.DecodeAll(msg.Value, nil)
+			assert.Nil(t, err)
+			assert.Contains(t, string(value), `"name":"foo"`)
+		}
+	}
+	assert.Equal(t, 2, count)
+}
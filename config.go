@@ -19,9 +19,17 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/sirupsen/logrus"
 )
@@ -29,13 +37,35 @@ import (
 var (
 	kafkaBrokerList        = "kafka:9092"
 	kafkaTopic             = "metrics"
+	topicLowercase         = false
+	topicLookupLabel       string
+	topicLookup            map[string]string
+	topicLookupDefault     string
+	rulesMu                sync.RWMutex // guards topicTemplate and match, replaced on SIGHUP by reloadRules
 	topicTemplate          *template.Template
+	computedFields         = make(map[string]*template.Template)
 	match                  = make(map[string]*dto.MetricFamily, 0)
+	filterProfiles         = make(map[string]map[string]*dto.MetricFamily)
+	filterRoutes           = make(map[string]string)
+	filteredTopic          string
+	priorityRules          map[string]*dto.MetricFamily
+	priorityQueueSize      = 10000
+	priorityProduceTimeout = 30 * time.Second
 	basicauth              = false
 	basicauthUsername      = ""
 	basicauthPassword      = ""
 	kafkaCompression       = "none"
 	kafkaBatchNumMessages  = "10000"
+	kafkaMaxInFlight       int
+	kafkaQueueMaxMessages  int
+	kafkaQueueMaxKbytes    int
+	kafkaLingerMs          = -1
+	kafkaClientID          string
+	kafkaMetadataRefreshMs int
+	kafkaProducers         = 1
+	producerDistribution   = "round-robin"
+	shutdownFlushTimeout   = 10 * time.Second
+	produceOrdering        = "none"
 	kafkaSslClientCertFile = ""
 	kafkaSslClientKeyFile  = ""
 	kafkaSslClientKeyPass  = ""
@@ -44,7 +74,89 @@ var (
 	kafkaSaslMechanism     = ""
 	kafkaSaslUsername      = ""
 	kafkaSaslPassword      = ""
+	kafkaSaslPasswordFile  string
+	syncProduce            = false
+	logErrorSampling       = 1
+	heartbeatTopic         = ""
+	heartbeatInterval      = 30 * time.Second
+	adapterID              = ""
+	provenanceLabel        string
+	provenanceConflict     = "rename"
+	instanceHostMode       string
+	tenantHeader           string
+	tenantHeaderLabel      = "tenant"
+	tenantDefault          string
+	streamDecodeBatch      = 0
+	maxSamplesPerRequest   = 0
+	maxSamplesPolicy       = "reject"
+	queueFullPolicy        = "reject"
+	queueFullRetryInterval = 10 * time.Millisecond
+	retryAfter             = 5 * time.Second
+	inFlightSlots          chan struct{}
+	dedup                  *dedupCache
+	sampleConflictPolicy   = ""
+	cardinality            *cardinalityLimiter
+	seriesRateLimit        *rateLimiter
+	aggregation            *aggregator
+	topicCache             *lruCache
+	filterCache            *lruCache
+	partitioner            Partitioner = defaultPartitioner{}
+	partitionLabel         string
+	emptyLabelPolicy       = "keep"
+	requiredLabels         []string
+	dropSuffixes           []string
+	nameFallbackLabels     []string
+	metricNameValidation   = "off"
+	labelValueMaxLength    = 0
+	labelValueOverflow     = "truncate"
+	labelTruncationSuffix  = "…"
+	stripInternalLabels    bool
+	stripNameLabel         bool
+	sampleRecordTimestamp  bool
+	timestampLabel         string
+	timestampLabelRecord   bool
+	sortSamples            bool
+	schemaVersion          string
+	schemaVersionHeader    bool
+	timeWindowStart        time.Time
+	timeWindowEnd          time.Time
+	timeWindowLast         time.Duration
+	maxSampleAge           time.Duration
+	maxFutureSkew          time.Duration
+	clampSampleBounds      bool
+	keySource              = ""
+	staleTombstones        bool
+	sequenceHeaders        bool
+	sequenceScope          = "topic"
+	messageTTLMode         = "absolute"
+	batchGroupByKey        bool
+	jsonEscapeHTML         = true
+	jsonExplicitNulls      bool
+	jsonValueNumber        bool
+	debugHeaders           bool
+	avroFieldOrder         = "schema"
+	omitTimestamp          bool
+	seriesIDField          bool
+	fallbackFormat         string
+	fallbackSerializer     Serializer
+	selfTestEnabled        bool
+	selfTestTopic          string
+	selfTestTimeout        = 10 * time.Second
+	keyTimestampWidth      = 13
+	acceptedContentTypes   = []string{"application/x-protobuf"}
+	valueRound             = -1
+	valueTransforms        []valueTransform
+	infPolicy              = "text"
+	produceOverrides       []produceOverride
+	outputBackend          = "kafka"
+	ocfDirectory           string
+	ocfMaxBytes            = 64 << 20
+	ocfMaxAge              = 5 * time.Minute
+	payloadCompression     payloadCompressor
+	compressionLevel       int
 	serializer             Serializer
+	serializationFormat    = "json"
+	partitionerKind        = "default"
 )
 
 func init() {
@@ -55,102 +167,1432 @@ func init() {
 		logrus.SetLevel(parseLogLevel(value))
 	}
 
+	if value := os.Getenv("LOG_ERROR_SAMPLING"); value != "" {
+		every, err := strconv.Atoi(value)
+		if err != nil || every < 1 {
+			logrus.WithError(err).Fatalln("couldn't parse the log error sampling")
+		}
+		logErrorSampling = every
+	}
+
 	if value := os.Getenv("KAFKA_BROKER_LIST"); value != "" {
 		kafkaBrokerList = value
 	}
 
-	if value := os.Getenv("KAFKA_TOPIC"); value != "" {
-		kafkaTopic = value
+	if value := os.Getenv("KAFKA_TOPIC"); value != "" {
+		kafkaTopic = value
+	}
+
+	if value := os.Getenv("BASIC_AUTH_USERNAME"); value != "" {
+		basicauth = true
+		basicauthUsername = value
+	}
+
+	if value := os.Getenv("BASIC_AUTH_PASSWORD"); value != "" {
+		basicauthPassword = value
+	}
+
+	if value := os.Getenv("SIGNING_KEY"); value != "" {
+		signingKey = []byte(value)
+	}
+
+	if value := os.Getenv("KAFKA_COMPRESSION"); value != "" {
+		kafkaCompression = value
+	}
+
+	if value := os.Getenv("KAFKA_BATCH_NUM_MESSAGES"); value != "" {
+		kafkaBatchNumMessages = value
+	}
+
+	if value := os.Getenv("KAFKA_MAX_IN_FLIGHT"); value != "" {
+		kafkaMaxInFlight = parseIntRange("KAFKA_MAX_IN_FLIGHT", value, 1, 1000000)
+	}
+
+	if value := os.Getenv("KAFKA_QUEUE_MAX_MESSAGES"); value != "" {
+		kafkaQueueMaxMessages = parseIntRange("KAFKA_QUEUE_MAX_MESSAGES", value, 1, 2147483647)
+	}
+
+	if value := os.Getenv("KAFKA_QUEUE_MAX_KBYTES"); value != "" {
+		kafkaQueueMaxKbytes = parseIntRange("KAFKA_QUEUE_MAX_KBYTES", value, 1, 2147483647)
+	}
+
+	if value := os.Getenv("KAFKA_LINGER_MS"); value != "" {
+		kafkaLingerMs = parseIntRange("KAFKA_LINGER_MS", value, 0, 900000)
+	}
+
+	if value := os.Getenv("KAFKA_CLIENT_ID"); value != "" {
+		kafkaClientID = value
+	}
+
+	if value := os.Getenv("KAFKA_METADATA_REFRESH_MS"); value != "" {
+		kafkaMetadataRefreshMs = parseIntRange("KAFKA_METADATA_REFRESH_MS", value, 1000, 3600000)
+	}
+
+	if value := os.Getenv("KAFKA_PRODUCERS"); value != "" {
+		kafkaProducers = parseIntRange("KAFKA_PRODUCERS", value, 1, 64)
+	}
+
+	if value := os.Getenv("KAFKA_PRODUCER_DISTRIBUTION"); value != "" {
+		producerDistribution = parseProducerDistribution(value)
+	}
+
+	if value := os.Getenv("ORDERING"); value != "" {
+		produceOrdering = parseOrdering(value)
+	}
+
+	if value := os.Getenv("SHUTDOWN_FLUSH_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			logrus.WithField("shutdown-flush-timeout-value", value).Fatalln("couldn't parse the shutdown flush timeout")
+		}
+		shutdownFlushTimeout = timeout
+	}
+
+	if value := os.Getenv("KAFKA_SSL_CLIENT_CERT_FILE"); value != "" {
+		kafkaSslClientCertFile = value
+	}
+
+	if value := os.Getenv("KAFKA_SSL_CLIENT_KEY_FILE"); value != "" {
+		kafkaSslClientKeyFile = value
+	}
+
+	if value := os.Getenv("KAFKA_SSL_CLIENT_KEY_PASS"); value != "" {
+		kafkaSslClientKeyPass = value
+	}
+
+	if value := os.Getenv("KAFKA_SSL_CA_CERT_FILE"); value != "" {
+		kafkaSslCACertFile = value
+	}
+
+	if value := os.Getenv("KAFKA_SECURITY_PROTOCOL"); value != "" {
+		kafkaSecurityProtocol = strings.ToLower(value)
+	}
+
+	if value := os.Getenv("KAFKA_SASL_MECHANISM"); value != "" {
+		kafkaSaslMechanism = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_USERNAME"); value != "" {
+		kafkaSaslUsername = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_PASSWORD"); value != "" {
+		kafkaSaslPassword = value
+	}
+
+	if value := os.Getenv("KAFKA_SASL_PASSWORD_FILE"); value != "" {
+		kafkaSaslPasswordFile = value
+	}
+
+	if value := os.Getenv("SYNC_PRODUCE"); value != "" {
+		syncProduce = parseBool("SYNC_PRODUCE", value)
+	}
+
+	if value := os.Getenv("QUEUE_FULL_POLICY"); value != "" {
+		queueFullPolicy = parseQueueFullPolicy(value)
+	}
+
+	if err := validateOrdering(produceOrdering, kafkaMaxInFlight, kafkaProducers, producerDistribution, queueFullPolicy); err != nil {
+		logrus.WithError(err).Fatalln("invalid config")
+	}
+
+	if value := os.Getenv("RETRY_AFTER"); value != "" {
+		after, err := time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the retry after duration")
+		}
+		retryAfter = after
+	}
+
+	if value := os.Getenv("MAX_IN_FLIGHT_REQUESTS"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			logrus.WithField("max-in-flight-requests-value", value).Fatalln("couldn't parse the max in flight requests")
+		}
+		if limit > 0 {
+			inFlightSlots = make(chan struct{}, limit)
+		}
+	}
+
+	if value := os.Getenv("HEARTBEAT_TOPIC"); value != "" {
+		heartbeatTopic = value
+	}
+
+	if value := os.Getenv("HEARTBEAT_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			logrus.WithError(err).Fatalln("couldn't parse the heartbeat interval")
+		}
+		heartbeatInterval = interval
+	}
+
+	adapterID, _ = os.Hostname()
+	if value := os.Getenv("ADAPTER_ID"); value != "" {
+		adapterID = value
+	}
+
+	if value := os.Getenv("PROVENANCE_LABEL"); value != "" {
+		provenanceLabel = value
+	}
+
+	if value := os.Getenv("PROVENANCE_CONFLICT_POLICY"); value != "" {
+		provenanceConflict = parseProvenanceConflictPolicy(value)
+	}
+
+	if value := os.Getenv("TENANT_HEADER"); value != "" {
+		tenantHeader = value
+	}
+
+	if value := os.Getenv("TENANT_HEADER_LABEL"); value != "" {
+		tenantHeaderLabel = value
+	}
+
+	if value := os.Getenv("TENANT_DEFAULT"); value != "" {
+		tenantDefault = value
+	}
+
+	if value := os.Getenv("INSTANCE_HOST_LABEL"); value != "" {
+		instanceHostMode = parseInstanceHostMode(value)
+	}
+
+	if value := os.Getenv("MAX_SAMPLES_PER_REQUEST"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			logrus.WithField("max-samples-per-request-value", value).Fatalln("couldn't parse the max samples per request")
+		}
+		maxSamplesPerRequest = limit
+	}
+
+	if value := os.Getenv("MAX_SAMPLES_POLICY"); value != "" {
+		maxSamplesPolicy = parseMaxSamplesPolicy(value)
+	}
+
+	if value := os.Getenv("STREAM_DECODE_BATCH"); value != "" {
+		batch, err := strconv.Atoi(value)
+		if err != nil || batch < 0 {
+			logrus.WithError(err).Fatalln("couldn't parse the stream decode batch")
+		}
+		streamDecodeBatch = batch
+	}
+
+	if value := os.Getenv("DEDUP_WINDOW"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the deduplication window")
+		}
+		if window > 0 {
+			dedup = newDedupCache(window)
+		}
+	}
+
+	if value := os.Getenv("SERIES_RATE_LIMIT"); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			logrus.WithField("series-rate-limit-value", value).Fatalln("couldn't parse the series rate limit")
+		}
+		burst := int(math.Ceil(rate))
+		if value := os.Getenv("SERIES_RATE_BURST"); value != "" {
+			if burst, err = strconv.Atoi(value); err != nil || burst < 1 {
+				logrus.WithField("series-rate-burst-value", value).Fatalln("couldn't parse the series rate burst")
+			}
+		}
+		maxSeries := 100000
+		if value := os.Getenv("SERIES_RATE_MAX_SERIES"); value != "" {
+			if maxSeries, err = strconv.Atoi(value); err != nil || maxSeries < 1 {
+				logrus.WithField("series-rate-max-series-value", value).Fatalln("couldn't parse the series rate max series")
+			}
+		}
+		if rate > 0 {
+			if burst < 1 {
+				burst = 1
+			}
+			seriesRateLimit = newRateLimiter(rate, burst, maxSeries)
+		}
+	}
+
+	if value := os.Getenv("SAMPLE_CONFLICT_POLICY"); value != "" {
+		sampleConflictPolicy = parseSampleConflictPolicy(value)
+	}
+
+	if value := os.Getenv("CARDINALITY_LIMIT"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the cardinality limit")
+		}
+		window := time.Hour
+		if value := os.Getenv("CARDINALITY_WINDOW"); value != "" {
+			if window, err = time.ParseDuration(value); err != nil || window <= 0 {
+				logrus.WithError(err).Fatalln("couldn't parse the cardinality window")
+			}
+		}
+		if limit > 0 {
+			cardinality = newCardinalityLimiter(limit, window)
+		}
+	}
+
+	if value := os.Getenv("AGGREGATION_WINDOW"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the aggregation window")
+		}
+		// windows are handled in milliseconds, the sample timestamp unit
+		if window > 0 && window < time.Millisecond {
+			logrus.WithField("aggregation-window", value).Fatalln("invalid config: the aggregation window must be at least 1ms")
+		}
+		maxSeries := 100000
+		if value := os.Getenv("AGGREGATION_MAX_SERIES"); value != "" {
+			if maxSeries, err = strconv.Atoi(value); err != nil || maxSeries <= 0 {
+				logrus.WithError(err).Fatalln("couldn't parse the aggregation max series")
+			}
+		}
+		if window > 0 {
+			aggregation = newAggregator(window, parseAggregationFunction(os.Getenv("AGGREGATION_FUNCTION")), maxSeries)
+		}
+	}
+
+	if value := os.Getenv("TOPIC_LOWERCASE"); value != "" {
+		topicLowercase = parseBool("TOPIC_LOWERCASE", value)
+	}
+
+	if value := os.Getenv("TOPIC_LOOKUP"); value != "" {
+		lookup, err := parseTopicLookup(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the topic lookup table")
+		}
+		topicLookup = lookup
+	}
+
+	if value := os.Getenv("TOPIC_LOOKUP_LABEL"); value != "" {
+		topicLookupLabel = value
+	}
+
+	if value := os.Getenv("TOPIC_LOOKUP_DEFAULT"); value != "" {
+		topicLookupDefault = value
+	}
+
+	if topicLookup != nil && topicLookupLabel == "" {
+		logrus.Fatalln("invalid config: TOPIC_LOOKUP requires TOPIC_LOOKUP_LABEL")
+	}
+
+	if value := os.Getenv("TOPIC_CACHE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the topic cache size")
+		}
+		if size > 0 {
+			topicCache = newLRUCache(size)
+		}
+	}
+
+	if value := os.Getenv("PRIORITY_MATCH"); value != "" {
+		rules, err := parseMatchList(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the priority match rules")
+		}
+		priorityRules = rules
+	}
+
+	if value := os.Getenv("PRIORITY_QUEUE_SIZE"); value != "" {
+		priorityQueueSize = parseIntRange("PRIORITY_QUEUE_SIZE", value, 1, 10000000)
+	}
+
+	if value := os.Getenv("PRIORITY_PRODUCE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			logrus.WithField("priority-produce-timeout-value", value).Fatalln("couldn't parse the priority produce timeout")
+		}
+		priorityProduceTimeout = timeout
+	}
+
+	if value := os.Getenv("FILTERED_TOPIC"); value != "" {
+		filteredTopic = value
+	}
+
+	if value := os.Getenv("FILTER_CACHE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the filter cache size")
+		}
+		if size > 0 {
+			filterCache = newLRUCache(size)
+		}
+	}
+
+	if value := os.Getenv("PARTITION_LABEL"); value != "" {
+		partitionLabel = value
+	}
+
+	if value := os.Getenv("EMPTY_LABEL_POLICY"); value != "" {
+		emptyLabelPolicy = parseEmptyLabelPolicy(value)
+	}
+
+	if value := os.Getenv("LABEL_VALUE_MAX_LENGTH"); value != "" {
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			logrus.WithField("label-value-max-length-value", value).Fatalln("couldn't parse the label value max length")
+		}
+		labelValueMaxLength = length
+	}
+
+	if value := os.Getenv("LABEL_VALUE_OVERFLOW_POLICY"); value != "" {
+		labelValueOverflow = parseLabelValueOverflowPolicy(value)
+	}
+
+	if value, ok := os.LookupEnv("LABEL_TRUNCATION_SUFFIX"); ok {
+		labelTruncationSuffix = value
+	}
+
+	if value := os.Getenv("REQUIRED_LABELS"); value != "" {
+		for _, label := range strings.Split(value, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				requiredLabels = append(requiredLabels, label)
+			}
+		}
+	}
+
+	if value := os.Getenv("DROP_METRIC_SUFFIXES"); value != "" {
+		for _, suffix := range strings.Split(value, ",") {
+			if suffix = strings.TrimSpace(suffix); suffix != "" {
+				dropSuffixes = append(dropSuffixes, suffix)
+			}
+		}
+	}
+
+	if value := os.Getenv("NAME_FALLBACK_LABELS"); value != "" {
+		for _, label := range strings.Split(value, ",") {
+			if label = strings.TrimSpace(label); label != "" && label != "__name__" {
+				nameFallbackLabels = append(nameFallbackLabels, label)
+			}
+		}
+	}
+
+	if value := os.Getenv("METRIC_NAME_VALIDATION"); value != "" {
+		metricNameValidation = parseMetricNameValidation(value)
+	}
+
+	if value := os.Getenv("STRIP_INTERNAL_LABELS"); value != "" {
+		stripInternalLabels = parseBool("STRIP_INTERNAL_LABELS", value)
+	}
+
+	if value := os.Getenv("STRIP_NAME_LABEL"); value != "" {
+		stripNameLabel = parseBool("STRIP_NAME_LABEL", value)
+	}
+
+	if value := os.Getenv("RECORD_TIMESTAMP_FROM_SAMPLE"); value != "" {
+		sampleRecordTimestamp = parseBool("RECORD_TIMESTAMP_FROM_SAMPLE", value)
+	}
+
+	if value := os.Getenv("TIMESTAMP_LABEL"); value != "" {
+		timestampLabel = value
+	}
+
+	if value := os.Getenv("TIMESTAMP_LABEL_RECORD"); value != "" {
+		timestampLabelRecord = parseBool("TIMESTAMP_LABEL_RECORD", value)
+	}
+
+	if value := os.Getenv("SORT_SAMPLES"); value != "" {
+		sortSamples = parseBool("SORT_SAMPLES", value)
+	}
+
+	if value := os.Getenv("SCHEMA_VERSION"); value != "" {
+		schemaVersion = value
+	}
+
+	if value := os.Getenv("SCHEMA_VERSION_TARGET"); value != "" {
+		schemaVersionHeader = parseSchemaVersionTarget(value)
+	}
+
+	if value := os.Getenv("TIME_WINDOW_START"); value != "" {
+		start, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the time window start")
+		}
+		timeWindowStart = start
+	}
+
+	if value := os.Getenv("TIME_WINDOW_END"); value != "" {
+		end, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the time window end")
+		}
+		timeWindowEnd = end
+	}
+
+	if value := os.Getenv("TIME_WINDOW_LAST"); value != "" {
+		last, err := time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the time window duration")
+		}
+		timeWindowLast = last
+	}
+
+	if value := os.Getenv("MAX_SAMPLE_AGE"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the max sample age")
+		}
+		maxSampleAge = age
+	}
+
+	if value := os.Getenv("MAX_FUTURE_SKEW"); value != "" {
+		skew, err := time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the max future skew")
+		}
+		maxFutureSkew = skew
+	}
+
+	if value := os.Getenv("SAMPLE_BOUNDS_ACTION"); value != "" {
+		clampSampleBounds = parseSampleBoundsAction(value)
+	}
+
+	if value := os.Getenv("KEY_SOURCE"); value != "" {
+		keySource = parseKeySource(value)
+	}
+
+	if value := os.Getenv("SELFTEST_ENABLED"); value != "" {
+		selfTestEnabled = parseBool("SELFTEST_ENABLED", value)
+	}
+
+	if value := os.Getenv("SELFTEST_TOPIC"); value != "" {
+		selfTestTopic = value
+	}
+
+	if value := os.Getenv("SELFTEST_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			logrus.WithField("selftest-timeout-value", value).Fatalln("couldn't parse the self-test timeout")
+		}
+		selfTestTimeout = timeout
+	}
+
+	if value := os.Getenv("DEBUG"); value != "" {
+		debugHeaders = parseBool("DEBUG", value)
+	}
+
+	if value := os.Getenv("JSON_ESCAPE_HTML"); value != "" {
+		jsonEscapeHTML = parseBool("JSON_ESCAPE_HTML", value)
+	}
+
+	if value := os.Getenv("JSON_EXPLICIT_NULLS"); value != "" {
+		jsonExplicitNulls = parseBool("JSON_EXPLICIT_NULLS", value)
+	}
+
+	if value := os.Getenv("JSON_VALUE_NUMBER"); value != "" {
+		jsonValueNumber = parseBool("JSON_VALUE_NUMBER", value)
+	}
+
+	if value := os.Getenv("BATCH_GROUP_BY_KEY"); value != "" {
+		batchGroupByKey = parseBool("BATCH_GROUP_BY_KEY", value)
+	}
+
+	var messageTTLDefault time.Duration
+	if value := os.Getenv("MESSAGE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			logrus.WithField("message-ttl-value", value).Fatalln("couldn't parse the message ttl")
+		}
+		messageTTLDefault = ttl
+	}
+
+	var messageTTLTopics map[string]time.Duration
+	if value := os.Getenv("MESSAGE_TTL_TOPICS"); value != "" {
+		topics, err := parseMessageTTLTopics(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the message ttl topics")
+		}
+		messageTTLTopics = topics
+	}
+
+	if value := os.Getenv("MESSAGE_TTL_MODE"); value != "" {
+		messageTTLMode = parseMessageTTLMode(value)
+	}
+
+	if messageTTLDefault > 0 || len(messageTTLTopics) > 0 {
+		messageExpiry = newMessageTTL(messageTTLMode, messageTTLDefault, messageTTLTopics)
+	}
+
+	if value := os.Getenv("SEQUENCE_HEADERS"); value != "" {
+		sequenceHeaders = parseBool("SEQUENCE_HEADERS", value)
+	}
+
+	if value := os.Getenv("SEQUENCE_SCOPE"); value != "" {
+		sequenceScope = parseSequenceScope(value)
+	}
+
+	if sequenceHeaders {
+		messageSequence = newSequencer(sequenceScope, time.Now())
+	}
+
+	if value := os.Getenv("STALE_TOMBSTONES"); value != "" {
+		staleTombstones = parseBool("STALE_TOMBSTONES", value)
+	}
+
+	if value := os.Getenv("KEY_TIMESTAMP_WIDTH"); value != "" {
+		width, err := strconv.Atoi(value)
+		if err != nil || width < 0 {
+			logrus.WithField("key-timestamp-width-value", value).Fatalln("couldn't parse the key timestamp width")
+		}
+		keyTimestampWidth = width
+	}
+
+	if value := os.Getenv("ACCEPTED_CONTENT_TYPES"); value != "" {
+		for _, contentType := range strings.Split(value, ",") {
+			if contentType = strings.TrimSpace(contentType); contentType != "" {
+				acceptedContentTypes = append(acceptedContentTypes, strings.ToLower(contentType))
+			}
+		}
+	}
+
+	if value := os.Getenv("INF_POLICY"); value != "" {
+		infPolicy = parseInfPolicy(value)
+	}
+
+	if value := os.Getenv("VALUE_ROUND"); value != "" {
+		decimals, err := strconv.Atoi(value)
+		if err != nil || decimals < 0 {
+			logrus.WithField("value-round-value", value).Fatalln("couldn't parse the value rounding decimals")
+		}
+		valueRound = decimals
+	}
+
+	if value := os.Getenv("VALUE_TRANSFORMS"); value != "" {
+		transforms, err := parseValueTransforms(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the value transforms")
+		}
+		valueTransforms = transforms
+	}
+
+	if value := os.Getenv("PRODUCE_OVERRIDES"); value != "" {
+		overrides, err := parseProduceOverrides(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the produce overrides")
+		}
+		produceOverrides = overrides
+	}
+
+	if value := os.Getenv("OUTPUT_BACKEND"); value != "" {
+		outputBackend = parseOutputBackend(value)
+	}
+
+	if value := os.Getenv("OCF_DIRECTORY"); value != "" {
+		ocfDirectory = value
+	}
+
+	if value := os.Getenv("OCF_MAX_BYTES"); value != "" {
+		maxBytes, err := strconv.Atoi(value)
+		if err != nil || maxBytes <= 0 {
+			logrus.WithField("ocf-max-bytes-value", value).Fatalln("couldn't parse the ocf max bytes")
+		}
+		ocfMaxBytes = maxBytes
+	}
+
+	if value := os.Getenv("OCF_MAX_AGE"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge <= 0 {
+			logrus.WithField("ocf-max-age-value", value).Fatalln("couldn't parse the ocf max age")
+		}
+		ocfMaxAge = maxAge
+	}
+
+	if value := os.Getenv("PAYLOAD_COMPRESSION"); value != "" {
+		if value := os.Getenv("COMPRESSION_LEVEL"); value != "" {
+			level, err := strconv.Atoi(value)
+			if err != nil {
+				logrus.WithField("compression-level-value", value).Fatalln("couldn't parse the compression level")
+			}
+			compressionLevel = level
+		}
+		compressor, err := parsePayloadCompression(value, os.Getenv("PAYLOAD_COMPRESSION_DICTIONARY"), compressionLevel)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't configure the payload compression")
+		}
+		payloadCompression = compressor
+	}
+
+	if matchRules, err := loadMatchRules(os.Getenv("MATCH"), os.Getenv("MATCH_FILES")); err != nil {
+		logrus.WithError(err).Fatalln("couldn't load the match rules")
+	} else {
+		match = matchRules
+	}
+
+	if value := os.Getenv("COMPUTED_FIELDS"); value != "" {
+		fields, err := parseComputedFields(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the computed fields")
+		}
+		computedFields = fields
+	}
+
+	if value := os.Getenv("FILTER_PROFILES"); value != "" {
+		profiles, err := parseFilterProfiles(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the filter profiles")
+		}
+		filterProfiles = profiles
+	}
+
+	if value := os.Getenv("FILTER_ROUTES"); value != "" {
+		routes, err := parseFilterRoutes(value, filterProfiles)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't parse the filter routes")
+		}
+		filterRoutes = routes
+	}
+
+	if value := os.Getenv("OMIT_TIMESTAMP"); value != "" {
+		omitTimestamp = parseBool("OMIT_TIMESTAMP", value)
+	}
+
+	if value := os.Getenv("SERIES_ID_FIELD"); value != "" {
+		seriesIDField = parseBool("SERIES_ID_FIELD", value)
+	}
+
+	if value := os.Getenv("AVRO_FIELD_ORDER"); value != "" {
+		avroFieldOrder = parseAvroFieldOrder(value)
+	}
+
+	if value := os.Getenv("SERIALIZATION_FORMAT"); value != "" {
+		serializationFormat = value
+	}
+
+	var err error
+	serializer, err = parseSerializationFormat(serializationFormat)
+	if err != nil {
+		logrus.WithError(err).Fatalln("couldn't create a metrics serializer")
+	}
+
+	if _, ok := serializer.(*ParquetSerializer); ok && omitTimestamp {
+		logrus.Fatalln("invalid config: the parquet serialization format can't omit the timestamp")
+	}
+
+	if value := os.Getenv("FALLBACK_SERIALIZER"); value != "" {
+		fallbackFormat = value
+		fallbackSerializer, err = parseFallbackSerializer(value)
+		if err != nil {
+			logrus.WithError(err).Fatalln("couldn't create the fallback serializer")
+		}
+	}
+
+	partitioner, err = newPartitioner(os.Getenv("PARTITIONER"), os.Getenv)
+	if err != nil {
+		logrus.WithError(err).Fatalln("couldn't create the partitioner")
+	}
+	partitionerKind = partitionerName(os.Getenv("PARTITIONER"), os.Getenv)
+	// librdkafka picks the partition after the message is numbered
+	if _, ok := partitioner.(defaultPartitioner); ok && sequenceHeaders && sequenceScope == "partition" {
+		logrus.Fatalln("invalid config: the partition SEQUENCE_SCOPE requires a PARTITIONER picking the partitions")
+	}
+	// the json-bulk topic is only known once the whole request is serialized
+	if _, ok := serializer.(BulkSerializer); ok {
+		if _, ok := partitioner.(defaultPartitioner); !ok || partitionLabel != "" || len(priorityRules) > 0 {
+			logrus.Fatalln("invalid config: the json-bulk serialization format can't be combined with PARTITIONER, PARTITION_LABEL or PRIORITY_MATCH")
+		}
+	}
+	if partitionLabel != "" {
+		partitioner = labelPartitioner{label: partitionLabel, inner: partitioner}
+	}
+
+	topicTemplate, err = parseTopicTemplate(kafkaTopic)
+	if err != nil {
+		logrus.WithError(err).Fatalln("invalid config: couldn't parse the KAFKA_TOPIC template")
+	}
+}
+
+// loadMatchRules parses the MATCH rules, merged with those of the
+// MATCH_FILES.
+func loadMatchRules(value, files string) (map[string]*dto.MetricFamily, error) {
+	matchRules := make(map[string]*dto.MetricFamily)
+	if value != "" {
+		matchList, err := parseMatchList(value)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the match rules: %s", err)
+		}
+		matchRules = matchList
+	}
+
+	if files != "" {
+		conflicts, err := parseMatchFiles(strings.Split(files, ","), matchRules)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the match files: %s", err)
+		}
+		for _, conflict := range conflicts {
+			logrus.WithField("conflict", conflict).Warningln("conflicting match rules")
+		}
+	}
+	return matchRules, nil
+}
+
+// reloadRules reads the MATCH_FILES again, replacing the match rules in use.
+// The rules in use are kept if the files can't be parsed.
+func reloadRules() error {
+	matchRules, err := loadMatchRules(os.Getenv("MATCH"), os.Getenv("MATCH_FILES"))
+	if err != nil {
+		return err
+	}
+
+	rulesMu.RLock()
+	tpl := topicTemplate
+	rulesMu.RUnlock()
+	setRules(matchRules, tpl)
+	return nil
+}
+
+// setRules replaces the match rules and topic template in use, clearing the
+// topics cached with the previous template.
+func setRules(matchRules map[string]*dto.MetricFamily, tpl *template.Template) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	match = matchRules
+	topicTemplate = tpl
+	if topicCache != nil {
+		topicCache.Purge()
+	}
+	if filterCache != nil {
+		filterCache.Purge()
+	}
+}
+
+// redacted replaces the secrets in the effective configuration.
+const redacted = "<redacted>"
+
+// effectiveConfig returns the configuration in use, keyed by the environment
+// variables setting it, with the secrets redacted.
+func effectiveConfig() map[string]interface{} {
+	secret := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return redacted
+	}
+	duration := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return d.String()
+	}
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	rulesMu.RLock()
+	topic := ""
+	if topicTemplate != nil && topicTemplate.Tree != nil {
+		topic = topicTemplate.Root.String()
+	}
+	matchRules := matchRulesText(match)
+	rulesMu.RUnlock()
+
+	profiles := make(map[string][]string, len(filterProfiles))
+	for name, rules := range filterProfiles {
+		profiles[name] = matchRulesText(rules)
+	}
+	fields := make(map[string]string, len(computedFields))
+	for name, tpl := range computedFields {
+		fields[name] = tpl.Root.String()
+	}
+
+	config := map[string]interface{}{
+		"KAFKA_BROKER_LIST":            kafkaBrokerList,
+		"KAFKA_TOPIC":                  topic,
+		"TOPIC_LOWERCASE":              topicLowercase,
+		"TOPIC_LOOKUP_LABEL":           topicLookupLabel,
+		"TOPIC_LOOKUP":                 topicLookup,
+		"TOPIC_LOOKUP_DEFAULT":         topicLookupDefault,
+		"KAFKA_COMPRESSION":            kafkaCompression,
+		"KAFKA_BATCH_NUM_MESSAGES":     kafkaBatchNumMessages,
+		"KAFKA_MAX_IN_FLIGHT":          kafkaMaxInFlight,
+		"KAFKA_QUEUE_MAX_MESSAGES":     kafkaQueueMaxMessages,
+		"KAFKA_QUEUE_MAX_KBYTES":       kafkaQueueMaxKbytes,
+		"KAFKA_LINGER_MS":              kafkaLingerMs,
+		"KAFKA_CLIENT_ID":              kafkaClientID,
+		"KAFKA_METADATA_REFRESH_MS":    kafkaMetadataRefreshMs,
+		"KAFKA_PRODUCERS":              kafkaProducers,
+		"KAFKA_PRODUCER_DISTRIBUTION":  producerDistribution,
+		"SHUTDOWN_FLUSH_TIMEOUT":       duration(shutdownFlushTimeout),
+		"ORDERING":                     produceOrdering,
+		"KAFKA_SSL_CLIENT_CERT_FILE":   kafkaSslClientCertFile,
+		"KAFKA_SSL_CLIENT_KEY_FILE":    kafkaSslClientKeyFile,
+		"KAFKA_SSL_CLIENT_KEY_PASS":    secret(kafkaSslClientKeyPass),
+		"KAFKA_SSL_CA_CERT_FILE":       kafkaSslCACertFile,
+		"KAFKA_SECURITY_PROTOCOL":      kafkaSecurityProtocol,
+		"KAFKA_SASL_MECHANISM":         kafkaSaslMechanism,
+		"KAFKA_SASL_USERNAME":          kafkaSaslUsername,
+		"KAFKA_SASL_PASSWORD":          secret(kafkaSaslPassword),
+		"KAFKA_SASL_PASSWORD_FILE":     kafkaSaslPasswordFile,
+		"BASIC_AUTH_USERNAME":          basicauthUsername,
+		"BASIC_AUTH_PASSWORD":          secret(basicauthPassword),
+		"SIGNING_KEY":                  secret(string(signingKey)),
+		"MATCH":                        matchRules,
+		"FILTER_PROFILES":              profiles,
+		"FILTER_ROUTES":                filterRoutes,
+		"FILTERED_TOPIC":               filteredTopic,
+		"PRIORITY_MATCH":               matchRulesText(priorityRules),
+		"PRIORITY_QUEUE_SIZE":          priorityQueueSize,
+		"PRIORITY_PRODUCE_TIMEOUT":     duration(priorityProduceTimeout),
+		"COMPUTED_FIELDS":              fields,
+		"SERIALIZATION_FORMAT":         serializationFormat,
+		"SYNC_PRODUCE":                 syncProduce,
+		"OUTPUT_BACKEND":               outputBackend,
+		"LOG_ERROR_SAMPLING":           logErrorSampling,
+		"STREAM_DECODE_BATCH":          streamDecodeBatch,
+		"MAX_SAMPLES_PER_REQUEST":      maxSamplesPerRequest,
+		"MAX_SAMPLES_POLICY":           maxSamplesPolicy,
+		"HEARTBEAT_TOPIC":              heartbeatTopic,
+		"HEARTBEAT_INTERVAL":           duration(heartbeatInterval),
+		"ADAPTER_ID":                   adapterID,
+		"PROVENANCE_LABEL":             provenanceLabel,
+		"PROVENANCE_CONFLICT_POLICY":   provenanceConflict,
+		"INSTANCE_HOST_LABEL":          instanceHostMode,
+		"TENANT_HEADER":                tenantHeader,
+		"TENANT_HEADER_LABEL":          tenantHeaderLabel,
+		"TENANT_DEFAULT":               tenantDefault,
+		"QUEUE_FULL_POLICY":            queueFullPolicy,
+		"RETRY_AFTER":                  duration(retryAfter),
+		"MAX_IN_FLIGHT_REQUESTS":       cap(inFlightSlots),
+		"PARTITIONER":                  partitionerKind,
+		"PARTITION_LABEL":              partitionLabel,
+		"EMPTY_LABEL_POLICY":           emptyLabelPolicy,
+		"DROP_METRIC_SUFFIXES":         dropSuffixes,
+		"NAME_FALLBACK_LABELS":         nameFallbackLabels,
+		"METRIC_NAME_VALIDATION":       metricNameValidation,
+		"LABEL_VALUE_MAX_LENGTH":       labelValueMaxLength,
+		"LABEL_VALUE_OVERFLOW_POLICY":  labelValueOverflow,
+		"LABEL_TRUNCATION_SUFFIX":      labelTruncationSuffix,
+		"REQUIRED_LABELS":              requiredLabels,
+		"STRIP_INTERNAL_LABELS":        stripInternalLabels,
+		"STRIP_NAME_LABEL":             stripNameLabel,
+		"RECORD_TIMESTAMP_FROM_SAMPLE": sampleRecordTimestamp,
+		"TIMESTAMP_LABEL":              timestampLabel,
+		"TIMESTAMP_LABEL_RECORD":       timestampLabelRecord,
+		"SORT_SAMPLES":                 sortSamples,
+		"SCHEMA_VERSION":               schemaVersion,
+		"TIME_WINDOW_START":            timestamp(timeWindowStart),
+		"TIME_WINDOW_END":              timestamp(timeWindowEnd),
+		"TIME_WINDOW_LAST":             duration(timeWindowLast),
+		"MAX_SAMPLE_AGE":               duration(maxSampleAge),
+		"MAX_FUTURE_SKEW":              duration(maxFutureSkew),
+		"KEY_SOURCE":                   keySource,
+		"STALE_TOMBSTONES":             staleTombstones,
+		"SEQUENCE_HEADERS":             sequenceHeaders,
+		"SEQUENCE_SCOPE":               sequenceScope,
+		"MESSAGE_TTL_MODE":             messageTTLMode,
+		"BATCH_GROUP_BY_KEY":           batchGroupByKey,
+		"JSON_ESCAPE_HTML":             jsonEscapeHTML,
+		"JSON_EXPLICIT_NULLS":          jsonExplicitNulls,
+		"JSON_VALUE_NUMBER":            jsonValueNumber,
+		"DEBUG":                        debugHeaders,
+		"AVRO_FIELD_ORDER":             avroFieldOrder,
+		"OMIT_TIMESTAMP":               omitTimestamp,
+		"SERIES_ID_FIELD":              seriesIDField,
+		"FALLBACK_SERIALIZER":          fallbackFormat,
+		"SELFTEST_ENABLED":             selfTestEnabled,
+		"SELFTEST_TOPIC":               selfTestTopic,
+		"SELFTEST_TIMEOUT":             duration(selfTestTimeout),
+		"KEY_TIMESTAMP_WIDTH":          keyTimestampWidth,
+		"ACCEPTED_CONTENT_TYPES":       acceptedContentTypes,
+		"VALUE_ROUND":                  valueRound,
+		"INF_POLICY":                   infPolicy,
+		"PAYLOAD_COMPRESSION":          "none",
+	}
+	if payloadCompression != nil {
+		config["PAYLOAD_COMPRESSION"] = payloadCompression.Encoding()
+		config["COMPRESSION_LEVEL"] = compressionLevel
+	}
+	if dedup != nil {
+		config["DEDUP_WINDOW"] = dedup.window.String()
+	}
+	if sampleConflictPolicy != "" {
+		config["SAMPLE_CONFLICT_POLICY"] = sampleConflictPolicy
+	}
+	if messageExpiry != nil {
+		topics := make(map[string]string, len(messageExpiry.topics))
+		for topic, ttl := range messageExpiry.topics {
+			topics[topic] = ttl.String()
+		}
+		config["MESSAGE_TTL"] = duration(messageExpiry.ttl)
+		config["MESSAGE_TTL_TOPICS"] = topics
+	}
+	if seriesRateLimit != nil {
+		config["SERIES_RATE_LIMIT"] = seriesRateLimit.rate
+		config["SERIES_RATE_BURST"] = int(seriesRateLimit.burst)
+		config["SERIES_RATE_MAX_SERIES"] = seriesRateLimit.buckets.size
+	}
+	if cardinality != nil {
+		config["CARDINALITY_LIMIT"] = cardinality.limit
+		config["CARDINALITY_WINDOW"] = cardinality.window.String()
+	}
+	if aggregation != nil {
+		config["AGGREGATION_WINDOW"] = (time.Duration(aggregation.window) * time.Millisecond).String()
+		config["AGGREGATION_FUNCTION"] = aggregation.function
+		config["AGGREGATION_MAX_SERIES"] = aggregation.maxSeries
+	}
+	if topicCache != nil {
+		config["TOPIC_CACHE_SIZE"] = topicCache.size
+	}
+	if filterCache != nil {
+		config["FILTER_CACHE_SIZE"] = filterCache.size
+	}
+	if outputBackend == "ocf" {
+		config["OCF_DIRECTORY"] = ocfDirectory
+		config["OCF_MAX_BYTES"] = ocfMaxBytes
+		config["OCF_MAX_AGE"] = duration(ocfMaxAge)
+	}
+	if p, ok := partitioner.(*tenantPartitioner); ok {
+		config["PARTITION_TENANT_LABEL"] = p.label
+	}
+	return config
+}
+
+// matchRulesText returns the match rules in the syntax of MATCH, sorted.
+func matchRulesText(rules map[string]*dto.MetricFamily) []string {
+	text := []string{}
+	for name, mf := range rules {
+		for _, m := range mf.Metric {
+			text = append(text, matchRuleText(name, m))
+		}
+	}
+	sort.Strings(text)
+	return text
+}
+
+// matchRuleText returns a match rule in the syntax of MATCH, with the label
+// matchers sorted so equivalent rules have the same text.
+func matchRuleText(name string, m *dto.Metric) string {
+	var matchers []string
+	for _, label := range m.Label {
+		if strings.ContainsAny(label.GetName(), "<>") {
+			matchers = append(matchers, label.GetName()+label.GetValue())
+		} else {
+			matchers = append(matchers, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+		}
+	}
+	if len(matchers) == 0 {
+		return name
+	}
+	sort.Strings(matchers)
+	return fmt.Sprintf("%s{%s}", name, strings.Join(matchers, ","))
+}
+
+// parseMatchFiles merges into rules the match rules of each file, a YAML list
+// with the syntax of MATCH, in order. It returns the conflicts found, prefixed
+// by the file that introduced them.
+func parseMatchFiles(paths []string, rules map[string]*dto.MetricFamily) ([]string, error) {
+	var conflicts []string
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fileRules, err := parseMatchList(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		for _, conflict := range mergeMatchRules(rules, fileRules) {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %s", path, conflict))
+		}
+	}
+	return conflicts, nil
+}
+
+// mergeMatchRules adds the rules of src to dst. Rules can only be added, so a
+// rule of src already in dst is reported as a duplicate and skipped, and a
+// rule overlapping with a rule matching every series of the same metric,
+// making the narrower one redundant, is reported and added.
+func mergeMatchRules(dst, src map[string]*dto.MetricFamily) []string {
+	names := make([]string, 0, len(src))
+	for name := range src {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conflicts []string
+	for _, name := range names {
+		existing, ok := dst[name]
+		if !ok {
+			dst[name] = src[name]
+			continue
+		}
+
+		for _, m := range src[name].Metric {
+			text := matchRuleText(name, m)
+			duplicate := false
+			for _, e := range existing.Metric {
+				if matchRuleText(name, e) == text {
+					conflicts = append(conflicts, fmt.Sprintf("duplicate rule %s", text))
+					duplicate = true
+					break
+				}
+				if len(e.Label) == 0 || len(m.Label) == 0 {
+					conflicts = append(conflicts, fmt.Sprintf("rule %s overlaps with rule %s", text, matchRuleText(name, e)))
+				}
+			}
+			if !duplicate {
+				existing.Metric = append(existing.Metric, m)
+			}
+		}
+	}
+	return conflicts
+}
+
+func parseMatchList(text string) (map[string]*dto.MetricFamily, error) {
+	var matchRules []string
+	err := yaml.Unmarshal([]byte(text), &matchRules)
+	if err != nil {
+		return nil, err
+	}
+	return parseMatchRules(matchRules)
+}
+
+func parseMatchRules(matchRules []string) (map[string]*dto.MetricFamily, error) {
+	metricFamilies := make(map[string]*dto.MetricFamily)
+	for _, v := range matchRules {
+		conjunctions, err := parseRuleExpression(v)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse match rules: %s", err)
+		}
+
+		for _, selectors := range conjunctions {
+			name, m, err := parseRuleConjunction(selectors)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse match rules: %s", err)
+			}
+			if existing, ok := metricFamilies[name]; ok {
+				existing.Metric = append(existing.Metric, m)
+			} else {
+				metricFamilies[name] = &dto.MetricFamily{Name: &name, Metric: []*dto.Metric{m}}
+			}
+		}
+	}
+	return metricFamilies, nil
+}
+
+// parseRuleConjunction parses the selectors a series must all match into a
+// single metric, holding the label matchers of every selector. The selectors
+// must share the metric name, as a series has a single one.
+func parseRuleConjunction(selectors []string) (string, *dto.Metric, error) {
+	var name string
+	m := &dto.Metric{}
+	for _, selector := range selectors {
+		text, comparisons, err := extractComparisons(selector)
+		if err != nil {
+			return "", nil, err
+		}
+
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(strings.NewReader(fmt.Sprintf("%s 0\n", text)))
+		if err != nil {
+			return "", nil, err
+		}
+
+		for family, mf := range families {
+			if name != "" && family != name {
+				return "", nil, fmt.Errorf("rules of different metrics %q and %q can't be combined with and", name, family)
+			}
+			name = family
+			for _, metric := range mf.Metric {
+				m.Label = append(m.Label, metric.Label...)
+			}
+		}
+		m.Label = append(m.Label, comparisons...)
+	}
+	return name, m, nil
+}
+
+// parseRuleExpression parses a match rule combining selectors with and, or
+// and parentheses, and binding tighter than or, e.g:
+// `up{job="node"} and (up{env="prod"} or up{env="staging"})`. It returns the
+// rule in disjunctive normal form: a series matches the rule if it matches
+// all the selectors of any of the conjunctions.
+func parseRuleExpression(rule string) ([][]string, error) {
+	tokens, err := tokenizeRule(rule)
+	if err != nil {
+		return nil, err
 	}
 
-	if value := os.Getenv("BASIC_AUTH_USERNAME"); value != "" {
-		basicauth = true
-		basicauthUsername = value
+	p := &ruleParser{tokens: tokens}
+	conjunctions, err := p.or()
+	if err != nil {
+		return nil, err
 	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in rule %q", p.tokens[p.pos], rule)
+	}
+	return conjunctions, nil
+}
 
-	if value := os.Getenv("BASIC_AUTH_PASSWORD"); value != "" {
-		basicauthPassword = value
+// tokenizeRule splits a match rule into selectors, the and and or operators
+// and parentheses, leaving the label matchers within braces untouched. Label
+// matchers separated from their metric name by spaces, e.g. `up {job="a"}`,
+// are kept with it.
+func tokenizeRule(rule string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	depth, quoted, escaped := 0, false, false
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
 	}
 
-	if value := os.Getenv("KAFKA_COMPRESSION"); value != "" {
-		kafkaCompression = value
+	for _, r := range rule {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"' && depth > 0:
+			quoted = !quoted
+		case quoted:
+		case r == '{':
+			if depth == 0 && current.Len() == 0 && len(tokens) > 0 && !ruleOperator(tokens[len(tokens)-1]) {
+				current.WriteString(tokens[len(tokens)-1])
+				tokens = tokens[:len(tokens)-1]
+			}
+			depth++
+		case r == '}':
+			depth--
+		case depth == 0 && (r == '(' || r == ')'):
+			flush()
+			tokens = append(tokens, string(r))
+			continue
+		case depth == 0 && unicode.IsSpace(r):
+			flush()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if depth != 0 || quoted {
+		return nil, fmt.Errorf("unbalanced braces or quotes in rule %q", rule)
 	}
+	flush()
+	return tokens, nil
+}
 
-	if value := os.Getenv("KAFKA_BATCH_NUM_MESSAGES"); value != "" {
-		kafkaBatchNumMessages = value
+// ruleOperator reports whether the token of a match rule is an operator or a
+// parenthesis rather than a selector.
+func ruleOperator(token string) bool {
+	switch token {
+	case "and", "or", "(", ")":
+		return true
 	}
+	return false
+}
 
-	if value := os.Getenv("KAFKA_SSL_CLIENT_CERT_FILE"); value != "" {
-		kafkaSslClientCertFile = value
+// ruleParser is a recursive descent parser of the tokens of a match rule.
+type ruleParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
 	}
+	return ""
+}
 
-	if value := os.Getenv("KAFKA_SSL_CLIENT_KEY_FILE"); value != "" {
-		kafkaSslClientKeyFile = value
+// or parses conjunctions separated by or.
+func (p *ruleParser) or() ([][]string, error) {
+	result, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, right...)
 	}
+	return result, nil
+}
 
-	if value := os.Getenv("KAFKA_SSL_CLIENT_KEY_PASS"); value != "" {
-		kafkaSslClientKeyPass = value
+// and parses operands separated by and, distributing and over the or of
+// parenthesized operands.
+func (p *ruleParser) and() ([][]string, error) {
+	result, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		var product [][]string
+		for _, l := range result {
+			for _, r := range right {
+				product = append(product, append(l[:len(l):len(l)], r...))
+			}
+		}
+		result = product
 	}
+	return result, nil
+}
 
-	if value := os.Getenv("KAFKA_SSL_CA_CERT_FILE"); value != "" {
-		kafkaSslCACertFile = value
+// operand parses a selector or a parenthesized expression.
+func (p *ruleParser) operand() ([][]string, error) {
+	token := p.peek()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("missing selector at the end of the rule")
+	case "and", "or", ")":
+		return nil, fmt.Errorf("expected a selector, found %q", token)
+	case "(":
+		p.pos++
+		result, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return result, nil
 	}
+	p.pos++
+	return [][]string{{token}}, nil
+}
 
-	if value := os.Getenv("KAFKA_SECURITY_PROTOCOL"); value != "" {
-		kafkaSecurityProtocol = strings.ToLower(value)
+// comparisonPattern matches a numeric comparison of a match rule, e.g:
+// code>=500.
+var comparisonPattern = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)\s*(>=|<=|>|<)\s*(\S+)$`)
+
+// extractComparisons removes the numeric comparisons from the label matchers
+// of a match rule, returning them as label pairs whose name is the label
+// followed by the operator, e.g: {Name: "code>=", Value: "500"}. As label
+// names can't hold operators, these pairs can't collide with equality
+// matchers.
+func extractComparisons(rule string) (string, []*dto.LabelPair, error) {
+	start := strings.Index(rule, "{")
+	end := strings.LastIndex(rule, "}")
+	if start < 0 || end < start {
+		return rule, nil, nil
 	}
 
-	if value := os.Getenv("KAFKA_SASL_MECHANISM"); value != "" {
-		kafkaSaslMechanism = value
+	var matchers []string
+	var comparisons []*dto.LabelPair
+	for _, matcher := range splitMatchers(rule[start+1 : end]) {
+		parts := comparisonPattern.FindStringSubmatch(strings.TrimSpace(matcher))
+		if parts == nil {
+			matchers = append(matchers, matcher)
+			continue
+		}
+		if _, err := strconv.ParseFloat(parts[3], 64); err != nil {
+			return "", nil, fmt.Errorf("invalid number in comparison %q", matcher)
+		}
+		name, value := parts[1]+parts[2], parts[3]
+		comparisons = append(comparisons, &dto.LabelPair{Name: &name, Value: &value})
 	}
 
-	if value := os.Getenv("KAFKA_SASL_USERNAME"); value != "" {
-		kafkaSaslUsername = value
+	return rule[:start+1] + strings.Join(matchers, ",") + rule[end:], comparisons, nil
+}
+
+// splitMatchers splits the label matchers of a match rule by the commas out
+// of the quoted values.
+func splitMatchers(text string) []string {
+	var matchers []string
+	quoted, escaped, last := false, false, 0
+	for i, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = quoted
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			matchers = append(matchers, text[last:i])
+			last = i + 1
+		}
+	}
+	if rest := text[last:]; strings.TrimSpace(rest) != "" {
+		matchers = append(matchers, rest)
 	}
+	return matchers
+}
 
-	if value := os.Getenv("KAFKA_SASL_PASSWORD"); value != "" {
-		kafkaSaslPassword = value
+func parseFilterProfiles(text string) (map[string]map[string]*dto.MetricFamily, error) {
+	var profileRules map[string][]string
+	if err := yaml.Unmarshal([]byte(text), &profileRules); err != nil {
+		return nil, err
 	}
 
-	if value := os.Getenv("MATCH"); value != "" {
-		matchList, err := parseMatchList(value)
+	profiles := make(map[string]map[string]*dto.MetricFamily, len(profileRules))
+	for name, rules := range profileRules {
+		matchList, err := parseMatchRules(rules)
 		if err != nil {
-			logrus.WithError(err).Fatalln("couldn't parse the match rules")
+			return nil, fmt.Errorf("couldn't parse filter profile %q: %s", name, err)
 		}
-		match = matchList
+		profiles[name] = matchList
 	}
+	return profiles, nil
+}
 
-	var err error
-	serializer, err = parseSerializationFormat(os.Getenv("SERIALIZATION_FORMAT"))
-	if err != nil {
-		logrus.WithError(err).Fatalln("couldn't create a metrics serializer")
+func parseTopicLookup(text string) (map[string]string, error) {
+	var lookup map[string]string
+	if err := yaml.Unmarshal([]byte(text), &lookup); err != nil {
+		return nil, err
 	}
 
-	topicTemplate, err = parseTopicTemplate(kafkaTopic)
-	if err != nil {
-		logrus.WithError(err).Fatalln("couldn't parse the topic template")
+	for value, topic := range lookup {
+		if topic == "" {
+			return nil, fmt.Errorf("topic lookup value %q has no topic", value)
+		}
 	}
+	return lookup, nil
 }
 
-func parseMatchList(text string) (map[string]*dto.MetricFamily, error) {
-	var matchRules []string
-	err := yaml.Unmarshal([]byte(text), &matchRules)
-	if err != nil {
+func parseMessageTTLTopics(text string) (map[string]time.Duration, error) {
+	var ttls map[string]string
+	if err := yaml.Unmarshal([]byte(text), &ttls); err != nil {
 		return nil, err
 	}
-	var metricsList []string
-	for _, v := range matchRules {
-		metricsList = append(metricsList, fmt.Sprintf("%s 0\n", v))
+
+	topics := make(map[string]time.Duration, len(ttls))
+	for topic, value := range ttls {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid ttl %q of topic %q", value, topic)
+		}
+		topics[topic] = ttl
 	}
+	return topics, nil
+}
 
-	metricsText := strings.Join(metricsList, "")
+func parseFilterRoutes(text string, profiles map[string]map[string]*dto.MetricFamily) (map[string]string, error) {
+	var routes map[string]string
+	if err := yaml.Unmarshal([]byte(text), &routes); err != nil {
+		return nil, err
+	}
 
-	var parser expfmt.TextParser
-	metricFamilies, err := parser.TextToMetricFamilies(strings.NewReader(metricsText))
-	if err != nil {
-		return nil, fmt.Errorf("couldn't parse match rules: %s", err)
+	for route, profile := range routes {
+		if !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("filter route %q must start with /", route)
+		}
+		if route == "/receive" {
+			return nil, fmt.Errorf("filter route %q collides with the default receive route", route)
+		}
+		if _, ok := profiles[profile]; !ok {
+			return nil, fmt.Errorf("filter route %q uses unknown filter profile %q", route, profile)
+		}
 	}
-	return metricFamilies, nil
+	return routes, nil
 }
 
 func parseLogLevel(value string) logrus.Level {
@@ -164,19 +1606,364 @@ func parseLogLevel(value string) logrus.Level {
 	return level
 }
 
+// parseIntRange parses the integer value of the named setting, which must be
+// within the range librdkafka accepts for it.
+func parseIntRange(name, value string, min, max int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		logrus.WithField(strings.ToLower(name)+"-value", value).Fatalf("couldn't parse %s, it must be an integer between %d and %d", name, min, max)
+	}
+	return n
+}
+
+func parseBool(name, value string) bool {
+	b, err := strconv.ParseBool(value)
+
+	if err != nil {
+		logrus.WithField(name, value).Warningln("invalid boolean from env var, using false")
+		return false
+	}
+
+	return b
+}
+
+func parseMaxSamplesPolicy(value string) string {
+	switch value {
+	case "reject", "truncate":
+		return value
+	default:
+		logrus.WithField("max-samples-policy-value", value).Warningln("invalid max samples policy, using reject")
+		return "reject"
+	}
+}
+
+func parseQueueFullPolicy(value string) string {
+	switch value {
+	case "block", "drop-newest", "drop-oldest", "reject":
+		return value
+	default:
+		logrus.WithField("queue-full-policy-value", value).Warningln("invalid queue full policy, using reject")
+		return "reject"
+	}
+}
+
+// parseSchemaVersionTarget reports whether the SCHEMA_VERSION is sent as a
+// kafka header rather than as a field of the messages.
+func parseSchemaVersionTarget(value string) bool {
+	switch value {
+	case "field":
+		return false
+	case "header":
+		return true
+	default:
+		logrus.WithField("schema-version-target-value", value).Warningln("invalid schema version target, using field")
+		return false
+	}
+}
+
+func parseKeySource(value string) string {
+	switch value {
+	case "series", "series-timestamp", "metric_name":
+		return value
+	default:
+		logrus.WithField("key-source-value", value).Warningln("invalid key source, using no key")
+		return ""
+	}
+}
+
+func parseSampleConflictPolicy(value string) string {
+	switch value {
+	case "first-wins", "last-wins":
+		return value
+	default:
+		logrus.WithField("sample-conflict-policy-value", value).Warningln("invalid sample conflict policy, keeping conflicting samples")
+		return ""
+	}
+}
+
+func parseInfPolicy(value string) string {
+	switch value {
+	case "text", "clamp", "drop":
+		return value
+	default:
+		logrus.WithField("inf-policy-value", value).Warningln("invalid inf policy, writing infinite values as text")
+		return "text"
+	}
+}
+
+func parseEmptyLabelPolicy(value string) string {
+	switch value {
+	case "keep", "drop-label", "drop-series":
+		return value
+	default:
+		logrus.WithField("empty-label-policy-value", value).Warningln("invalid empty label policy, keeping empty labels")
+		return "keep"
+	}
+}
+
+func parseLabelValueOverflowPolicy(value string) string {
+	switch value {
+	case "truncate", "drop-label":
+		return value
+	default:
+		logrus.WithField("label-value-overflow-policy-value", value).Warningln("invalid label value overflow policy, truncating the values")
+		return "truncate"
+	}
+}
+
+func parseOrdering(value string) string {
+	switch value {
+	case "none", "per-partition", "strict":
+		return value
+	default:
+		logrus.WithField("ordering-value", value).Fatalln("invalid ordering, it must be none, per-partition or strict")
+		return ""
+	}
+}
+
+func parseProducerDistribution(value string) string {
+	switch value {
+	case "round-robin", "topic":
+		return value
+	default:
+		logrus.WithField("producer-distribution-value", value).Warningln("invalid producer distribution, using round-robin")
+		return "round-robin"
+	}
+}
+
+func parseSequenceScope(value string) string {
+	switch value {
+	case "topic", "partition":
+		return value
+	default:
+		logrus.WithField("sequence-scope-value", value).Warningln("invalid sequence scope, numbering the messages per topic")
+		return "topic"
+	}
+}
+
+func parseMetricNameValidation(value string) string {
+	switch value {
+	case "off", "drop", "sanitize":
+		return value
+	default:
+		logrus.WithField("metric-name-validation-value", value).Warningln("invalid metric name validation, leaving the metric names unchecked")
+		return "off"
+	}
+}
+
+func parseMessageTTLMode(value string) string {
+	switch value {
+	case "absolute", "relative":
+		return value
+	default:
+		logrus.WithField("message-ttl-mode-value", value).Warningln("invalid message ttl mode, using absolute expiry times")
+		return "absolute"
+	}
+}
+
+func parseAvroFieldOrder(value string) string {
+	switch value {
+	case "schema", "any":
+		return value
+	default:
+		logrus.WithField("avro-field-order-value", value).Warningln("invalid avro field order, using the schema order")
+		return "schema"
+	}
+}
+
+func parseOutputBackend(value string) string {
+	switch value {
+	case "kafka", "ocf":
+		return value
+	default:
+		logrus.WithField("output-backend-value", value).Warningln("invalid output backend, using kafka")
+		return "kafka"
+	}
+}
+
+func parseProvenanceConflictPolicy(value string) string {
+	switch value {
+	case "rename", "overwrite", "keep":
+		return value
+	default:
+		logrus.WithField("provenance-conflict-policy-value", value).Warningln("invalid provenance conflict policy, renaming the conflicting labels")
+		return "rename"
+	}
+}
+
+func parseInstanceHostMode(value string) string {
+	switch value {
+	case "add", "replace":
+		return value
+	default:
+		logrus.WithField("instance-host-label-value", value).Warningln("invalid instance host label mode, adding the instance_host label")
+		return "add"
+	}
+}
+
+// parseSampleBoundsAction reports whether samples out of the MAX_SAMPLE_AGE
+// and MAX_FUTURE_SKEW bounds are clamped rather than dropped.
+func parseSampleBoundsAction(value string) bool {
+	switch value {
+	case "drop":
+		return false
+	case "clamp":
+		return true
+	default:
+		logrus.WithField("sample-bounds-action-value", value).Warningln("invalid sample bounds action, dropping samples out of bounds")
+		return false
+	}
+}
+
+func parseAggregationFunction(value string) string {
+	switch value {
+	case "", "last":
+		return "last"
+	case "min", "max", "avg":
+		return value
+	default:
+		logrus.WithField("aggregation-function-value", value).Warningln("invalid aggregation function, using last")
+		return "last"
+	}
+}
+
 func parseSerializationFormat(value string) (Serializer, error) {
 	switch value {
 	case "json":
-		return NewJSONSerializer()
+		return parseJSONSerializer(os.Getenv("JSON_LABELS_FORMAT"), os.Getenv("JSON_INDENT"))
+	case "json-array":
+		return NewJSONArraySerializer()
+	case "json-bulk":
+		return parseJSONBulkSerializer(os.Getenv("BULK_TOPIC"))
+	case "json-connect":
+		return NewConnectJSONSerializer()
 	case "avro-json":
-		return NewAvroJSONSerializer("schemas/metric.avsc")
+		if label := os.Getenv("AVRO_TENANT_LABEL"); label != "" {
+			return NewAvroJSONSerializerWithTenant(avroSchemaPath("metric-tenant"), label)
+		}
+		return NewAvroJSONSerializer(avroSchemaPath("metric"))
+	case "avro-json-series":
+		return NewAvroJSONSeriesSerializer(avroSchemaPath("series"))
+	case "line-protocol":
+		return NewLineProtocolSerializer(os.Getenv("LINE_PROTOCOL_NON_FINITE_SENTINEL"))
+	case "graphite":
+		return NewGraphiteSerializer(os.Getenv("GRAPHITE_NON_FINITE_SENTINEL"))
+	case "parquet":
+		return parseParquetSerializer(os.Getenv("PARQUET_LABEL_COLUMNS"), os.Getenv("PARQUET_MAX_ROWS"), os.Getenv("PARQUET_MAX_BYTES"))
 	default:
 		logrus.WithField("serialization-format-value", value).Warningln("invalid serialization format, using json")
 		return NewJSONSerializer()
 	}
 }
 
+// parseFallbackSerializer builds the serializer of the samples failing
+// serialization, which must serialize each sample on its own.
+func parseFallbackSerializer(value string) (Serializer, error) {
+	switch value {
+	case "json", "avro-json", "line-protocol", "graphite":
+		return parseSerializationFormat(value)
+	default:
+		return nil, fmt.Errorf("fallback serialization format %q isn't one of json, avro-json, line-protocol or graphite", value)
+	}
+}
+
+// avroSchemaPath returns the path of the bundled Avro schema, or of its
+// variant without the timestamp field with OMIT_TIMESTAMP.
+func avroSchemaPath(name string) string {
+	if omitTimestamp {
+		name += "-no-timestamp"
+	}
+	return "schemas/" + name + ".avsc"
+}
+
+func parseJSONBulkSerializer(topic string) (*JSONBulkSerializer, error) {
+	if topic == "" {
+		topic = kafkaTopic
+	}
+	tpl, err := parseTopicTemplate(topic)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the bulk topic template: %s", err)
+	}
+	return NewJSONBulkSerializer(tpl)
+}
+
+func parseJSONSerializer(labelsFormat, indent string) (*JSONSerializer, error) {
+	s, err := NewJSONSerializerWithLabelsFormat(labelsFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if indent != "" {
+		spaces, err := strconv.Atoi(indent)
+		if err != nil || spaces < 0 {
+			return nil, fmt.Errorf("invalid json indent %q", indent)
+		}
+		s.indent = strings.Repeat(" ", spaces)
+	}
+	return s, nil
+}
+
+func parseParquetSerializer(columns, maxRows, maxBytes string) (*ParquetSerializer, error) {
+	var labelColumns []string
+	for _, column := range strings.Split(columns, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			labelColumns = append(labelColumns, column)
+		}
+	}
+
+	rows := 10000
+	if maxRows != "" {
+		var err error
+		if rows, err = strconv.Atoi(maxRows); err != nil {
+			return nil, fmt.Errorf("invalid parquet max rows %q: %s", maxRows, err)
+		}
+	}
+
+	size := 1000000
+	if maxBytes != "" {
+		var err error
+		if size, err = strconv.Atoi(maxBytes); err != nil {
+			return nil, fmt.Errorf("invalid parquet max bytes %q: %s", maxBytes, err)
+		}
+	}
+
+	return NewParquetSerializer(labelColumns, rows, size)
+}
+
+func parseComputedFields(text string) (map[string]*template.Template, error) {
+	var fieldTemplates map[string]string
+	if err := yaml.Unmarshal([]byte(text), &fieldTemplates); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]*template.Template, len(fieldTemplates))
+	for name, tpl := range fieldTemplates {
+		switch name {
+		case "timestamp", "value", "name", "labels", schemaVersionField:
+			return nil, fmt.Errorf("computed field %q collides with a reserved field", name)
+		}
+
+		t, err := parseTemplate(name, tpl)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse computed field %q: %s", name, err)
+		}
+		fields[name] = t
+	}
+	return fields, nil
+}
+
+// parseTopicTemplate parses a topic template. Its errors quote the template
+// and tell where it's invalid, e.g: `template: topic:1: function "lower" not
+// defined`, so a broken KAFKA_TOPIC is easy to spot in the startup logs.
 func parseTopicTemplate(tpl string) (*template.Template, error) {
+	t, err := parseTemplate("topic", tpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic template %q: %s", tpl, err)
+	}
+	return t, nil
+}
+
+func parseTemplate(name, tpl string) (*template.Template, error) {
 	funcMap := template.FuncMap{
 		"replace": func(old, new, src string) string {
 			return strings.Replace(src, old, new, -1)
@@ -193,6 +1980,14 @@ func parseTopicTemplate(tpl string) (*template.Template, error) {
 			}
 			return s[start:end]
 		},
+		"baseName":    baseName,
+		"fingerprint": fingerprint,
+		"mod": func(a, b uint64) (uint64, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("template function - mod: division by zero")
+			}
+			return a % b, nil
+		},
 	}
-	return template.New("topic").Funcs(funcMap).Parse(tpl)
+	return template.New(name).Funcs(funcMap).Parse(tpl)
 }
@@ -0,0 +1,105 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ConnectJSONSerializer represents a metrics serializer that writes the
+// Kafka Connect JSON envelope, the JSON object of the JSON serialization as
+// the payload along with an inline schema describing its fields, as the
+// JsonConverter reads it with schemas.enable. The schema is built from the
+// configuration, so all the messages share it.
+type ConnectJSONSerializer struct {
+	schema map[string]interface{}
+	fields map[string]bool
+}
+
+func (s *ConnectJSONSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
+	payload := jsonRecord(metric)
+	for name := range payload {
+		if !s.fields[name] {
+			return nil, fmt.Errorf("field %q isn't described by the kafka connect schema", name)
+		}
+	}
+	return marshalJSON(map[string]interface{}{"schema": s.schema, "payload": payload}, "")
+}
+
+// connectField returns the Kafka Connect schema of a field.
+func connectField(name, fieldType string, optional bool) map[string]interface{} {
+	return map[string]interface{}{"field": name, "type": fieldType, "optional": optional}
+}
+
+// connectSchema returns the Kafka Connect struct schema of the JSON objects
+// written with the current configuration, with its fields sorted by name.
+// The value, name and labels are always set, the rest of the fields are
+// optional, e.g. value_num is null for non-finite values.
+func connectSchema() []map[string]interface{} {
+	labels := connectField("labels", "map", false)
+	labels["keys"] = map[string]interface{}{"type": "string", "optional": false}
+	labels["values"] = map[string]interface{}{"type": "string", "optional": false}
+	fields := []map[string]interface{}{
+		connectField("value", "string", false),
+		connectField("name", "string", false),
+		labels,
+	}
+
+	if !omitTimestamp || jsonExplicitNulls {
+		fields = append(fields, connectField("timestamp", "string", true))
+	}
+	for name := range computedFields {
+		fields = append(fields, connectField(name, "string", true))
+	}
+	if schemaVersion != "" && !schemaVersionHeader || jsonExplicitNulls {
+		fields = append(fields, connectField(schemaVersionField, "string", true))
+	}
+	if seriesIDField {
+		fields = append(fields, connectField(seriesIDFieldName, "string", true))
+	}
+	if jsonValueNumber {
+		fields = append(fields, connectField(valueNumberField, "double", true))
+	}
+	if jsonExplicitNulls {
+		// reserved, always null for now
+		fields = append(fields, connectField("exemplars", "string", true), connectField("unit", "string", true))
+	}
+
+	// the computed fields named after another field are described by it
+	seen := make(map[string]bool, len(fields))
+	unique := fields[:0]
+	for _, field := range fields {
+		if name := field["field"].(string); !seen[name] {
+			seen[name] = true
+			unique = append(unique, field)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i]["field"].(string) < unique[j]["field"].(string) })
+	return unique
+}
+
+// NewConnectJSONSerializer builds a new instance of the ConnectJSONSerializer
+func NewConnectJSONSerializer() (*ConnectJSONSerializer, error) {
+	fields := connectSchema()
+	s := &ConnectJSONSerializer{
+		schema: map[string]interface{}{"type": "struct", "fields": fields, "optional": false},
+		fields: make(map[string]bool, len(fields)),
+	}
+	for _, field := range fields {
+		s.fields[field["field"].(string)] = true
+	}
+	return s, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectJSONSerializerEnvelope(t *testing.T) {
+	serializer, err := NewConnectJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Len(t, output["metrics"], 2)
+
+	var envelope struct {
+		Schema struct {
+			Type     string                   `json:"type"`
+			Optional bool                     `json:"optional"`
+			Fields   []map[string]interface{} `json:"fields"`
+		} `json:"schema"`
+		Payload map[string]interface{} `json:"payload"`
+	}
+	var keys map[string]json.RawMessage
+	assert.Nil(t, json.Unmarshal(output["metrics"][0].Value, &keys))
+	assert.Len(t, keys, 2)
+	assert.Nil(t, json.Unmarshal(output["metrics"][0].Value, &envelope))
+
+	assert.Equal(t, "struct", envelope.Schema.Type)
+	assert.False(t, envelope.Schema.Optional)
+	assert.Equal(t, []map[string]interface{}{
+		{
+			"field":    "labels",
+			"type":     "map",
+			"keys":     map[string]interface{}{"type": "string", "optional": false},
+			"values":   map[string]interface{}{"type": "string", "optional": false},
+			"optional": false,
+		},
+		{"field": "name", "type": "string", "optional": false},
+		{"field": "timestamp", "type": "string", "optional": true},
+		{"field": "value", "type": "string", "optional": false},
+	}, envelope.Schema.Fields)
+
+	// every payload field is described by the schema
+	assert.Len(t, envelope.Payload, len(envelope.Schema.Fields))
+	for _, field := range envelope.Schema.Fields {
+		assert.Contains(t, envelope.Payload, field["field"])
+	}
+	assert.Equal(t, "foo", envelope.Payload["name"])
+	assert.Equal(t, map[string]interface{}{"__name__": "foo", "labelfoo": "label-bar"}, envelope.Payload["labels"])
+}
+
+func TestConnectJSONSerializerFixedSchema(t *testing.T) {
+	jsonValueNumber = true
+	defer func() { jsonValueNumber = false }()
+
+	serializer, err := NewConnectJSONSerializer()
+	assert.Nil(t, err)
+
+	var schemas []interface{}
+	var numbers []interface{}
+	for _, value := range []string{"1.5", "+Inf", "NaN"} {
+		data, err := serializer.Marshal(map[string]interface{}{"value": value, "name": "up", "labels": map[string]string{}})
+		assert.Nil(t, err)
+
+		var envelope map[string]map[string]interface{}
+		assert.Nil(t, json.Unmarshal(data, &envelope))
+		schemas = append(schemas, envelope["schema"])
+		numbers = append(numbers, envelope["payload"][valueNumberField])
+	}
+	assert.Equal(t, schemas[0], schemas[1], "finite and non-finite samples should share the schema")
+	assert.Equal(t, schemas[0], schemas[2], "finite and non-finite samples should share the schema")
+	assert.Contains(t, schemas[0].(map[string]interface{})["fields"], map[string]interface{}{"field": valueNumberField, "type": "double", "optional": true})
+	assert.Equal(t, []interface{}{1.5, nil, nil}, numbers)
+}
+
+func TestConnectJSONSerializerUnknownField(t *testing.T) {
+	serializer, err := NewConnectJSONSerializer()
+	assert.Nil(t, err)
+
+	_, err = serializer.Marshal(map[string]interface{}{"value": "1", "name": "up", "labels": map[string]string{}, "extra": "field"})
+	assert.NotNil(t, err, "fields missing from the schema should fail the serialization")
+}
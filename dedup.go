@@ -0,0 +1,165 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type dedupKey struct {
+	fingerprint uint64
+	timestamp   int64
+}
+
+// dedupCache remembers the samples seen within a time window, so samples
+// resent by prometheus retries can be dropped.
+type dedupCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[dedupKey]time.Time
+	lastSweep time.Time
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window: window,
+		seen:   make(map[dedupKey]time.Time),
+	}
+}
+
+// Seen reports whether the sample was already seen within the window,
+// recording it otherwise.
+func (d *dedupCache) Seen(fingerprint uint64, timestamp int64, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastSweep) >= d.window {
+		d.sweep(now)
+	}
+
+	key := dedupKey{fingerprint: fingerprint, timestamp: timestamp}
+	if expiry, ok := d.seen[key]; ok && now.Before(expiry) {
+		return true
+	}
+	d.seen[key] = now.Add(d.window)
+	return false
+}
+
+// forget removes the samples from the cache, so they aren't dropped as
+// duplicates when sent again.
+func (d *dedupCache) forget(keys []dedupKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, key := range keys {
+		delete(d.seen, key)
+	}
+}
+
+// dedupRecord collects the samples a request recorded in the dedup cache, so
+// they can be forgotten if the request fails: prometheus retries it, and the
+// samples have to be produced then.
+type dedupRecord struct {
+	cache *dedupCache
+	keys  []dedupKey
+}
+
+// newDedupRecord returns the record of a request, nil without dedup cache.
+func newDedupRecord(cache *dedupCache) *dedupRecord {
+	if cache == nil {
+		return nil
+	}
+	return &dedupRecord{cache: cache}
+}
+
+func (r *dedupRecord) add(fingerprint uint64, timestamp int64) {
+	if r != nil {
+		r.keys = append(r.keys, dedupKey{fingerprint: fingerprint, timestamp: timestamp})
+	}
+}
+
+// Forget removes the samples recorded by the request from the cache.
+func (r *dedupRecord) Forget() {
+	if r != nil {
+		r.cache.forget(r.keys)
+		r.keys = nil
+	}
+}
+
+// Len returns the number of samples currently remembered.
+func (d *dedupCache) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.seen)
+}
+
+func (d *dedupCache) sweep(now time.Time) {
+	for key, expiry := range d.seen {
+		if !now.Before(expiry) {
+			delete(d.seen, key)
+		}
+	}
+	d.lastSweep = now
+}
+
+// collapseConflicts returns the request keeping a single sample for each
+// series and timestamp, the first or the last one of the request as set by
+// SAMPLE_CONFLICT_POLICY, so samples sent with different values for the same
+// time don't reach kafka, along with the number of samples collapsed. The
+// request isn't modified.
+func collapseConflicts(req *prompb.WriteRequest) (*prompb.WriteRequest, int) {
+	type position struct{ series, sample int }
+
+	winners := make(map[dedupKey]position)
+	fingerprints := make([]uint64, len(req.Timeseries))
+	conflicts := 0
+	for i, ts := range req.Timeseries {
+		labels := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			labels[l.Name] = l.Value
+		}
+		fingerprints[i] = fingerprint(labels)
+
+		for j, sample := range ts.Samples {
+			key := dedupKey{fingerprint: fingerprints[i], timestamp: sample.Timestamp}
+			if _, ok := winners[key]; ok {
+				conflicts++
+				if sampleConflictPolicy == "first-wins" {
+					continue
+				}
+			}
+			winners[key] = position{series: i, sample: j}
+		}
+	}
+	if conflicts == 0 {
+		return req, 0
+	}
+
+	collapsed := &prompb.WriteRequest{Timeseries: make([]*prompb.TimeSeries, 0, len(req.Timeseries))}
+	for i, ts := range req.Timeseries {
+		samples := make([]prompb.Sample, 0, len(ts.Samples))
+		for j, sample := range ts.Samples {
+			key := dedupKey{fingerprint: fingerprints[i], timestamp: sample.Timestamp}
+			if winners[key] == (position{series: i, sample: j}) {
+				samples = append(samples, sample)
+			}
+		}
+		collapsed.Timeseries = append(collapsed.Timeseries, &prompb.TimeSeries{Labels: ts.Labels, Samples: samples})
+	}
+	return collapsed, conflicts
+}
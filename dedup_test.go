@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupCacheWindow(t *testing.T) {
+	cache := newDedupCache(time.Minute)
+	now := time.Unix(1000, 0)
+
+	assert.False(t, cache.Seen(1, 0, now))
+	assert.True(t, cache.Seen(1, 0, now.Add(30*time.Second)))
+	assert.False(t, cache.Seen(1, 1000, now.Add(30*time.Second)))
+	assert.False(t, cache.Seen(2, 0, now.Add(30*time.Second)))
+
+	assert.False(t, cache.Seen(1, 0, now.Add(2*time.Minute)), "sample should be forwarded again once the window expired")
+	assert.Equal(t, 1, cache.Len(), "expired samples should be evicted")
+}
+
+func TestSerializeDedupRetriedRequest(t *testing.T) {
+	dedup = newDedupCache(time.Minute)
+	defer func() { dedup = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+
+	retried, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countMessages(retried))
+}
+
+func TestCollapseConflicts(t *testing.T) {
+	defer func() { sampleConflictPolicy = "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	for policy, expected := range map[string][]string{
+		"":           {"1", "2", "3", "5"},
+		"first-wins": {"1", "5"},
+		"last-wins":  {"3", "5"},
+	} {
+		sampleConflictPolicy = policy
+
+		writeRequest := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}},
+				Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 1000, Value: 2}, {Timestamp: 2000, Value: 5}},
+			},
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}},
+				Samples: []prompb.Sample{{Timestamp: 1000, Value: 3}},
+			},
+		}}
+
+		output, err := SerializeMessages(serializer, writeRequest)
+		assert.Nil(t, err)
+
+		var values []string
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				var metric map[string]interface{}
+				assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+				values = append(values, metric["value"].(string))
+			}
+		}
+		sort.Strings(values)
+		assert.Equal(t, expected, values, policy)
+		assert.Len(t, writeRequest.Timeseries[0].Samples, 3, "the request shouldn't be modified")
+	}
+}
+
+func TestReceiveDedupRetriedFailedRequest(t *testing.T) {
+	dedup = newDedupCache(time.Minute)
+	defer func() { dedup = nil }()
+
+	// the first attempt is rejected for the full producer queue
+	producer := &fakeProducer{full: 1}
+	w := serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	w = serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, producer.messages, 2, "the retried samples should be produced")
+
+	w = serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, producer.messages, 2, "the samples produced should be dropped as duplicates")
+}
+
+func TestSerializeDedupRateLimited(t *testing.T) {
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	cfg := serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate, dedup: newDedupCache(time.Minute)}
+
+	// the second sample of the series is over the rate limit
+	limited := cfg
+	limited.rateLimit = newRateLimiter(0.001, 1, 10)
+	output, err := serializeMessages(serializer, NewWriteRequest(), limited)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output))
+
+	output, err = serializeMessages(serializer, NewWriteRequest(), cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "the rate limited sample should be produced when resent")
+}
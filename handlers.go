@@ -15,9 +15,15 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -29,10 +35,53 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 )
 
-func receiveHandler(producer *kafka.Producer, serializer Serializer) func(c *gin.Context) {
+// Producer represents the subset of the kafka producer used by the handlers
+type Producer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+}
+
+// receiveHandler handles prometheus remote write requests, filtering them
+// with the rules of the given filter profile, or the MATCH rules if empty.
+func receiveHandler(producer Producer, serializer Serializer, profile string) func(c *gin.Context) {
 	return func(c *gin.Context) {
 
 		httpRequestsTotal.Add(float64(1))
+		c.Header(remoteWriteVersionHeader, strings.Join(remoteWriteVersions, ", "))
+
+		if inFlightSlots != nil {
+			select {
+			case inFlightSlots <- struct{}{}:
+				defer func() { <-inFlightSlots }()
+			default:
+				requestsInFlightRejected.Add(float64(1))
+				setRetryAfter(c, retryAfter)
+				c.AbortWithStatus(http.StatusTooManyRequests)
+				logrus.Warn("too many requests in flight, rejecting request")
+				return
+			}
+		}
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+
+		if !acceptedContentType(c.ContentType()) {
+			c.AbortWithStatus(http.StatusUnsupportedMediaType)
+			logrus.WithField("content-type", c.GetHeader("Content-Type")).Error("unsupported content type")
+			return
+		}
+
+		if version := c.GetHeader(remoteWriteVersionHeader); !supportedRemoteWriteVersion(version) {
+			c.AbortWithStatus(http.StatusBadRequest)
+			logrus.WithField("version", version).Error("unsupported remote write version")
+			return
+		}
+
+		tenant, ok := requestTenant(c)
+		if !ok {
+			c.String(http.StatusBadRequest, fmt.Sprintf("missing tenant header %s", tenantHeader))
+			c.Abort()
+			logrus.WithField("header", tenantHeader).Error("missing tenant header, rejecting request")
+			return
+		}
 
 		compressed, err := ioutil.ReadAll(c.Request.Body)
 		if err != nil {
@@ -41,49 +90,439 @@ func receiveHandler(producer *kafka.Producer, serializer Serializer) func(c *gin
 			return
 		}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
+		reqBuf, err := decodeBody(c.GetHeader("Content-Encoding"), compressed)
+		if errors.Is(err, errUnsupportedEncoding) {
+			c.String(http.StatusUnsupportedMediaType, err.Error())
+			c.Abort()
+			logrus.WithError(err).Error("unsupported content encoding")
+			return
+		}
 		if err != nil {
-			c.AbortWithStatus(http.StatusBadRequest)
+			c.String(http.StatusBadRequest, err.Error())
+			c.Abort()
 			logrus.WithError(err).Error("couldn't decompress body")
 			return
 		}
 
+		var stats *filterStats
+		if debugHeaders {
+			stats = &filterStats{}
+		}
+
+		limit := newSampleLimit(maxSamplesPerRequest)
+
+		if streamDecodeBatch > 0 {
+			err := decodeWriteRequest(reqBuf, streamDecodeBatch, func(chunk *prompb.WriteRequest) error {
+				if !limit.apply(c, chunk) {
+					return errRequestAborted
+				}
+				if tenant != "" {
+					setSeriesLabel(chunk, tenantHeaderLabel, tenant)
+				}
+				if !produceWriteRequest(c, producer, chunk, profile, stats) {
+					return errRequestAborted
+				}
+				return nil
+			})
+			if err != nil && !c.IsAborted() {
+				c.String(http.StatusBadRequest, fmt.Sprintf("couldn't unmarshal body: %s", err))
+				c.Abort()
+				logrus.WithError(err).Error("couldn't unmarshal body")
+			}
+			return
+		}
+
 		var req prompb.WriteRequest
 		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			c.AbortWithStatus(http.StatusBadRequest)
+			c.String(http.StatusBadRequest, fmt.Sprintf("couldn't unmarshal body: %s", err))
+			c.Abort()
 			logrus.WithError(err).Error("couldn't unmarshal body")
 			return
 		}
 
-		metricsPerTopic, err := processWriteRequest(&req)
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-			logrus.WithError(err).Error("couldn't process write request")
+		if !limit.apply(c, &req) {
 			return
 		}
+		if tenant != "" {
+			setSeriesLabel(&req, tenantHeaderLabel, tenant)
+		}
+		produceWriteRequest(c, producer, &req, profile, stats)
+	}
+}
+
+// requestTenant returns the tenant of the request from the TENANT_HEADER, or
+// the TENANT_DEFAULT if the header is missing. It reports false if the header
+// is missing and there is no default, to reject the request. The tenant is
+// empty without TENANT_HEADER.
+func requestTenant(c *gin.Context) (string, bool) {
+	if tenantHeader == "" {
+		return "", true
+	}
+	if tenant := c.GetHeader(tenantHeader); tenant != "" {
+		return tenant, true
+	}
+	return tenantDefault, tenantDefault != ""
+}
+
+// sampleLimit holds the samples a request can still carry under the
+// MAX_SAMPLES_PER_REQUEST, across the batches of a streamed request.
+type sampleLimit struct {
+	remaining int
+}
+
+// newSampleLimit returns the limit of a request, nil if there is no limit.
+func newSampleLimit(limit int) *sampleLimit {
+	if limit <= 0 {
+		return nil
+	}
+	return &sampleLimit{remaining: limit}
+}
+
+// apply enforces the limit on the series of the request, rejecting the
+// request with a 413 and returning false if they exceed it with the reject
+// MAX_SAMPLES_POLICY, or dropping the samples beyond it with truncate.
+func (l *sampleLimit) apply(c *gin.Context, req *prompb.WriteRequest) bool {
+	if l == nil {
+		return true
+	}
+
+	samples := countSamples(req)
+	if samples <= l.remaining {
+		l.remaining -= samples
+		return true
+	}
+	if maxSamplesPolicy == "reject" {
+		requestsSampleLimited.Add(float64(1))
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("request exceeds the limit of %d samples", maxSamplesPerRequest))
+		c.Abort()
+		logrus.WithField("limit", maxSamplesPerRequest).Warn("request exceeds the max samples, rejecting request")
+		return false
+	}
+
+	objectsSampleLimited.Add(float64(samples - l.remaining))
+	truncateSamples(req, l.remaining)
+	l.remaining = 0
+	return true
+}
+
+// countSamples returns the number of samples of the request.
+func countSamples(req *prompb.WriteRequest) int {
+	count := 0
+	for _, ts := range req.Timeseries {
+		count += len(ts.Samples)
+	}
+	return count
+}
+
+// truncateSamples keeps the first samples of the request, in series order, up
+// to the limit, removing the series left without samples.
+func truncateSamples(req *prompb.WriteRequest, limit int) {
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		if limit == 0 {
+			break
+		}
+		if len(ts.Samples) > limit {
+			ts.Samples = ts.Samples[:limit]
+		}
+		limit -= len(ts.Samples)
+		kept = append(kept, ts)
+	}
+	req.Timeseries = kept
+}
+
+// filterStatsHeader is the response header reporting the filter decisions
+// of the request with DEBUG.
+const filterStatsHeader = "X-Filter-Series"
+
+// errRequestAborted stops the decoding of a request already aborted.
+var errRequestAborted = errors.New("request aborted")
 
-		for topic, metrics := range metricsPerTopic {
-			t := topic
-			part := kafka.TopicPartition{
-				Partition: kafka.PartitionAny,
-				Topic:     &t,
+// produceWriteRequest serializes and produces the series of the request,
+// aborting the request and returning false on failure. The filter decisions
+// are accumulated in stats, if not nil, and reported in a response header.
+// On failure, the samples are removed from the dedup cache, so they aren't
+// dropped as duplicates when prometheus retries the request.
+func produceWriteRequest(c *gin.Context, producer Producer, req *prompb.WriteRequest, profile string, stats *filterStats) (ok bool) {
+	seen := newDedupRecord(dedup)
+	defer func() {
+		if !ok {
+			seen.Forget()
+		}
+	}()
+
+	metricsPerTopic, err := processWriteRequest(req, profile, stats, seen)
+	if stats != nil {
+		c.Header(filterStatsHeader, stats.String())
+	}
+	var serializeErr *SerializeError
+	if errors.As(err, &serializeErr) {
+		// samples failing serialization are dropped, the rest are produced
+		logrus.WithError(err).Warn("some samples couldn't be serialized")
+	} else if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		logrus.WithError(err).Error("couldn't process write request")
+		return false
+	}
+
+	var deliveryChan chan kafka.Event
+	if syncProduce {
+		deliveryChan = make(chan kafka.Event, countMessages(metricsPerTopic))
+	}
+
+	produced := 0
+	for _, topicMessages := range SortedByTopic(metricsPerTopic) {
+		topic := topicMessages.Topic
+		for _, metric := range topicMessages.Messages {
+			objectsWritten.Add(float64(1))
+			msg := &kafka.Message{
+				TopicPartition: kafka.TopicPartition{
+					Partition: metric.Partition,
+					Topic:     &topic,
+				},
+				Key:       metric.Key,
+				Value:     metric.Value,
+				Headers:   metric.Headers,
+				Timestamp: metric.Timestamp,
+			}
+			if metric.HighPriority {
+				msg.Opaque = highPriority
 			}
-			for _, metric := range metrics {
-				objectsWritten.Add(float64(1))
-				err := producer.Produce(&kafka.Message{
-					TopicPartition: part,
-					Value:          metric,
-				}, nil)
-
-				if err != nil {
-					objectsFailed.Add(float64(1))
-					c.AbortWithStatus(http.StatusInternalServerError)
-					logrus.WithError(err).Debug(fmt.Sprintf("Failing metric %v", metric))
-					logrus.WithError(err).Error(fmt.Sprintf("couldn't produce message in kafka topic %v", topic))
-					return
+			messageExpiry.Apply(msg, time.Now())
+			err := messageSequence.Produce(msg, func() error {
+				return produce(c, producer, msg, deliveryChan)
+			})
+
+			if isQueueFull(err) && queueFullPolicy == "drop-newest" {
+				queueFullDropped.Add(float64(1))
+				continue
+			}
+			if isQueueFull(err) && queueFullPolicy == "reject" {
+				queueFullRejected.Add(float64(1))
+				setRetryAfter(c, retryAfter)
+				c.AbortWithStatus(http.StatusTooManyRequests)
+				logrus.WithField("topic", topic).Warn("kafka producer queue is full, rejecting request")
+				return false
+			}
+			if err != nil {
+				objectsFailed.Add(float64(1))
+				c.AbortWithStatus(http.StatusInternalServerError)
+				logrus.WithError(err).Debug(fmt.Sprintf("Failing metric %v", metric.Value))
+				logrus.WithError(err).Error(fmt.Sprintf("couldn't produce message in kafka topic %v", topic))
+				return false
+			}
+			countProduced(topic, metric.Value)
+			produced++
+		}
+	}
+
+	if syncProduce {
+		if err := awaitDelivery(c, deliveryChan, produced); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			logrus.WithError(err).Error("couldn't deliver messages to kafka")
+			return false
+		}
+	}
+	return true
+}
+
+// configHandler serves the effective configuration, with the secrets
+// redacted.
+func configHandler() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, effectiveConfig())
+	}
+}
+
+// remoteWriteVersionHeader is the header telling the remote write protocol
+// version of the request, and the versions supported by the adapter in the
+// responses.
+const remoteWriteVersionHeader = "X-Prometheus-Remote-Write-Version"
+
+// remoteWriteVersions are the remote write protocol versions the receive
+// endpoint can decode.
+var remoteWriteVersions = []string{"0.1.0"}
+
+// supportedRemoteWriteVersion reports whether the remote write version of a
+// request is supported. Requests without version are decoded as 0.1.0, as
+// sent by the clients predating the header.
+func supportedRemoteWriteVersion(version string) bool {
+	if version == "" {
+		return true
+	}
+	for _, supported := range remoteWriteVersions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedContentType reports whether a request with the content type can be
+// decoded. Requests without content type are taken as application/x-protobuf,
+// as sent by the clients that don't set it.
+func acceptedContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	for _, accepted := range acceptedContentTypes {
+		if contentType == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// errUnsupportedEncoding is returned for request bodies compressed with an
+// encoding the adapter can't decode.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// gzipMagic are the first bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decodeBody decompresses the request body as told by its Content-Encoding,
+// either snappy, the remote write default, gzip or identity. Without the
+// header, a body unmarshalling as a write request is taken as uncompressed,
+// as snappy could mangle it, and the encoding is sniffed otherwise: gzip by
+// its magic bytes, then snappy if the body decodes as such.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "snappy":
+		buf, err := snappy.Decode(nil, body)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress snappy body: %s", err)
+		}
+		return buf, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress gzip body: %s", err)
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress gzip body: %s", err)
+		}
+		return buf, nil
+	case "identity":
+		return body, nil
+	case "":
+		if proto.Unmarshal(body, &prompb.WriteRequest{}) == nil {
+			return body, nil
+		}
+		if bytes.HasPrefix(body, gzipMagic) {
+			return decodeBody("gzip", body)
+		}
+		if buf, err := snappy.Decode(nil, body); err == nil {
+			return buf, nil
+		}
+		return body, nil
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+}
+
+// countProduced counts a message handed to the producer in the per topic
+// throughput metrics.
+func countProduced(topic string, value []byte) {
+	topicMessagesProduced.WithLabelValues(topic).Inc()
+	topicBytesProduced.WithLabelValues(topic).Add(float64(len(value)))
+}
+
+// produce hands the message to the producer. With the block queue full
+// policy, the message is retried until the producer queue has room for it or
+// the request is cancelled.
+func produce(c *gin.Context, producer Producer, msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	err := producer.Produce(msg, deliveryChan)
+	if !isQueueFull(err) || queueFullPolicy != "block" {
+		return err
+	}
+
+	queueFullBlocked.Add(float64(1))
+	for isQueueFull(err) {
+		select {
+		case <-time.After(queueFullRetryInterval):
+			err = producer.Produce(msg, deliveryChan)
+		case <-c.Request.Context().Done():
+			return c.Request.Context().Err()
+		}
+	}
+	return err
+}
+
+// setRetryAfter tells the client how long to back off before retrying the
+// request, in whole seconds rounded up.
+func setRetryAfter(c *gin.Context, after time.Duration) {
+	seconds := int64((after + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// isQueueFull reports whether the produce error is due to the producer queue
+// being full.
+func isQueueFull(err error) bool {
+	var kafkaErr kafka.Error
+	return errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrQueueFull
+}
+
+// awaitDelivery blocks until the delivery reports of the given number of
+// produced messages are received, returning the first delivery failure.
+func awaitDelivery(c *gin.Context, deliveryChan chan kafka.Event, produced int) error {
+	var failed error
+	for i := 0; i < produced; i++ {
+		select {
+		case e := <-deliveryChan:
+			if m, ok := e.(*kafka.Message); ok {
+				if err := recordDelivery(m); err != nil && failed == nil {
+					failed = err
+				}
+			}
+		case <-c.Request.Context().Done():
+			return c.Request.Context().Err()
+		}
+	}
+	return failed
+}
+
+// handleDeliveryReports consumes the producer events, recording the outcome
+// of the delivery of each message, until the events channel is closed.
+// Identical errors are logged one in every LOG_ERROR_SAMPLING.
+func handleDeliveryReports(events <-chan kafka.Event) {
+	sampler := newLogSampler(logErrorSampling)
+	for e := range events {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			if err := recordDelivery(ev); err != nil {
+				topic := *ev.TopicPartition.Topic
+				if ok, suppressed := sampler.Allow(topic + ": " + err.Error()); ok {
+					logrus.WithError(err).WithField("suppressed", suppressed).Error(fmt.Sprintf("couldn't deliver message to kafka topic %v", topic))
 				}
 			}
+		case kafka.Error:
+			if ok, suppressed := sampler.Allow(ev.Error()); ok {
+				logrus.WithError(ev).WithField("suppressed", suppressed).Error("kafka producer error")
+			}
 		}
+	}
+}
+
+// recordDelivery updates the self metrics with the delivery report of a
+// message, returning the delivery error if any.
+func recordDelivery(m *kafka.Message) error {
+	if m.TopicPartition.Error != nil {
+		objectsFailed.Add(float64(1))
+		return m.TopicPartition.Error
+	}
+	lastProduceTimestamp.SetToCurrentTime()
+	return nil
+}
 
+func countMessages(metricsPerTopic map[string][]Message) int {
+	count := 0
+	for _, metrics := range metricsPerTopic {
+		count += len(metrics)
 	}
+	return count
 }
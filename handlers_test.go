@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProducer struct {
+	mu       sync.Mutex
+	messages []*kafka.Message
+	delay    time.Duration
+	err      error
+	// full is the number of produce calls failing with a full queue
+	full int
+}
+
+func (p *fakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	p.mu.Lock()
+	if p.full > 0 {
+		p.full--
+		p.mu.Unlock()
+		return kafka.NewError(kafka.ErrQueueFull, "Local: Queue full", false)
+	}
+	p.messages = append(p.messages, msg)
+	p.mu.Unlock()
+
+	if deliveryChan != nil {
+		go func() {
+			time.Sleep(p.delay)
+			report := *msg
+			report.TopicPartition.Error = p.err
+			deliveryChan <- &report
+		}()
+	}
+	return nil
+}
+
+func newReceiveRequest(t *testing.T, req *prompb.WriteRequest) *http.Request {
+	data, err := proto.Marshal(req)
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/receive", bytes.NewReader(snappy.Encode(nil, data)))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("Content-Encoding", "snappy")
+	r.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return r
+}
+
+func serveReceive(t *testing.T, producer Producer, req *prompb.WriteRequest) *httptest.ResponseRecorder {
+	return serveReceiveRequest(producer, newReceiveRequest(t, req))
+}
+
+func serveReceiveRequest(producer Producer, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newReceiveRouter(producer).ServeHTTP(w, req)
+	return w
+}
+
+func newReceiveRouter(producer Producer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/receive", receiveHandler(producer, serializer, ""))
+	return r
+}
+
+func TestReceiveAsyncProduce(t *testing.T) {
+	syncProduce = false
+	producer := &fakeProducer{delay: 200 * time.Millisecond, err: errors.New("broker down")}
+
+	start := time.Now()
+	w := serveReceive(t, producer, NewWriteRequest())
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Less(t, int64(time.Since(start)), int64(producer.delay), "async produce should not wait for delivery")
+	assert.Len(t, producer.messages, 2)
+}
+
+func TestReceiveSyncProduce(t *testing.T) {
+	syncProduce = true
+	defer func() { syncProduce = false }()
+	producer := &fakeProducer{delay: 100 * time.Millisecond}
+
+	start := time.Now()
+	w := serveReceive(t, producer, NewWriteRequest())
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(producer.delay), "sync produce should wait for delivery")
+	assert.Len(t, producer.messages, 2)
+}
+
+func TestReceiveSyncProduceDeliveryFailure(t *testing.T) {
+	syncProduce = true
+	defer func() { syncProduce = false }()
+	producer := &fakeProducer{err: errors.New("broker down")}
+
+	w := serveReceive(t, producer, NewWriteRequest())
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestDeliveryReportsUpdateLastProduceTimestamp(t *testing.T) {
+	lastProduceTimestamp.Set(0)
+	topic := "metrics"
+
+	events := make(chan kafka.Event, 2)
+	events <- &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Error: errors.New("broker down")}}
+	events <- &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	close(events)
+
+	before := float64(time.Now().Unix())
+	handleDeliveryReports(events)
+
+	m := &dto.Metric{}
+	assert.Nil(t, lastProduceTimestamp.Write(m))
+	assert.GreaterOrEqual(t, m.GetGauge().GetValue(), before)
+}
+
+func TestReceiveContentType(t *testing.T) {
+	accepted := newReceiveRequest(t, NewWriteRequest())
+	accepted.Header.Set("Content-Type", "application/x-protobuf; proto=prometheus.WriteRequest")
+	assert.Equal(t, http.StatusOK, serveReceiveRequest(&fakeProducer{}, accepted).Code)
+
+	rejected := newReceiveRequest(t, NewWriteRequest())
+	rejected.Header.Set("Content-Type", "application/json")
+	assert.Equal(t, http.StatusUnsupportedMediaType, serveReceiveRequest(&fakeProducer{}, rejected).Code)
+
+	missing := newReceiveRequest(t, NewWriteRequest())
+	missing.Header.Del("Content-Type")
+	assert.Equal(t, http.StatusOK, serveReceiveRequest(&fakeProducer{}, missing).Code, "a missing content type should be taken as protobuf")
+}
+
+func TestReceiveExtendedContentType(t *testing.T) {
+	acceptedContentTypes = append(acceptedContentTypes, "application/octet-stream")
+	defer func() { acceptedContentTypes = acceptedContentTypes[:len(acceptedContentTypes)-1] }()
+
+	req := newReceiveRequest(t, NewWriteRequest())
+	req.Header.Set("Content-Type", "application/octet-stream")
+	assert.Equal(t, http.StatusOK, serveReceiveRequest(&fakeProducer{}, req).Code)
+}
+
+func TestReceiveFilterProfiles(t *testing.T) {
+	var err error
+	filterProfiles, err = parseFilterProfiles(`{edge: ['foo{labelfoo="label-bar"}'], core: ['bar']}`)
+	assert.Nil(t, err)
+	filterRoutes, err = parseFilterRoutes(`{/write/edge: edge, /write/core: core}`, filterProfiles)
+	assert.Nil(t, err)
+	defer func() {
+		filterProfiles = make(map[string]map[string]*dto.MetricFamily)
+		filterRoutes = make(map[string]string)
+	}()
+
+	edge := &fakeProducer{}
+	core := &fakeProducer{}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/write/edge", receiveHandler(edge, serializer, filterRoutes["/write/edge"]))
+	r.POST("/write/core", receiveHandler(core, serializer, filterRoutes["/write/core"]))
+
+	for _, route := range []string{"/write/edge", "/write/core"} {
+		req := newReceiveRequest(t, NewWriteRequest())
+		req.URL.Path = route
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	assert.Len(t, edge.messages, 2, "edge profile should keep foo")
+	assert.Len(t, core.messages, 0, "core profile should drop foo")
+}
+
+func TestParseFilterRoutesUnknownProfile(t *testing.T) {
+	_, err := parseFilterRoutes(`{/write/edge: edge}`, map[string]map[string]*dto.MetricFamily{})
+	assert.NotNil(t, err)
+}
+
+func TestReceiveQueueFullPolicies(t *testing.T) {
+	defer func() { queueFullPolicy = "reject" }()
+
+	queueFullPolicy = "reject"
+	producer := &fakeProducer{full: 1}
+	w := serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+	assert.Len(t, producer.messages, 0)
+
+	queueFullPolicy = "drop-newest"
+	producer = &fakeProducer{full: 1}
+	assert.Equal(t, http.StatusOK, serveReceive(t, producer, NewWriteRequest()).Code)
+	assert.Len(t, producer.messages, 1, "the message not fitting in the queue should be dropped")
+
+	queueFullPolicy = "block"
+	producer = &fakeProducer{full: 3}
+	assert.Equal(t, http.StatusOK, serveReceive(t, producer, NewWriteRequest()).Code)
+	assert.Len(t, producer.messages, 2, "the message should be produced once the queue has room")
+
+	// with drop-oldest, the messages go through the adapter's queue, which
+	// makes room by itself
+	queueFullPolicy = "drop-oldest"
+	producer = &fakeProducer{}
+	queued := newPriorityProducer(producer, 1, true, time.Minute)
+	assert.Equal(t, http.StatusOK, serveReceive(t, queued, NewWriteRequest()).Code)
+	assert.Equal(t, 0, queued.Flush(1000))
+	assert.NotEmpty(t, producer.messages)
+}
+
+func TestParseQueueFullPolicy(t *testing.T) {
+	assert.Equal(t, "block", parseQueueFullPolicy("block"))
+	assert.Equal(t, "drop-newest", parseQueueFullPolicy("drop-newest"))
+	assert.Equal(t, "drop-oldest", parseQueueFullPolicy("drop-oldest"))
+	assert.Equal(t, "reject", parseQueueFullPolicy("unknown"))
+}
+
+func TestReceiveRecordTimestampFromSample(t *testing.T) {
+	sampleRecordTimestamp = true
+	defer func() { sampleRecordTimestamp = false }()
+
+	producer := &fakeProducer{}
+	w := serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var timestamps []time.Time
+	for _, msg := range producer.messages {
+		timestamps = append(timestamps, msg.Timestamp)
+	}
+	assert.ElementsMatch(t, []time.Time{time.Unix(0, 0).UTC(), time.Unix(10, 0).UTC()}, timestamps)
+}
+
+func TestReceiveRetryAfter(t *testing.T) {
+	retryAfter = 1500 * time.Millisecond
+	defer func() { retryAfter = 5 * time.Second }()
+
+	w := serveReceive(t, &fakeProducer{full: 1}, NewWriteRequest())
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"), "retry after should be rounded up to seconds")
+
+	w = serveReceive(t, &fakeProducer{}, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+}
+
+func TestReceiveMaxInFlightRequests(t *testing.T) {
+	inFlightSlots = make(chan struct{}, 2)
+	syncProduce = true
+	defer func() { inFlightSlots, syncProduce = nil, false }()
+	producer := &fakeProducer{delay: 300 * time.Millisecond}
+
+	// the router and requests are built upfront, gin.SetMode isn't safe for
+	// concurrent use
+	router := newReceiveRouter(producer)
+	var wg sync.WaitGroup
+	codes := make(chan int, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		req := newReceiveRequest(t, NewWriteRequest())
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	count := make(map[int]int)
+	for code := range codes {
+		count[code]++
+	}
+	assert.GreaterOrEqual(t, count[http.StatusOK], 1)
+	assert.LessOrEqual(t, count[http.StatusOK], 2, "at most the limit of requests should be handled at once")
+	assert.GreaterOrEqual(t, count[http.StatusTooManyRequests], 4)
+	assert.Empty(t, inFlightSlots, "the slots should be released")
+
+	assert.Equal(t, http.StatusOK, serveReceive(t, producer, NewWriteRequest()).Code)
+}
+
+func TestReceiveRemoteWriteVersion(t *testing.T) {
+	known := newReceiveRequest(t, NewWriteRequest())
+	w := serveReceiveRequest(&fakeProducer{}, known)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0.1.0", w.Header().Get("X-Prometheus-Remote-Write-Version"))
+
+	unknown := newReceiveRequest(t, NewWriteRequest())
+	unknown.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+	w = serveReceiveRequest(&fakeProducer{}, unknown)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "0.1.0", w.Header().Get("X-Prometheus-Remote-Write-Version"), "supported versions should be advertised")
+
+	missing := newReceiveRequest(t, NewWriteRequest())
+	missing.Header.Del("X-Prometheus-Remote-Write-Version")
+	assert.Equal(t, http.StatusOK, serveReceiveRequest(&fakeProducer{}, missing).Code)
+}
+
+func TestReceiveContentEncodings(t *testing.T) {
+	data, err := proto.Marshal(NewWriteRequest())
+	assert.Nil(t, err)
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	for _, tcase := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"snappy", snappy.Encode(nil, data)},
+		{"gzip", gzipped.Bytes()},
+		{"identity", data},
+		{"", snappy.Encode(nil, data)},
+		{"", gzipped.Bytes()},
+		{"", data},
+	} {
+		r := newReceiveRequest(t, &prompb.WriteRequest{})
+		r.Body = ioutil.NopCloser(bytes.NewReader(tcase.body))
+		r.Header.Set("Content-Encoding", tcase.encoding)
+
+		producer := &fakeProducer{}
+		w := serveReceiveRequest(producer, r)
+		assert.Equal(t, http.StatusOK, w.Code, tcase.encoding)
+		assert.Len(t, producer.messages, 2, tcase.encoding)
+	}
+}
+
+func TestReceiveMalformedBody(t *testing.T) {
+	for _, tcase := range []struct {
+		encoding string
+		body     []byte
+		code     int
+		message  string
+	}{
+		{"br", []byte("irrelevant"), http.StatusUnsupportedMediaType, `unsupported content encoding "br"`},
+		{"snappy", []byte("not snappy"), http.StatusBadRequest, "couldn't decompress snappy body"},
+		{"gzip", []byte("not gzip"), http.StatusBadRequest, "couldn't decompress gzip body"},
+		{"gzip", gzipMagic, http.StatusBadRequest, "couldn't decompress gzip body"},
+		{"identity", []byte{0x0a, 0xff}, http.StatusBadRequest, "couldn't unmarshal body"},
+	} {
+		r := newReceiveRequest(t, &prompb.WriteRequest{})
+		r.Body = ioutil.NopCloser(bytes.NewReader(tcase.body))
+		r.Header.Set("Content-Encoding", tcase.encoding)
+
+		producer := &fakeProducer{}
+		w := serveReceiveRequest(producer, r)
+		assert.Equal(t, tcase.code, w.Code, tcase.encoding)
+		assert.Contains(t, w.Body.String(), tcase.message, tcase.encoding)
+		assert.Empty(t, producer.messages)
+	}
+}
+
+func TestReceivePerTopicCounters(t *testing.T) {
+	tpl, err := parseTopicTemplate(`throughput.{{ index . "__name__" }}`)
+	assert.Nil(t, err)
+	previous := defaultSerializeConfig()
+	setRules(make(map[string]*dto.MetricFamily), tpl)
+	defer setRules(previous.match, previous.topicTemplate)
+
+	req := NewWriteRequest()
+	req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "bar"}},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+	})
+
+	producer := &fakeProducer{}
+	assert.Equal(t, http.StatusOK, serveReceive(t, producer, req).Code)
+
+	bytesPerTopic := make(map[string]int)
+	for _, msg := range producer.messages {
+		bytesPerTopic[*msg.TopicPartition.Topic] += len(msg.Value)
+	}
+
+	for topic, expected := range map[string]int{"throughput.foo": 2, "throughput.bar": 1} {
+		metric := &dto.Metric{}
+		assert.Nil(t, topicMessagesProduced.WithLabelValues(topic).Write(metric))
+		assert.Equal(t, float64(expected), metric.GetCounter().GetValue(), topic)
+
+		assert.Nil(t, topicBytesProduced.WithLabelValues(topic).Write(metric))
+		assert.Equal(t, float64(bytesPerTopic[topic]), metric.GetCounter().GetValue(), topic)
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	kafkaSaslUsername, kafkaSaslPassword = "adapter", "sasl-secret"
+	kafkaSslClientKeyPass = "key-secret"
+	defer func() {
+		kafkaSaslUsername, kafkaSaslPassword = "", ""
+		kafkaSslClientKeyPass = ""
+	}()
+
+	rules, err := parseMatchList(`['up{job="node"}', 'http_requests_total{code>=500}']`)
+	assert.Nil(t, err)
+	previous := defaultSerializeConfig()
+	setRules(rules, previous.topicTemplate)
+	defer setRules(previous.match, previous.topicTemplate)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/config", configHandler())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var config map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &config))
+	assert.Equal(t, kafkaBrokerList, config["KAFKA_BROKER_LIST"])
+	assert.Equal(t, "adapter", config["KAFKA_SASL_USERNAME"])
+	assert.Equal(t, redacted, config["KAFKA_SASL_PASSWORD"])
+	assert.Equal(t, redacted, config["KAFKA_SSL_CLIENT_KEY_PASS"])
+	assert.Equal(t, "", config["BASIC_AUTH_PASSWORD"], "unset secrets should be left empty")
+	assert.Equal(t, []interface{}{"http_requests_total{code>=500}", `up{job="node"}`}, config["MATCH"])
+	assert.Equal(t, "json", config["SERIALIZATION_FORMAT"])
+	assert.Equal(t, "default", config["PARTITIONER"])
+	assert.NotContains(t, w.Body.String(), "secret")
+}
+
+func TestReceiveFilterStatsHeader(t *testing.T) {
+	defer func() { debugHeaders = false }()
+
+	rules, err := parseMatchList(`['foo']`)
+	assert.Nil(t, err)
+	previous := defaultSerializeConfig()
+	setRules(rules, previous.topicTemplate)
+	defer setRules(previous.match, previous.topicTemplate)
+
+	req := NewWriteRequest()
+	req.Timeseries = append(req.Timeseries,
+		&prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "bar"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+		},
+		&prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "baz"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+		},
+	)
+
+	w := serveReceive(t, &fakeProducer{}, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(filterStatsHeader), "the header should only be sent with DEBUG")
+
+	debugHeaders = true
+	producer := &fakeProducer{}
+	w = serveReceive(t, producer, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "received=3, kept=1, dropped=2", w.Header().Get(filterStatsHeader))
+	assert.Len(t, producer.messages, 2)
+
+	streamDecodeBatch = 1
+	defer func() { streamDecodeBatch = 0 }()
+	w = serveReceive(t, &fakeProducer{}, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "received=3, kept=1, dropped=2", w.Header().Get(filterStatsHeader), "the decisions should add up across streamed batches")
+}
+
+func TestReceiveTenantHeader(t *testing.T) {
+	defer func() { tenantHeader, tenantDefault = "", "" }()
+	tenantHeader = "X-Scope-OrgID"
+
+	assertTenant := func(producer *fakeProducer, tenant string) {
+		assert.Len(t, producer.messages, 2)
+		for _, msg := range producer.messages {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &m))
+			assert.Equal(t, tenant, m["labels"].(map[string]interface{})["tenant"])
+		}
+	}
+
+	// present
+	producer := &fakeProducer{}
+	req := newReceiveRequest(t, NewWriteRequest())
+	req.Header.Set("X-Scope-OrgID", "team-a")
+	w := serveReceiveRequest(producer, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assertTenant(producer, "team-a")
+
+	// missing, rejected
+	producer = &fakeProducer{}
+	w = serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "X-Scope-OrgID")
+	assert.Empty(t, producer.messages)
+
+	// missing, defaulted
+	tenantDefault = "anonymous"
+	producer = &fakeProducer{}
+	w = serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assertTenant(producer, "anonymous")
+
+	// the header replaces the label of the series
+	writeRequest := NewWriteRequest()
+	setSeriesLabel(writeRequest, "tenant", "spoofed")
+	producer = &fakeProducer{}
+	req = newReceiveRequest(t, writeRequest)
+	req.Header.Set("X-Scope-OrgID", "team-b")
+	w = serveReceiveRequest(producer, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assertTenant(producer, "team-b")
+}
+
+func TestReceiveMaxSamplesPerRequest(t *testing.T) {
+	maxSamplesPerRequest = 3
+	defer func() { maxSamplesPerRequest, maxSamplesPolicy, streamDecodeBatch = 0, "reject", 0 }()
+
+	req := &prompb.WriteRequest{}
+	for _, name := range []string{"a", "b", "c"} {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: name}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 0}, {Value: 2, Timestamp: 1000}},
+		})
+	}
+
+	producer := &fakeProducer{}
+	w := serveReceive(t, producer, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(t, producer.messages)
+
+	limited := &dto.Metric{}
+	assert.Nil(t, objectsSampleLimited.Write(limited))
+	before := limited.GetCounter().GetValue()
+
+	maxSamplesPolicy = "truncate"
+	for _, batch := range []int{0, 1} {
+		streamDecodeBatch = batch
+		producer = &fakeProducer{}
+		w = serveReceive(t, producer, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var names []string
+		for _, msg := range producer.messages {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &m))
+			names = append(names, m["name"].(string))
+		}
+		assert.ElementsMatch(t, []string{"a", "a", "b"}, names, "stream decode batch %d", batch)
+	}
+
+	assert.Nil(t, objectsSampleLimited.Write(limited))
+	assert.Equal(t, before+6, limited.GetCounter().GetValue())
+
+	// requests under the limit are untouched
+	producer = &fakeProducer{}
+	w = serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, producer.messages, 2)
+}
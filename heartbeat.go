@@ -0,0 +1,81 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// heartbeat is the message periodically produced to the heartbeat topic, so
+// downstream pipelines can tell the adapter is alive while no metrics flow.
+type heartbeat struct {
+	AdapterID string `json:"adapter_id"`
+	Timestamp string `json:"timestamp"`
+}
+
+// startHeartbeat produces a heartbeat keyed by the adapter id to the topic
+// every interval, until the returned function is called. The function waits
+// for the heartbeat goroutine to exit.
+func startHeartbeat(producer Producer, topic, adapterID string, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				produceHeartbeat(producer, topic, adapterID, now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func produceHeartbeat(producer Producer, topic, adapterID string, now time.Time) {
+	value, err := json.Marshal(heartbeat{
+		AdapterID: adapterID,
+		Timestamp: now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		logrus.WithError(err).Error("couldn't marshal heartbeat")
+		return
+	}
+
+	err = producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{
+			Partition: kafka.PartitionAny,
+			Topic:     &topic,
+		},
+		Key:   []byte(adapterID),
+		Value: value,
+	}, nil)
+	if err != nil {
+		logrus.WithError(err).WithField("topic", topic).Error("couldn't produce heartbeat")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	producer := &fakeProducer{}
+	stop := startHeartbeat(producer, "control", "adapter-1", 10*time.Millisecond)
+	time.Sleep(55 * time.Millisecond)
+	stop()
+
+	producer.mu.Lock()
+	produced := len(producer.messages)
+	messages := producer.messages
+	producer.mu.Unlock()
+	assert.GreaterOrEqual(t, produced, 2)
+
+	for _, msg := range messages {
+		assert.Equal(t, "control", *msg.TopicPartition.Topic)
+		assert.Equal(t, "adapter-1", string(msg.Key))
+
+		var beat heartbeat
+		assert.Nil(t, json.Unmarshal(msg.Value, &beat))
+		assert.Equal(t, "adapter-1", beat.AdapterID)
+		_, err := time.Parse(time.RFC3339, beat.Timestamp)
+		assert.Nil(t, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+	assert.Len(t, producer.messages, produced, "no heartbeat should be produced once stopped")
+}
@@ -0,0 +1,99 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// integrationBroker is the address the kafka container is advertised and
+// published on, the port is fixed as kafka must advertise it before starting.
+const integrationBroker = "localhost:19092"
+
+func startKafka(t *testing.T) func() {
+	ctx := context.Background()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "docker.redpanda.com/vectorized/redpanda:v22.3.11",
+			ExposedPorts: []string{"19092:19092/tcp"},
+			Cmd: []string{
+				"redpanda", "start", "--mode", "dev-container", "--smp", "1",
+				"--kafka-addr", "0.0.0.0:19092",
+				"--advertise-kafka-addr", integrationBroker,
+			},
+			WaitingFor: wait.ForLog("Successfully started Redpanda!").WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("couldn't start kafka: %s", err)
+	}
+	return func() { container.Terminate(ctx) }
+}
+
+func TestIntegrationProduce(t *testing.T) {
+	defer startKafka(t)()
+
+	rules, err := parseMatchList(`['foo']`)
+	assert.Nil(t, err)
+	tpl, err := parseTopicTemplate(`metrics.{{ index . "__name__" }}`)
+	assert.Nil(t, err)
+	previous := defaultSerializeConfig()
+	setRules(rules, tpl)
+	defer setRules(previous.match, previous.topicTemplate)
+
+	syncProduce = true
+	defer func() { syncProduce = false }()
+
+	producer, err := newKafkaProducer(&kafka.ConfigMap{
+		"bootstrap.servers":   integrationBroker,
+		"go.delivery.reports": true,
+	})
+	assert.Nil(t, err)
+
+	req := NewWriteRequest()
+	req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "bar"}},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+	})
+	w := serveReceive(t, producer, req)
+	assert.Equal(t, 200, w.Code)
+
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": integrationBroker,
+		"group.id":          "integration",
+		"auto.offset.reset": "earliest",
+	})
+	assert.Nil(t, err)
+	defer consumer.Close()
+
+	assert.Nil(t, consumer.Subscribe("metrics.foo", nil))
+	var values []string
+	for len(values) < 2 {
+		msg, err := consumer.ReadMessage(30 * time.Second)
+		if !assert.Nil(t, err) {
+			break
+		}
+		assert.Equal(t, "metrics.foo", *msg.TopicPartition.Topic)
+
+		var metric map[string]interface{}
+		assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+		assert.Equal(t, "foo", metric["name"])
+		values = append(values, metric["value"].(string))
+	}
+	assert.ElementsMatch(t, []string{"456", "+Inf"}, values)
+
+	metadata, err := consumer.GetMetadata(nil, true, 10000)
+	assert.Nil(t, err)
+	assert.NotContains(t, metadata.Topics, "metrics.bar", "filtered series shouldn't be produced")
+}
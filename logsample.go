@@ -0,0 +1,55 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// logSamplerMaxKeys bounds the distinct messages a log sampler counts, the
+// counts are reset once reached.
+const logSamplerMaxKeys = 1024
+
+// logSampler thins out repeated identical log messages, logging the first
+// occurrence of a message and then one in every n.
+type logSampler struct {
+	every  int
+	counts map[string]int
+}
+
+func newLogSampler(every int) *logSampler {
+	if every < 1 {
+		every = 1
+	}
+	return &logSampler{
+		every:  every,
+		counts: make(map[string]int),
+	}
+}
+
+// Allow reports whether the occurrence of the message identified by key has
+// to be logged, along with the number of occurrences suppressed since the
+// last one logged.
+func (s *logSampler) Allow(key string) (bool, int) {
+	n, ok := s.counts[key]
+	if !ok && len(s.counts) >= logSamplerMaxKeys {
+		s.counts = make(map[string]int)
+	}
+	s.counts[key] = n + 1
+
+	if n%s.every != 0 {
+		return false, 0
+	}
+	if n == 0 {
+		return true, 0
+	}
+	return true, s.every - 1
+}
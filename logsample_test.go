@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSampler(t *testing.T) {
+	sampler := newLogSampler(5)
+
+	var logged []int
+	for i := 0; i < 12; i++ {
+		if ok, suppressed := sampler.Allow("broker down"); ok {
+			logged = append(logged, suppressed)
+		}
+	}
+	assert.Equal(t, []int{0, 4, 4}, logged, "the first error and then one in five should be logged")
+
+	ok, _ := sampler.Allow("other error")
+	assert.True(t, ok, "different errors should be sampled separately")
+}
+
+func TestDeliveryReportsSampleErrors(t *testing.T) {
+	logErrorSampling = 5
+	defer func() { logErrorSampling = 1 }()
+
+	var out bytes.Buffer
+	previous := logrus.StandardLogger().Out
+	logrus.SetOutput(&out)
+	defer logrus.SetOutput(previous)
+
+	topic := "metrics"
+	events := make(chan kafka.Event, 10)
+	for i := 0; i < 10; i++ {
+		events <- &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Error: errors.New("broker down")}}
+	}
+	close(events)
+	handleDeliveryReports(events)
+
+	assert.Equal(t, 2, strings.Count(out.String(), "couldn't deliver message"))
+}
@@ -15,6 +15,10 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -27,45 +31,45 @@ import (
 func main() {
 	logrus.Info("creating kafka producer")
 
-	kafkaConfig := kafka.ConfigMap{
-		"bootstrap.servers":   kafkaBrokerList,
-		"compression.codec":   kafkaCompression,
-		"batch.num.messages":  kafkaBatchNumMessages,
-		"go.batch.producer":   true,  // Enable batch producer (for increased performance).
-		"go.delivery.reports": false, // per-message delivery reports to the Events() channel
-	}
-
-	if kafkaSslClientCertFile != "" && kafkaSslClientKeyFile != "" && kafkaSslCACertFile != "" {
-		if kafkaSecurityProtocol == "" {
-			kafkaSecurityProtocol = "ssl"
+	var producer Producer
+	var reloading *reloadingProducer
+	var err error
+	if outputBackend == "ocf" {
+		if ocfDirectory == "" {
+			logrus.Fatal("invalid config: the ocf output backend requires OCF_DIRECTORY")
 		}
-
-		if kafkaSecurityProtocol != "ssl" && kafkaSecurityProtocol != "sasl_ssl" {
-			logrus.Fatal("invalid config: kafka security protocol is not ssl based but ssl config is provided")
+		ocf, err := newOCFProducer(serializer, dirBlobStore{dir: ocfDirectory}, ocfMaxBytes, ocfMaxAge)
+		if err != nil {
+			logrus.WithError(err).Fatal("couldn't create the ocf output backend")
 		}
-
-		kafkaConfig["security.protocol"] = kafkaSecurityProtocol
-		kafkaConfig["ssl.ca.location"] = kafkaSslCACertFile              // CA certificate file for verifying the broker's certificate.
-		kafkaConfig["ssl.certificate.location"] = kafkaSslClientCertFile // Client's certificate
-		kafkaConfig["ssl.key.location"] = kafkaSslClientKeyFile          // Client's key
-		kafkaConfig["ssl.key.password"] = kafkaSslClientKeyPass          // Key password, if any.
+		go flushOCFFiles(ocf)
+		producer = ocf
+	} else {
+		newProducer := newProducerPool(kafkaProducers, producerDistribution == "topic", newKafkaProducer)
+		reloading, err = newReloadingProducer(kafkaClientConfig, func(config kafka.ConfigMap) (Producer, error) {
+			return newTopicProducer(config, produceOverrides, newProducer)
+		})
+		producer = reloading
 	}
 
-	if kafkaSaslMechanism != "" && kafkaSaslUsername != "" && kafkaSaslPassword != "" {
-		if kafkaSecurityProtocol != "sasl_ssl" && kafkaSecurityProtocol != "sasl_plaintext" {
-			logrus.Fatal("invalid config: kafka security protocol is not sasl based but sasl config is provided")
-		}
+	if err != nil {
+		logrus.WithError(err).Fatal("couldn't create kafka producer")
+	}
+	go reloadOnHangup(reloading)
 
-		kafkaConfig["security.protocol"] = kafkaSecurityProtocol
-		kafkaConfig["sasl.mechanism"] = kafkaSaslMechanism
-		kafkaConfig["sasl.username"] = kafkaSaslUsername
-		kafkaConfig["sasl.password"] = kafkaSaslPassword
+	if len(priorityRules) > 0 || queueFullPolicy == "drop-oldest" {
+		producer = newPriorityProducer(producer, priorityQueueSize, queueFullPolicy == "drop-oldest", priorityProduceTimeout)
 	}
 
-	producer, err := kafka.NewProducer(&kafkaConfig)
+	if selfTestEnabled {
+		logrus.WithField("topic", selfTestTopic).Info("running the self-test")
+		if err := selfTest(serializer, producer, selfTestTopic, selfTestTimeout); err != nil {
+			logrus.WithError(err).Fatal("self-test failed")
+		}
+	}
 
-	if err != nil {
-		logrus.WithError(err).Fatal("couldn't create kafka producer")
+	if aggregation != nil {
+		go flushAggregates(aggregation, producer, serializer)
 	}
 
 	r := gin.New()
@@ -74,14 +78,51 @@ func main() {
 
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	r.GET("/healthz", func(c *gin.Context) { c.JSON(200, gin.H{"status": "UP"}) })
+
+	var receive gin.IRoutes = r
 	if basicauth {
-		authorized := r.Group("/", gin.BasicAuth(gin.Accounts{
+		receive = r.Group("/", gin.BasicAuth(gin.Accounts{
 			basicauthUsername: basicauthPassword,
 		}))
-		authorized.POST("/receive", receiveHandler(producer, serializer))
-	} else {
-		r.POST("/receive", receiveHandler(producer, serializer))
+	}
+	receive.POST("/receive", receiveHandler(producer, serializer, ""))
+	receive.POST("/validate", validateHandler(serializer))
+	receive.GET("/config", configHandler())
+	for route, profile := range filterRoutes {
+		receive.POST(route, receiveHandler(producer, serializer, profile))
+	}
+
+	if heartbeatTopic != "" {
+		stopHeartbeat := startHeartbeat(producer, heartbeatTopic, adapterID, heartbeatInterval)
+		defer stopHeartbeat()
+	}
+
+	shutdown, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- r.Run() }()
+
+	select {
+	case err := <-serveErr:
+		logrus.Fatal(err)
+	case <-shutdown.Done():
+		logrus.Info("shutting down")
+	}
+
+	if f, ok := producer.(flusher); ok {
+		if remaining := f.Flush(int(shutdownFlushTimeout / time.Millisecond)); remaining > 0 {
+			logrus.WithField("messages", remaining).Warn("couldn't deliver all the messages before shutting down")
+		}
+	}
+}
+
+func newKafkaProducer(config *kafka.ConfigMap) (Producer, error) {
+	producer, err := kafka.NewProducer(config)
+	if err != nil {
+		return nil, err
 	}
 
-	logrus.Fatal(r.Run())
+	go handleDeliveryReports(producer.Events())
+	return producer, nil
 }
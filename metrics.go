@@ -37,16 +37,191 @@ var (
 			Name: "serialized_failed_total",
 			Help: "Count of all serialization failures",
 		})
+	serializeFallback = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "serialized_fallback_total",
+			Help: "Count of all objects written by the fallback serializer after failing serialization",
+		})
+	serializeDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "serialized_dropped_total",
+			Help: "Count of all objects dropped because the serialization format can't represent them",
+		})
 	objectsFiltered = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "objects_filtered_total",
 			Help: "Count of all filter attempts",
 		})
+	objectsOutOfWindow = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_out_of_window_total",
+			Help: "Count of all objects dropped for falling outside the time window",
+		})
+	objectsDeduplicated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_deduplicated_total",
+			Help: "Count of all objects dropped as duplicates of recently seen samples",
+		})
+	queueFullBlocked = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queue_full_blocked_total",
+			Help: "Count of all messages that waited for room in the full producer queue",
+		})
+	queueFullDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queue_full_dropped_total",
+			Help: "Count of all messages dropped because the producer queue was full",
+		})
+	queueFullDroppedOldest = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queue_full_dropped_oldest_total",
+			Help: "Count of all queued messages dropped to make room for newer ones in the full queue",
+		})
+	queueFullRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queue_full_rejected_total",
+			Help: "Count of all requests rejected because the producer queue was full",
+		})
+	partitionLabelInvalid = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "partition_label_invalid_total",
+			Help: "Count of all series whose partition label isn't a valid partition",
+		})
+	timestampLabelInvalid = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "timestamp_label_invalid_total",
+			Help: "Count of all series whose timestamp label isn't a valid timestamp",
+		})
+	labelValuesTooLong = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "label_values_too_long_total",
+			Help: "Count of all label values truncated or dropped for exceeding the max length",
+		})
+	staleTombstonesProduced = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stale_tombstones_produced_total",
+			Help: "Count of all tombstones produced for the staleness markers of stopped series",
+		})
+	seriesWithoutSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "series_without_samples_total",
+			Help: "Count of all series skipped for carrying no samples",
+		})
+	seriesSuffixDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "series_suffix_dropped_total",
+			Help: "Count of all series dropped for a metric name ending with one of the dropped suffixes",
+		})
+	seriesInvalidName = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "series_invalid_name_total",
+			Help: "Count of all series dropped or sanitized for a metric name not matching [a-zA-Z_:][a-zA-Z0-9_:]*",
+		})
+	seriesEmptyLabelDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "series_empty_label_dropped_total",
+			Help: "Count of all series dropped for having an empty required label",
+		})
+	objectsInfDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_inf_dropped_total",
+			Help: "Count of all objects dropped for having an infinite value",
+		})
+	objectsTooOld = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_too_old_total",
+			Help: "Count of all objects dropped for being older than the max sample age",
+		})
+	objectsTooNew = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_too_new_total",
+			Help: "Count of all objects dropped for being further in the future than the max future skew",
+		})
+	objectsClamped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_clamped_total",
+			Help: "Count of all objects whose timestamp was clamped to the sample age or future skew bounds",
+		})
+	objectsConflicting = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_conflicting_total",
+			Help: "Count of all objects dropped for sharing the series and timestamp of another sample of the request",
+		})
+	objectsCardinalityLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_cardinality_limited_total",
+			Help: "Count of all objects dropped for belonging to new series beyond the topic cardinality limit",
+		})
+	objectsRateLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_rate_limited_total",
+			Help: "Count of all objects dropped for exceeding the rate limit of their series",
+		})
+	objectsAggregationLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_aggregation_limited_total",
+			Help: "Count of all objects dropped for belonging to new series beyond the aggregation max series",
+		})
+	objectsSampleLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "objects_sample_limited_total",
+			Help: "Count of all objects dropped for exceeding the max samples per request",
+		})
+	requestsSampleLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_requests_sample_limited_total",
+			Help: "Count of all receive requests rejected for exceeding the max samples per request",
+		})
+	requestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of receive requests currently being handled",
+		})
+	requestsInFlightRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_requests_in_flight_rejected_total",
+			Help: "Count of all receive requests rejected for exceeding the max in flight requests",
+		})
+	ocfFilesWritten = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ocf_files_written_total",
+			Help: "Count of all Avro Object Container Files written to the blob store",
+		})
+	ocfFilesFailed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ocf_files_failed_total",
+			Help: "Count of all Avro Object Container Files that couldn't be written to the blob store",
+		})
+	lastProduceTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "last_successful_produce_timestamp_seconds",
+			Help: "Unix time of the last message successfully delivered to Kafka",
+		})
+	topicCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "topic_cache_size",
+			Help: "Number of series currently held in the topic cache",
+		})
+	topicCacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "topic_cache_evictions_total",
+			Help: "Count of all series evicted from the topic cache",
+		})
 	objectsWritten = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "objects_written_total",
 			Help: "Count of all objects written to Kafka",
 		})
+	topicMessagesProduced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "topic_messages_produced_total",
+			Help: "Count of all messages produced, by topic",
+		}, []string{"topic"})
+	topicBytesProduced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "topic_bytes_produced_total",
+			Help: "Count of all message value bytes produced, by topic",
+		}, []string{"topic"})
 	objectsFailed = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "objects_failed_total",
@@ -56,10 +231,45 @@ var (
 
 func init() {
 	prometheus.MustRegister(httpRequestsTotal)
+	prometheus.MustRegister(requestsInFlight)
+	prometheus.MustRegister(requestsInFlightRejected)
+	prometheus.MustRegister(requestsSampleLimited)
+	prometheus.MustRegister(objectsSampleLimited)
 	prometheus.MustRegister(promBatches)
 	prometheus.MustRegister(serializeTotal)
 	prometheus.MustRegister(serializeFailed)
+	prometheus.MustRegister(serializeFallback)
+	prometheus.MustRegister(serializeDropped)
 	prometheus.MustRegister(objectsFiltered)
+	prometheus.MustRegister(objectsOutOfWindow)
+	prometheus.MustRegister(objectsDeduplicated)
+	prometheus.MustRegister(objectsConflicting)
+	prometheus.MustRegister(objectsCardinalityLimited)
+	prometheus.MustRegister(objectsRateLimited)
+	prometheus.MustRegister(objectsAggregationLimited)
+	prometheus.MustRegister(objectsTooOld)
+	prometheus.MustRegister(objectsInfDropped)
+	prometheus.MustRegister(partitionLabelInvalid)
+	prometheus.MustRegister(timestampLabelInvalid)
+	prometheus.MustRegister(seriesEmptyLabelDropped)
+	prometheus.MustRegister(seriesSuffixDropped)
+	prometheus.MustRegister(seriesInvalidName)
+	prometheus.MustRegister(seriesWithoutSamples)
+	prometheus.MustRegister(staleTombstonesProduced)
+	prometheus.MustRegister(labelValuesTooLong)
+	prometheus.MustRegister(queueFullBlocked)
+	prometheus.MustRegister(queueFullDropped)
+	prometheus.MustRegister(queueFullDroppedOldest)
+	prometheus.MustRegister(queueFullRejected)
+	prometheus.MustRegister(objectsTooNew)
+	prometheus.MustRegister(objectsClamped)
 	prometheus.MustRegister(objectsFailed)
+	prometheus.MustRegister(topicCacheSize)
+	prometheus.MustRegister(topicCacheEvictions)
 	prometheus.MustRegister(objectsWritten)
+	prometheus.MustRegister(topicMessagesProduced)
+	prometheus.MustRegister(topicBytesProduced)
+	prometheus.MustRegister(lastProduceTimestamp)
+	prometheus.MustRegister(ocfFilesWritten)
+	prometheus.MustRegister(ocfFilesFailed)
 }
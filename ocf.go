@@ -0,0 +1,263 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/linkedin/goavro"
+	"github.com/sirupsen/logrus"
+)
+
+// ocfFlushInterval is how often the files older than the max age are
+// written.
+const ocfFlushInterval = time.Second
+
+// BlobStore stores the files written by the object store backends.
+type BlobStore interface {
+	Put(name string, data []byte) error
+}
+
+// dirBlobStore stores the files in a directory, e.g: a bucket mounted with
+// s3fs or gcsfuse. Files are written to a temporary name and renamed, so
+// readers never see partial files.
+type dirBlobStore struct {
+	dir string
+}
+
+func (s dirBlobStore) Put(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ocfFile holds the records of a topic waiting to be written, along with the
+// delivery reports of their messages.
+type ocfFile struct {
+	records []interface{}
+	reports []queuedMessage
+	bytes   int
+	created time.Time
+}
+
+// ocfProducer is an output backend writing the messages of each topic, as
+// Avro-JSON records, to Avro Object Container Files in a blob store instead
+// of producing them to kafka. A file is written once its records reach the
+// max bytes or it gets older than the max age. Delivery is reported once the
+// file holding the record is written, and the records of the files failing
+// to be written are kept to be written again.
+type ocfProducer struct {
+	mu       sync.Mutex
+	codec    *goavro.Codec
+	store    BlobStore
+	maxBytes int
+	maxAge   time.Duration
+	files    map[string]*ocfFile
+	sequence uint64
+}
+
+// newOCFProducer creates an OCF backend for the records of the serializer,
+// which has to be an Avro-JSON one.
+func newOCFProducer(s Serializer, store BlobStore, maxBytes int, maxAge time.Duration) (*ocfProducer, error) {
+	var codec *goavro.Codec
+	switch s := s.(type) {
+	case *AvroJSONSerializer:
+		codec = s.codec
+	case *AvroJSONSeriesSerializer:
+		codec = s.codec
+	default:
+		return nil, fmt.Errorf("the ocf output backend requires an avro-json serialization format, got %T", s)
+	}
+
+	return &ocfProducer{
+		codec:    codec,
+		store:    store,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		files:    make(map[string]*ocfFile),
+	}, nil
+}
+
+func (p *ocfProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	record, _, err := p.codec.NativeFromTextual(msg.Value)
+	if err != nil {
+		return fmt.Errorf("couldn't decode the avro record: %s", err)
+	}
+	topic := *msg.TopicPartition.Topic
+
+	p.mu.Lock()
+	f, ok := p.files[topic]
+	if !ok {
+		f = &ocfFile{created: time.Now()}
+		p.files[topic] = f
+	}
+	f.records = append(f.records, record)
+	if deliveryChan != nil {
+		f.reports = append(f.reports, queuedMessage{msg: msg, deliveryChan: deliveryChan})
+	}
+	f.bytes += len(msg.Value)
+	full := f.bytes >= p.maxBytes
+	if full {
+		delete(p.files, topic)
+	}
+	p.mu.Unlock()
+
+	if full {
+		if err := p.write(topic, f); err != nil {
+			// the records are kept, and written again by the next flush
+			logrus.WithError(err).Error("couldn't write the full ocf file")
+		}
+	}
+	return nil
+}
+
+// flushExpired writes the files created before now minus the max age.
+func (p *ocfProducer) flushExpired(now time.Time) error {
+	return p.flush(func(f *ocfFile) bool { return now.Sub(f.created) >= p.maxAge })
+}
+
+// Flush writes all the files, whatever their age, retrying the files failing
+// to be written up to the timeout. It returns the number of records still
+// buffered.
+func (p *ocfProducer) Flush(timeoutMs int) int {
+	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	for {
+		err := p.flush(func(*ocfFile) bool { return true })
+		if err == nil {
+			return 0
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			logrus.WithError(err).Error("couldn't write the ocf files")
+			return p.buffered()
+		}
+		if wait > ocfFlushInterval {
+			wait = ocfFlushInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// flush writes the files selected by expired, returning the first error.
+func (p *ocfProducer) flush(expired func(*ocfFile) bool) error {
+	p.mu.Lock()
+	files := make(map[string]*ocfFile)
+	for topic, f := range p.files {
+		if expired(f) {
+			files[topic] = f
+			delete(p.files, topic)
+		}
+	}
+	p.mu.Unlock()
+
+	var firstErr error
+	for topic, f := range files {
+		if err := p.write(topic, f); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// buffered returns the number of records not yet written.
+func (p *ocfProducer) buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	for _, f := range p.files {
+		count += len(f.records)
+	}
+	return count
+}
+
+// write encodes the records in an OCF file named after the topic, e.g:
+// metrics/1700000000000000000-1.avro, and puts it in the blob store,
+// reporting the delivery of its records. If the file can't be put, its
+// records are kept to be written again.
+func (p *ocfProducer) write(topic string, f *ocfFile) error {
+	var buf bytes.Buffer
+	w, err := goavro.NewOCFWriter(goavro.OCFConfig{W: &buf, Codec: p.codec})
+	if err != nil {
+		return err
+	}
+	if err := w.Append(f.records); err != nil {
+		// the records would fail again, they are dropped
+		ocfFilesFailed.Add(float64(1))
+		err = fmt.Errorf("couldn't encode the ocf file: %s", err)
+		f.report(err)
+		return err
+	}
+
+	p.mu.Lock()
+	p.sequence++
+	name := fmt.Sprintf("%s/%d-%d.avro", topic, f.created.UnixNano(), p.sequence)
+	p.mu.Unlock()
+
+	if err := p.store.Put(name, buf.Bytes()); err != nil {
+		ocfFilesFailed.Add(float64(1))
+		p.restore(topic, f)
+		return fmt.Errorf("couldn't write the ocf file %s: %s", name, err)
+	}
+	ocfFilesWritten.Add(float64(1))
+	f.report(nil)
+	return nil
+}
+
+// restore puts back the records of a file failing to be written, ahead of
+// those buffered for the topic meanwhile.
+func (p *ocfProducer) restore(topic string, f *ocfFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if current, ok := p.files[topic]; ok {
+		f.records = append(f.records, current.records...)
+		f.reports = append(f.reports, current.reports...)
+		f.bytes += current.bytes
+	}
+	p.files[topic] = f
+}
+
+// report reports the delivery of the records of the file, failed if err
+// isn't nil.
+func (f *ocfFile) report(err error) {
+	for _, queued := range f.reports {
+		report := *queued.msg
+		report.TopicPartition.Error = err
+		queued.deliveryChan <- &report
+	}
+}
+
+// flushOCFFiles periodically writes the files older than the max age, until
+// the process exits.
+func flushOCFFiles(p *ocfProducer) {
+	for now := range time.Tick(ocfFlushInterval) {
+		if err := p.flushExpired(now); err != nil {
+			logrus.WithError(err).Error("couldn't flush the ocf files")
+		}
+	}
+}
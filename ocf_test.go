@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/linkedin/goavro"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBlobStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	err   error
+}
+
+func (s *fakeBlobStore) Put(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.files == nil {
+		s.files = make(map[string][]byte)
+	}
+	s.files[name] = data
+	return nil
+}
+
+func (s *fakeBlobStore) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readOCF(t *testing.T, data []byte) []map[string]interface{} {
+	r, err := goavro.NewOCFReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	var records []map[string]interface{}
+	for r.Scan() {
+		record, err := r.Read()
+		assert.Nil(t, err)
+		records = append(records, record.(map[string]interface{}))
+	}
+	assert.Nil(t, r.Err())
+	return records
+}
+
+func produceSerialized(t *testing.T, producer Producer, serializer Serializer) {
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	for topic, msgs := range output {
+		topic := topic
+		for _, msg := range msgs {
+			err := producer.Produce(&kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &topic},
+				Value:          msg.Value,
+			}, nil)
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestOCFProducerMaxBytes(t *testing.T) {
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	store := &fakeBlobStore{}
+	p, err := newOCFProducer(serializer, store, 1, time.Hour)
+	assert.Nil(t, err)
+
+	produceSerialized(t, p, serializer)
+
+	names := store.names()
+	assert.Len(t, names, 2, "each record should fill a file")
+	for _, name := range names {
+		assert.Regexp(t, `^[^/]+/\d+-\d+\.avro$`, name)
+		records := readOCF(t, store.files[name])
+		assert.Len(t, records, 1)
+		assert.Equal(t, "foo", records[0]["name"])
+	}
+}
+
+func TestOCFProducerMaxAge(t *testing.T) {
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	store := &fakeBlobStore{}
+	p, err := newOCFProducer(serializer, store, 1<<20, time.Minute)
+	assert.Nil(t, err)
+
+	produceSerialized(t, p, serializer)
+	assert.Nil(t, p.flushExpired(time.Now()))
+	assert.Empty(t, store.names(), "files younger than the max age should be kept")
+
+	assert.Nil(t, p.flushExpired(time.Now().Add(time.Minute)))
+	names := store.names()
+	assert.Len(t, names, 1)
+	records := readOCF(t, store.files[names[0]])
+	assert.Len(t, records, 2, "the records of a topic should be written in a single file")
+	assert.Equal(t, "456", records[0]["value"])
+}
+
+func TestOCFProducerStoreFailure(t *testing.T) {
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	store := &fakeBlobStore{err: errors.New("bucket unavailable")}
+	p, err := newOCFProducer(serializer, store, 1, time.Hour)
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	deliveryChan := make(chan kafka.Event, 2)
+	for topic, msgs := range output {
+		topic := topic
+		for _, msg := range msgs {
+			err := p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: msg.Value}, deliveryChan)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Empty(t, deliveryChan, "delivery shouldn't be reported before the records are written")
+	assert.Equal(t, 2, p.buffered(), "the records of the failed files should be kept")
+
+	assert.NotNil(t, p.flushExpired(time.Now().Add(time.Hour)))
+	assert.Equal(t, 2, p.buffered())
+
+	store.mu.Lock()
+	store.err = nil
+	store.mu.Unlock()
+	assert.Nil(t, p.flushExpired(time.Now().Add(time.Hour)))
+	names := store.names()
+	assert.Len(t, names, 1)
+	assert.Len(t, readOCF(t, store.files[names[0]]), 2, "the kept records should be written")
+	for i := 0; i < 2; i++ {
+		report := (<-deliveryChan).(*kafka.Message)
+		assert.Nil(t, report.TopicPartition.Error)
+	}
+}
+
+func TestOCFProducerFlushOnShutdown(t *testing.T) {
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	store := &fakeBlobStore{}
+	p, err := newOCFProducer(serializer, store, 1<<20, time.Hour)
+	assert.Nil(t, err)
+
+	produceSerialized(t, p, serializer)
+	assert.Empty(t, store.names())
+
+	var f flusher = p
+	assert.Equal(t, 0, f.Flush(1000))
+	assert.Len(t, store.names(), 1, "files younger than the max age should be written on shutdown")
+	assert.Equal(t, 0, p.buffered())
+
+	store.err = errors.New("bucket unavailable")
+	produceSerialized(t, p, serializer)
+	assert.Equal(t, 2, f.Flush(0), "the records that couldn't be written should be reported")
+}
+
+func TestNewOCFProducerRequiresAvro(t *testing.T) {
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	_, err = newOCFProducer(serializer, &fakeBlobStore{}, 1, time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestDirBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocf")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := dirBlobStore{dir: dir}
+	assert.Nil(t, store.Put("metrics/1-1.avro", []byte("data")))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "metrics", "1-1.avro"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+	_, err = os.Stat(filepath.Join(dir, "metrics", "1-1.avro.tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
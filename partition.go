@@ -0,0 +1,269 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// partitionRange represents an inclusive range of kafka partitions
+type partitionRange struct {
+	first int32
+	last  int32
+}
+
+// parsePartitionRange parses a single partition ("3") or an inclusive range
+// of partitions ("0-3").
+func parsePartitionRange(text string) (partitionRange, error) {
+	bounds := strings.SplitN(strings.TrimSpace(text), "-", 2)
+
+	first, err := strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 32)
+	if err != nil {
+		return partitionRange{}, fmt.Errorf("invalid partition range %q: %s", text, err)
+	}
+	last := first
+	if len(bounds) == 2 {
+		last, err = strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 32)
+		if err != nil {
+			return partitionRange{}, fmt.Errorf("invalid partition range %q: %s", text, err)
+		}
+	}
+
+	if first < 0 || last < first {
+		return partitionRange{}, fmt.Errorf("invalid partition range %q", text)
+	}
+	return partitionRange{first: int32(first), last: int32(last)}, nil
+}
+
+// pick returns the partition of the range the hash falls into.
+func (r partitionRange) pick(hash uint64) int32 {
+	size := uint64(r.last-r.first) + 1
+	return r.first + int32(hash%size)
+}
+
+// Partitioner selects the partition a series is produced to, given its topic,
+// labels and fingerprint. kafka.PartitionAny leaves the choice to the kafka
+// default partitioner.
+type Partitioner interface {
+	Partition(topic string, labels map[string]string, fp uint64) int32
+}
+
+// partitionerName returns the name of the partitioner in use: the given one
+// or, without a name, tenant if PARTITION_TENANT_LABEL is set, then topic if
+// PARTITION_TOPIC_RANGE is set, and default otherwise.
+func partitionerName(name string, getenv func(string) string) string {
+	if name != "" {
+		return name
+	}
+	switch {
+	case getenv("PARTITION_TENANT_LABEL") != "":
+		return "tenant"
+	case getenv("PARTITION_TOPIC_RANGE") != "":
+		return "topic"
+	default:
+		return "default"
+	}
+}
+
+// newPartitioner returns the partitioner with the given name, configured by
+// the variables looked up with getenv. Without a name, the one picked by
+// partitionerName is used.
+func newPartitioner(name string, getenv func(string) string) (Partitioner, error) {
+	switch partitionerName(name, getenv) {
+	case "default":
+		return defaultPartitioner{}, nil
+	case "round-robin", "series":
+		if getenv("PARTITION_RANGE") == "" {
+			return nil, fmt.Errorf("the %s partitioner requires PARTITION_RANGE", name)
+		}
+		r, err := parsePartitionRange(getenv("PARTITION_RANGE"))
+		if err != nil {
+			return nil, err
+		}
+		if name == "series" {
+			return seriesPartitioner{partitions: r}, nil
+		}
+		return &roundRobinPartitioner{partitions: r}, nil
+	case "tenant":
+		if getenv("PARTITION_TENANT_LABEL") == "" {
+			return nil, fmt.Errorf("the tenant partitioner requires PARTITION_TENANT_LABEL")
+		}
+		return parseTenantPartitioner(getenv("PARTITION_TENANT_LABEL"), getenv("PARTITION_TENANT_MAPPING"), getenv("PARTITION_TENANT_RANGE"))
+	case "topic":
+		if getenv("PARTITION_TOPIC_RANGE") == "" {
+			return nil, fmt.Errorf("the topic partitioner requires PARTITION_TOPIC_RANGE")
+		}
+		r, err := parsePartitionRange(getenv("PARTITION_TOPIC_RANGE"))
+		if err != nil {
+			return nil, err
+		}
+		return topicPartitioner{partitions: r}, nil
+	default:
+		return nil, fmt.Errorf("unknown partitioner %q", name)
+	}
+}
+
+// defaultPartitioner leaves the partition to the kafka default partitioner.
+type defaultPartitioner struct{}
+
+func (defaultPartitioner) Partition(topic string, labels map[string]string, fp uint64) int32 {
+	return kafka.PartitionAny
+}
+
+// roundRobinPartitioner cycles through a range of partitions, one series at a
+// time, evening out the partitions at the cost of the order within a series.
+type roundRobinPartitioner struct {
+	partitions partitionRange
+	next       uint64
+}
+
+func (p *roundRobinPartitioner) Partition(topic string, labels map[string]string, fp uint64) int32 {
+	return p.partitions.pick(atomic.AddUint64(&p.next, 1) - 1)
+}
+
+// seriesPartitioner spreads the series across a range of partitions by
+// fingerprint, keeping all the samples of a series in the same partition.
+type seriesPartitioner struct {
+	partitions partitionRange
+}
+
+func (p seriesPartitioner) Partition(topic string, labels map[string]string, fp uint64) int32 {
+	return p.partitions.pick(fp)
+}
+
+// topicPartitioner hashes the topic to a partition of a range, so the series
+// sharing a topic template output, e.g: a hash bucket, are produced to the
+// same partition. The hash doesn't depend on the process, keeping the (topic,
+// partition) of a series across restarts.
+type topicPartitioner struct {
+	partitions partitionRange
+}
+
+func (p topicPartitioner) Partition(topic string, labels map[string]string, fp uint64) int32 {
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	return p.partitions.pick(h.Sum64())
+}
+
+// tenantPartitioner pins the series of each tenant, identified by a label, to
+// a range of partitions.
+type tenantPartitioner struct {
+	label    string
+	mapping  map[string]partitionRange
+	fallback *partitionRange
+}
+
+// Partition returns the partition for the series with the given labels and
+// fingerprint. Series of mapped tenants are spread by fingerprint across the
+// tenant partitions, keeping the order within each series, while unmapped
+// tenants are hashed to a single partition of the fallback range.
+func (p *tenantPartitioner) Partition(topic string, labels map[string]string, fp uint64) int32 {
+	tenant := labels[p.label]
+
+	if r, ok := p.mapping[tenant]; ok {
+		return r.pick(fp)
+	}
+
+	if p.fallback == nil {
+		return kafka.PartitionAny
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(tenant))
+	return p.fallback.pick(h.Sum64())
+}
+
+func parseTenantPartitioner(label, mapping, fallback string) (*tenantPartitioner, error) {
+	p := &tenantPartitioner{
+		label:   label,
+		mapping: make(map[string]partitionRange),
+	}
+
+	if mapping != "" {
+		var ranges map[string]string
+		if err := yaml.Unmarshal([]byte(mapping), &ranges); err != nil {
+			return nil, err
+		}
+		for tenant, text := range ranges {
+			r, err := parsePartitionRange(text)
+			if err != nil {
+				return nil, err
+			}
+			p.mapping[tenant] = r
+		}
+	}
+
+	if fallback != "" {
+		r, err := parsePartitionRange(fallback)
+		if err != nil {
+			return nil, err
+		}
+		p.fallback = &r
+	}
+
+	return p, nil
+}
+
+// labelPartitioner forces the partition given by the integer value of a
+// label of the series, the PARTITION_LABEL, leaving the series without it or
+// with an invalid value to the inner partitioner.
+type labelPartitioner struct {
+	label string
+	inner Partitioner
+}
+
+func (p labelPartitioner) Partition(topic string, labels map[string]string, fp uint64) int32 {
+	value, ok := labels[p.label]
+	if !ok {
+		return p.inner.Partition(topic, labels, fp)
+	}
+
+	partition, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || partition < 0 {
+		partitionLabelInvalid.Add(float64(1))
+		logrus.WithField("partition", value).Debugln("invalid partition label value, using the partitioner")
+		return p.inner.Partition(topic, labels, fp)
+	}
+	return int32(partition)
+}
+
+// stripPartitionLabel removes the PARTITION_LABEL label from the labels of
+// the series, returning the labels the partitioner is given, which keep it.
+func stripPartitionLabel(labels map[string]string) map[string]string {
+	if partitionLabel == "" {
+		return labels
+	}
+
+	value, ok := labels[partitionLabel]
+	if !ok {
+		return labels
+	}
+	delete(labels, partitionLabel)
+
+	partitionLabels := make(map[string]string, len(labels)+1)
+	for name, v := range labels {
+		partitionLabels[name] = v
+	}
+	partitionLabels[partitionLabel] = value
+	return partitionLabels
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePartitionRange(t *testing.T) {
+	r, err := parsePartitionRange("2-5")
+	assert.Nil(t, err)
+	assert.Equal(t, partitionRange{first: 2, last: 5}, r)
+
+	r, err = parsePartitionRange("7")
+	assert.Nil(t, err)
+	assert.Equal(t, partitionRange{first: 7, last: 7}, r)
+
+	for _, invalid := range []string{"", "a", "5-2", "-1", "1-b"} {
+		_, err = parsePartitionRange(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestNewPartitioner(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+
+	p, err := newPartitioner("", env(nil))
+	assert.Nil(t, err)
+	assert.IsType(t, defaultPartitioner{}, p)
+
+	p, err = newPartitioner("", env(map[string]string{"PARTITION_TOPIC_RANGE": "0-3"}))
+	assert.Nil(t, err)
+	assert.IsType(t, topicPartitioner{}, p)
+
+	p, err = newPartitioner("", env(map[string]string{"PARTITION_TENANT_LABEL": "tenant", "PARTITION_TOPIC_RANGE": "0-3"}))
+	assert.Nil(t, err)
+	assert.IsType(t, &tenantPartitioner{}, p, "the tenant partitions should take precedence")
+
+	p, err = newPartitioner("series", env(map[string]string{"PARTITION_RANGE": "0-3"}))
+	assert.Nil(t, err)
+	assert.IsType(t, seriesPartitioner{}, p)
+
+	p, err = newPartitioner("round-robin", env(map[string]string{"PARTITION_RANGE": "0-3"}))
+	assert.Nil(t, err)
+	assert.IsType(t, &roundRobinPartitioner{}, p)
+
+	for _, name := range []string{"series", "round-robin", "tenant", "topic", "unknown"} {
+		_, err = newPartitioner(name, env(nil))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestDefaultPartitioner(t *testing.T) {
+	var p Partitioner = defaultPartitioner{}
+	assert.Equal(t, kafka.PartitionAny, p.Partition("metrics", map[string]string{"instance": "1"}, 1))
+}
+
+func TestRoundRobinPartitioner(t *testing.T) {
+	var p Partitioner = &roundRobinPartitioner{partitions: partitionRange{first: 2, last: 4}}
+
+	var partitions []int32
+	for i := 0; i < 6; i++ {
+		partitions = append(partitions, p.Partition("metrics", map[string]string{"instance": "1"}, 1))
+	}
+	assert.Equal(t, []int32{2, 3, 4, 2, 3, 4}, partitions)
+}
+
+func TestSeriesPartitioner(t *testing.T) {
+	var p Partitioner = seriesPartitioner{partitions: partitionRange{first: 0, last: 7}}
+
+	partitions := make(map[int32]bool)
+	for i := 0; i < 100; i++ {
+		labels := map[string]string{"instance": fmt.Sprint(i)}
+		partition := p.Partition("metrics", labels, fingerprint(labels))
+		assert.True(t, partition >= 0 && partition <= 7)
+		assert.Equal(t, partition, p.Partition("other", labels, fingerprint(labels)), "a series should stay in its partition")
+		partitions[partition] = true
+	}
+	assert.True(t, len(partitions) > 1, "series should be spread across the partitions")
+}
+
+func TestTopicPartitioner(t *testing.T) {
+	var p Partitioner = topicPartitioner{partitions: partitionRange{first: 0, last: 11}}
+
+	// fnv-64a of "metrics.label-bar" modulo 12
+	assert.Equal(t, int32(6), p.Partition("metrics.label-bar", map[string]string{"instance": "1"}, 1))
+	assert.Equal(t, int32(6), p.Partition("metrics.label-bar", map[string]string{"instance": "2"}, 2))
+}
+
+func TestTenantPartitionerDisjoint(t *testing.T) {
+	p, err := parseTenantPartitioner("tenant", `{a: "0-3", b: "4-7"}`, "")
+	assert.Nil(t, err)
+
+	partitionsA := make(map[int32]bool)
+	partitionsB := make(map[int32]bool)
+	for i := 0; i < 100; i++ {
+		labelsA := map[string]string{"tenant": "a", "instance": fmt.Sprint(i)}
+		labelsB := map[string]string{"tenant": "b", "instance": fmt.Sprint(i)}
+		partitionsA[p.Partition("", labelsA, fingerprint(labelsA))] = true
+		partitionsB[p.Partition("", labelsB, fingerprint(labelsB))] = true
+	}
+
+	for partition := range partitionsA {
+		assert.True(t, partition >= 0 && partition <= 3)
+		assert.False(t, partitionsB[partition], "tenants should not share partitions")
+	}
+	for partition := range partitionsB {
+		assert.True(t, partition >= 4 && partition <= 7)
+	}
+}
+
+func TestTenantPartitionerFallback(t *testing.T) {
+	p, err := parseTenantPartitioner("tenant", `{a: "0-3"}`, "")
+	assert.Nil(t, err)
+	assert.Equal(t, kafka.PartitionAny, p.Partition("", map[string]string{"tenant": "c"}, 0))
+
+	p, err = parseTenantPartitioner("tenant", `{a: "0-3"}`, "8-15")
+	assert.Nil(t, err)
+	first := p.Partition("", map[string]string{"tenant": "c", "instance": "1"}, 1)
+	assert.True(t, first >= 8 && first <= 15)
+	assert.Equal(t, first, p.Partition("", map[string]string{"tenant": "c", "instance": "2"}, 2), "unmapped tenant should be hashed to a single partition")
+}
+
+func TestSerializeTenantPartition(t *testing.T) {
+	partitioner, _ = parseTenantPartitioner("labelfoo", `{label-bar: "3"}`, "")
+	defer func() { partitioner = defaultPartitioner{} }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.Equal(t, int32(3), msg.Partition)
+		}
+	}
+}
+
+func TestSerializeLabelPartition(t *testing.T) {
+	partitionLabel = "__kafka_partition__"
+	partitioner = labelPartitioner{label: partitionLabel, inner: defaultPartitioner{}}
+	defer func() { partitionLabel, partitioner = "", defaultPartitioner{} }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	for value, expected := range map[string]int32{"5": 5, "abc": kafka.PartitionAny} {
+		req := NewWriteRequest()
+		req.Timeseries[0].Labels = append(req.Timeseries[0].Labels, &prompb.Label{Name: "__kafka_partition__", Value: value})
+
+		output, err := SerializeMessages(serializer, req)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, countMessages(output))
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				assert.Equal(t, expected, msg.Partition)
+				assert.NotContains(t, string(msg.Value), "__kafka_partition__", "partition label should be stripped")
+			}
+		}
+	}
+}
+
+func TestLabelPartitioner(t *testing.T) {
+	p := labelPartitioner{label: "__kafka_partition__", inner: seriesPartitioner{partitions: partitionRange{first: 8, last: 8}}}
+
+	assert.Equal(t, int32(5), p.Partition("", map[string]string{"__kafka_partition__": "5"}, 1))
+	assert.Equal(t, int32(8), p.Partition("", map[string]string{"__kafka_partition__": "-1"}, 1), "invalid values should be left to the inner partitioner")
+	assert.Equal(t, int32(8), p.Partition("", map[string]string{}, 1))
+}
+
+func TestSerializeBatchLabelPartition(t *testing.T) {
+	partitionLabel = "__kafka_partition__"
+	partitioner = labelPartitioner{label: partitionLabel, inner: defaultPartitioner{}}
+	defer func() { partitionLabel, partitioner = "", defaultPartitioner{} }()
+
+	serializer, err := NewJSONArraySerializer()
+	assert.Nil(t, err)
+
+	req := NewWriteRequest()
+	req.Timeseries[0].Labels = append(req.Timeseries[0].Labels, &prompb.Label{Name: "__kafka_partition__", Value: "5"})
+	output, err := SerializeMessages(serializer, req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output))
+	for _, msgs := range output {
+		assert.Equal(t, int32(5), msgs[0].Partition)
+		assert.NotContains(t, string(msgs[0].Value), "__kafka_partition__")
+	}
+}
+
+func TestSerializeTopicPartition(t *testing.T) {
+	r, err := parsePartitionRange("0-11")
+	assert.Nil(t, err)
+	partitioner = topicPartitioner{partitions: r}
+	defer func() { partitioner = defaultPartitioner{} }()
+
+	tpl, err := parseTopicTemplate(`metrics.{{ index . "labelfoo" }}`)
+	assert.Nil(t, err)
+	previous := defaultSerializeConfig()
+	setRules(previous.match, tpl)
+	defer setRules(previous.match, previous.topicTemplate)
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		output, err := SerializeMessages(serializer, NewWriteRequest())
+		assert.Nil(t, err)
+		assert.Equal(t, 2, countMessages(output))
+		for topic, msgs := range output {
+			assert.Equal(t, "metrics.label-bar", topic)
+			for _, msg := range msgs {
+				// fnv-64a of "metrics.label-bar" modulo 12, stable across restarts
+				assert.Equal(t, int32(6), msg.Partition)
+			}
+		}
+	}
+}
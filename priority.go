@@ -0,0 +1,162 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// producePriority marks the high priority messages in their Opaque field,
+// which librdkafka hands back untouched in the delivery reports.
+type producePriority int
+
+const highPriority producePriority = 1
+
+// queuedMessage is a message waiting in a priority queue along with the
+// channel its delivery is reported to.
+type queuedMessage struct {
+	msg          *kafka.Message
+	deliveryChan chan kafka.Event
+}
+
+// priorityProducer queues the messages in a high and a low priority queue
+// in front of the producer, always draining the high priority queue first,
+// so the high priority messages aren't starved behind the low priority ones
+// while the producer is backed up.
+type priorityProducer struct {
+	producer Producer
+	high     chan queuedMessage
+	low      chan queuedMessage
+	pending  int64 // messages queued and not yet handed to the producer
+	// dropOldest makes room in a full queue by dropping its oldest message
+	dropOldest bool
+	// timeout bounds the wait for room in the producer queue
+	timeout time.Duration
+}
+
+// newPriorityProducer creates a priority producer in front of the producer,
+// each queue holding up to size messages, and starts draining them. A queued
+// message the producer has no room for after the timeout fails.
+func newPriorityProducer(producer Producer, size int, dropOldest bool, timeout time.Duration) *priorityProducer {
+	p := &priorityProducer{
+		producer:   producer,
+		high:       make(chan queuedMessage, size),
+		low:        make(chan queuedMessage, size),
+		dropOldest: dropOldest,
+		timeout:    timeout,
+	}
+	go p.drain()
+	return p
+}
+
+// errDroppedOldest is reported for the messages dropped from a full queue to
+// make room for newer ones.
+var errDroppedOldest = kafka.NewError(kafka.ErrQueueFull, "dropped as the oldest message of the full queue", false)
+
+// Produce queues the message by priority. When its queue is full, the oldest
+// message of the queue is dropped with dropOldest, otherwise it fails with a
+// queue full error, handled by the QUEUE_FULL_POLICY.
+func (p *priorityProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	queue := p.low
+	if msg.Opaque == highPriority {
+		queue = p.high
+	}
+
+	atomic.AddInt64(&p.pending, 1)
+	for {
+		select {
+		case queue <- queuedMessage{msg: msg, deliveryChan: deliveryChan}:
+			return nil
+		default:
+		}
+		if !p.dropOldest {
+			atomic.AddInt64(&p.pending, -1)
+			return kafka.NewError(kafka.ErrQueueFull, "priority queue is full", false)
+		}
+
+		// the queue may have been drained meanwhile, then there is room
+		select {
+		case oldest := <-queue:
+			atomic.AddInt64(&p.pending, -1)
+			queueFullDroppedOldest.Add(float64(1))
+			if oldest.deliveryChan != nil {
+				oldest.msg.TopicPartition.Error = errDroppedOldest
+				oldest.deliveryChan <- oldest.msg
+			}
+		default:
+		}
+	}
+}
+
+func (p *priorityProducer) drain() {
+	for {
+		var queued queuedMessage
+		select {
+		case queued = <-p.high:
+		default:
+			select {
+			case queued = <-p.high:
+			case queued = <-p.low:
+			}
+		}
+		p.produce(queued)
+		atomic.AddInt64(&p.pending, -1)
+	}
+}
+
+// produce hands the message to the producer, waiting up to the timeout for
+// room in its queue. Failures are reported to the delivery channel, if any,
+// as the message was already accepted.
+func (p *priorityProducer) produce(queued queuedMessage) {
+	deadline := time.Now().Add(p.timeout)
+	err := p.producer.Produce(queued.msg, queued.deliveryChan)
+	for isQueueFull(err) && time.Now().Before(deadline) {
+		time.Sleep(queueFullRetryInterval)
+		err = p.producer.Produce(queued.msg, queued.deliveryChan)
+	}
+	if err == nil {
+		return
+	}
+
+	objectsFailed.Add(float64(1))
+	logrus.WithError(err).Errorf("couldn't produce queued message in kafka topic %v", *queued.msg.TopicPartition.Topic)
+	if queued.deliveryChan != nil {
+		queued.msg.TopicPartition.Error = err
+		queued.deliveryChan <- queued.msg
+	}
+}
+
+// Flush waits for the queued messages to be handed to the producer and then
+// for the producer to deliver them, up to the timeout, returning the number
+// of messages still buffered.
+func (p *priorityProducer) Flush(timeoutMs int) int {
+	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	for atomic.LoadInt64(&p.pending) > 0 {
+		if !time.Now().Before(deadline) {
+			return int(atomic.LoadInt64(&p.pending))
+		}
+		time.Sleep(queueFullRetryInterval)
+	}
+
+	remaining := int(time.Until(deadline) / time.Millisecond)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return flushAll([]Producer{p.producer}, remaining)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityProducerDrainsHighFirst(t *testing.T) {
+	// the producer is backed up until released
+	constrained := &fakeProducer{full: 1 << 30}
+	p := newPriorityProducer(constrained, 10, false, time.Minute)
+
+	topic := "metrics"
+	for _, value := range []string{"low-1", "low-2", "low-3", "high-1", "high-2", "high-3"} {
+		msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte(value)}
+		if value[:4] == "high" {
+			msg.Opaque = highPriority
+		}
+		assert.Nil(t, p.Produce(msg, nil))
+	}
+
+	constrained.mu.Lock()
+	constrained.full = 0
+	constrained.mu.Unlock()
+	assert.Equal(t, 0, p.Flush(5000))
+
+	var order []string
+	for _, msg := range constrained.messages {
+		order = append(order, string(msg.Value))
+	}
+	assert.Len(t, order, 6)
+	// the first low priority message may already be waiting for the
+	// producer when the high priority ones are queued
+	if order[0] == "low-1" {
+		order = order[1:]
+	}
+	assert.Equal(t, []string{"high-1", "high-2", "high-3"}, order[:3])
+}
+
+func TestPriorityProducerQueueFull(t *testing.T) {
+	constrained := &fakeProducer{full: 1 << 30}
+	p := newPriorityProducer(constrained, 1, false, time.Minute)
+	defer func() {
+		constrained.mu.Lock()
+		constrained.full = 0
+		constrained.mu.Unlock()
+	}()
+
+	topic := "metrics"
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}, nil)
+	}
+	assert.True(t, isQueueFull(err))
+
+	// the high priority queue is separate
+	assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Opaque: highPriority}, nil))
+}
+
+func TestSerializePriority(t *testing.T) {
+	rules, err := parseMatchList(`['slo_errors']`)
+	assert.Nil(t, err)
+	priorityRules = rules
+	defer func() { priorityRules = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	tpl, err := parseTopicTemplate(`{{ index . "__name__" }}`)
+	assert.Nil(t, err)
+
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			{Labels: []*prompb.Label{{Name: "__name__", Value: "slo_errors"}}, Samples: []prompb.Sample{{Value: 1}}},
+			{Labels: []*prompb.Label{{Name: "__name__", Value: "bulk"}}, Samples: []prompb.Sample{{Value: 1}}},
+		},
+	}
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: tpl})
+	assert.Nil(t, err)
+	assert.True(t, output["slo_errors"][0].HighPriority)
+	assert.False(t, output["bulk"][0].HighPriority)
+}
+
+func TestProduceAggregatesPriority(t *testing.T) {
+	rules, err := parseMatchList(`['slo_errors']`)
+	assert.Nil(t, err)
+	priorityRules = rules
+	defer func() { priorityRules = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	producer := &fakeProducer{}
+	produceAggregates([]*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "slo_errors"}}, Samples: []prompb.Sample{{Value: 1}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "bulk"}}, Samples: []prompb.Sample{{Value: 1}}},
+	}, producer, serializer)
+
+	priorities := make(map[string]interface{})
+	for _, msg := range producer.messages {
+		var metric map[string]interface{}
+		assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+		priorities[metric["name"].(string)] = msg.Opaque
+	}
+	assert.Equal(t, map[string]interface{}{"slo_errors": highPriority, "bulk": nil}, priorities)
+}
+
+func TestPriorityProducerDropOldest(t *testing.T) {
+	// the queue isn't drained, so it stays full
+	p := &priorityProducer{
+		producer:   &fakeProducer{},
+		high:       make(chan queuedMessage, 2),
+		low:        make(chan queuedMessage, 2),
+		dropOldest: true,
+	}
+	before := &dto.Metric{}
+	queueFullDroppedOldest.Write(before)
+
+	topic := "metrics"
+	deliveryChan := make(chan kafka.Event, 3)
+	for _, value := range []string{"1", "2", "3"} {
+		msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte(value)}
+		assert.Nil(t, p.Produce(msg, deliveryChan))
+	}
+
+	var queued []string
+	for len(p.low) > 0 {
+		queued = append(queued, string((<-p.low).msg.Value))
+	}
+	assert.Equal(t, []string{"2", "3"}, queued)
+
+	report := (<-deliveryChan).(*kafka.Message)
+	assert.Equal(t, "1", string(report.Value))
+	assert.Equal(t, errDroppedOldest, report.TopicPartition.Error)
+
+	after := &dto.Metric{}
+	queueFullDroppedOldest.Write(after)
+	assert.Equal(t, float64(1), after.GetCounter().GetValue()-before.GetCounter().GetValue())
+}
+
+func TestPriorityProducerTimeout(t *testing.T) {
+	// the producer never has room
+	p := newPriorityProducer(&fakeProducer{full: 1 << 30}, 1, false, 50*time.Millisecond)
+	before := &dto.Metric{}
+	objectsFailed.Write(before)
+
+	topic := "metrics"
+	deliveryChan := make(chan kafka.Event, 1)
+	assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}, deliveryChan))
+
+	select {
+	case e := <-deliveryChan:
+		assert.True(t, isQueueFull(e.(*kafka.Message).TopicPartition.Error))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued message wasn't failed after the timeout")
+	}
+	assert.Equal(t, 0, p.Flush(5000))
+
+	after := &dto.Metric{}
+	objectsFailed.Write(after)
+	assert.Equal(t, float64(1), after.GetCounter().GetValue()-before.GetCounter().GetValue())
+}
@@ -0,0 +1,326 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gopkg.in/yaml.v2"
+)
+
+// producerConfig returns the base kafka producer config, with the producer
+// tuning settings that are set.
+func producerConfig() kafka.ConfigMap {
+	config := kafka.ConfigMap{
+		"bootstrap.servers":   kafkaBrokerList,
+		"compression.codec":   kafkaCompression,
+		"batch.num.messages":  kafkaBatchNumMessages,
+		"go.batch.producer":   true, // Enable batch producer (for increased performance).
+		"go.delivery.reports": true, // per-message delivery reports to the Events() channel
+	}
+
+	if kafkaMaxInFlight > 0 {
+		config["max.in.flight.requests.per.connection"] = kafkaMaxInFlight
+	}
+	switch produceOrdering {
+	case "per-partition":
+		// the idempotent producer keeps the order of each partition across
+		// retries, with up to 5 requests in flight
+		config["enable.idempotence"] = true
+		if kafkaMaxInFlight == 0 {
+			config["max.in.flight.requests.per.connection"] = 5
+		}
+	case "strict":
+		config["enable.idempotence"] = true
+		config["max.in.flight.requests.per.connection"] = 1
+	}
+	if kafkaQueueMaxMessages > 0 {
+		config["queue.buffering.max.messages"] = kafkaQueueMaxMessages
+	}
+	if kafkaQueueMaxKbytes > 0 {
+		config["queue.buffering.max.kbytes"] = kafkaQueueMaxKbytes
+	}
+	if kafkaLingerMs >= 0 {
+		config["linger.ms"] = kafkaLingerMs
+	}
+	if kafkaClientID != "" {
+		config["client.id"] = kafkaClientID
+	}
+	if kafkaMetadataRefreshMs > 0 {
+		config["topic.metadata.refresh.interval.ms"] = kafkaMetadataRefreshMs
+	}
+	return config
+}
+
+// kafkaClientConfig returns the kafka producer config with the SSL and SASL
+// credentials, reading the SASL password from KAFKA_SASL_PASSWORD_FILE if
+// set, so rotated credentials are picked up by a new producer.
+func kafkaClientConfig() (kafka.ConfigMap, error) {
+	config := producerConfig()
+	protocol := kafkaSecurityProtocol
+
+	if kafkaSslClientCertFile != "" && kafkaSslClientKeyFile != "" && kafkaSslCACertFile != "" {
+		if protocol == "" {
+			protocol = "ssl"
+		}
+
+		if protocol != "ssl" && protocol != "sasl_ssl" {
+			return nil, errors.New("invalid config: kafka security protocol is not ssl based but ssl config is provided")
+		}
+
+		config["security.protocol"] = protocol
+		config["ssl.ca.location"] = kafkaSslCACertFile              // CA certificate file for verifying the broker's certificate.
+		config["ssl.certificate.location"] = kafkaSslClientCertFile // Client's certificate
+		config["ssl.key.location"] = kafkaSslClientKeyFile          // Client's key
+		config["ssl.key.password"] = kafkaSslClientKeyPass          // Key password, if any.
+	}
+
+	password := kafkaSaslPassword
+	if kafkaSaslPasswordFile != "" {
+		data, err := ioutil.ReadFile(kafkaSaslPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the sasl password file: %s", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if kafkaSaslMechanism != "" && kafkaSaslUsername != "" && password != "" {
+		if protocol != "sasl_ssl" && protocol != "sasl_plaintext" {
+			return nil, errors.New("invalid config: kafka security protocol is not sasl based but sasl config is provided")
+		}
+
+		config["security.protocol"] = protocol
+		config["sasl.mechanism"] = kafkaSaslMechanism
+		config["sasl.username"] = kafkaSaslUsername
+		config["sasl.password"] = password
+	}
+	return config, nil
+}
+
+// validateOrdering checks the producer settings can keep the ORDERING
+// guarantee.
+func validateOrdering(ordering string, maxInFlight, producers int, distribution, queueFull string) error {
+	if ordering == "none" {
+		return nil
+	}
+	if ordering == "per-partition" && maxInFlight > 5 {
+		return fmt.Errorf("ORDERING=per-partition requires KAFKA_MAX_IN_FLIGHT of at most 5, got %d", maxInFlight)
+	}
+	if ordering == "strict" && maxInFlight > 1 {
+		return fmt.Errorf("ORDERING=strict requires KAFKA_MAX_IN_FLIGHT of 1, got %d", maxInFlight)
+	}
+	if producers > 1 && distribution != "topic" {
+		return fmt.Errorf("ORDERING=%s requires KAFKA_PRODUCER_DISTRIBUTION=topic with several KAFKA_PRODUCERS", ordering)
+	}
+	// the messages dropped from the adapter queue leave holes in the order
+	if queueFull == "drop-oldest" {
+		return fmt.Errorf("ORDERING=%s can't be kept with QUEUE_FULL_POLICY=drop-oldest", ordering)
+	}
+	return nil
+}
+
+// produceOverride represents the producer settings applied to the topics
+// matching a pattern.
+type produceOverride struct {
+	pattern *regexp.Regexp
+	config  map[string]string
+}
+
+func parseProduceOverrides(text string) ([]produceOverride, error) {
+	var rules []struct {
+		Topic  string            `yaml:"topic"`
+		Config map[string]string `yaml:"config"`
+	}
+	if err := yaml.Unmarshal([]byte(text), &rules); err != nil {
+		return nil, err
+	}
+
+	overrides := make([]produceOverride, 0, len(rules))
+	for _, rule := range rules {
+		pattern, err := regexp.Compile("^(?:" + rule.Topic + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid produce override topic pattern %q: %s", rule.Topic, err)
+		}
+		if len(rule.Config) == 0 {
+			return nil, fmt.Errorf("produce override for topic pattern %q has no config", rule.Topic)
+		}
+		overrides = append(overrides, produceOverride{pattern: pattern, config: rule.Config})
+	}
+	return overrides, nil
+}
+
+// topicProducer dispatches each message to the producer created with the
+// settings of the first override matching its topic, or to the default
+// producer if none matches.
+type topicProducer struct {
+	overrides []produceOverride
+	producers []Producer
+	fallback  Producer
+}
+
+// newTopicProducer creates a producer from the base config and one producer
+// per override, with the override settings applied on top of the base config.
+func newTopicProducer(base kafka.ConfigMap, overrides []produceOverride, newProducer func(*kafka.ConfigMap) (Producer, error)) (Producer, error) {
+	fallback, err := newProducer(&base)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return fallback, nil
+	}
+
+	p := &topicProducer{
+		overrides: overrides,
+		fallback:  fallback,
+	}
+	for _, override := range overrides {
+		config := kafka.ConfigMap{}
+		for k, v := range base {
+			config[k] = v
+		}
+		for k, v := range override.config {
+			config[k] = v
+		}
+
+		producer, err := newProducer(&config)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create producer for topic pattern %q: %s", override.pattern, err)
+		}
+		p.producers = append(p.producers, producer)
+	}
+	return p, nil
+}
+
+func (p *topicProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	return p.producerFor(*msg.TopicPartition.Topic).Produce(msg, deliveryChan)
+}
+
+func (p *topicProducer) producerFor(topic string) Producer {
+	for i, override := range p.overrides {
+		if override.pattern.MatchString(topic) {
+			return p.producers[i]
+		}
+	}
+	return p.fallback
+}
+
+// Flush waits for the messages buffered by all the producers to be delivered,
+// up to the timeout, returning the number of messages still buffered.
+func (p *topicProducer) Flush(timeoutMs int) int {
+	return flushAll(append([]Producer{p.fallback}, p.producers...), timeoutMs)
+}
+
+// Close closes all the producers.
+func (p *topicProducer) Close() {
+	closeAll(append([]Producer{p.fallback}, p.producers...))
+}
+
+// flusher is implemented by the producers buffering messages, which are
+// flushed on shutdown.
+type flusher interface {
+	Flush(timeoutMs int) int
+}
+
+// flushAll flushes the producers concurrently, so they share the timeout,
+// returning the number of messages still buffered.
+func flushAll(producers []Producer, timeoutMs int) int {
+	remaining := make(chan int, len(producers))
+	for _, producer := range producers {
+		f, ok := producer.(flusher)
+		if !ok {
+			remaining <- 0
+			continue
+		}
+		go func() { remaining <- f.Flush(timeoutMs) }()
+	}
+
+	total := 0
+	for range producers {
+		total += <-remaining
+	}
+	return total
+}
+
+// closeAll closes the producers holding connections.
+func closeAll(producers []Producer) {
+	for _, producer := range producers {
+		if c, ok := producer.(closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// producerPool distributes the messages across several producer instances,
+// for more throughput than a single producer at very high sample rates.
+type producerPool struct {
+	producers []Producer
+	byTopic   bool
+	next      uint64
+}
+
+// newProducerPool returns a producer constructor creating pools of size
+// instances with newProducer, distributing the messages round-robin or, to
+// keep the messages of a topic in order, by topic.
+func newProducerPool(size int, byTopic bool, newProducer func(*kafka.ConfigMap) (Producer, error)) func(*kafka.ConfigMap) (Producer, error) {
+	return func(config *kafka.ConfigMap) (Producer, error) {
+		if size <= 1 {
+			return newProducer(config)
+		}
+
+		p := &producerPool{byTopic: byTopic}
+		for i := 0; i < size; i++ {
+			producer, err := newProducer(config)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't create producer instance %d: %s", i, err)
+			}
+			p.producers = append(p.producers, producer)
+		}
+		return p, nil
+	}
+}
+
+func (p *producerPool) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	return p.producerFor(*msg.TopicPartition.Topic).Produce(msg, deliveryChan)
+}
+
+func (p *producerPool) producerFor(topic string) Producer {
+	var n uint64
+	if p.byTopic {
+		h := fnv.New64a()
+		h.Write([]byte(topic))
+		n = h.Sum64()
+	} else {
+		n = atomic.AddUint64(&p.next, 1) - 1
+	}
+	return p.producers[n%uint64(len(p.producers))]
+}
+
+// Flush waits for the messages buffered by all the instances to be delivered,
+// up to the timeout, returning the number of messages still buffered.
+func (p *producerPool) Flush(timeoutMs int) int {
+	return flushAll(p.producers, timeoutMs)
+}
+
+// Close closes all the instances.
+func (p *producerPool) Close() {
+	closeAll(p.producers)
+}
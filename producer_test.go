@@ -0,0 +1,198 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+type configuredProducer struct {
+	fakeProducer
+	config kafka.ConfigMap
+}
+
+func newConfiguredProducer(config *kafka.ConfigMap) (Producer, error) {
+	return &configuredProducer{config: *config}, nil
+}
+
+func TestTopicProducerOverrides(t *testing.T) {
+	overrides, err := parseProduceOverrides(`[{topic: 'metrics\.critical\..*', config: {acks: all}}, {topic: 'metrics\.firehose', config: {acks: 1, compression.codec: snappy}}]`)
+	assert.Nil(t, err)
+
+	p, err := newTopicProducer(kafka.ConfigMap{"bootstrap.servers": "kafka:9092", "acks": "-1"}, overrides, newConfiguredProducer)
+	assert.Nil(t, err)
+
+	topics := []string{"metrics.critical.up", "metrics.firehose", "metrics.other"}
+	for _, topic := range topics {
+		topic := topic
+		assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}, nil))
+	}
+
+	critical := p.(*topicProducer).producerFor("metrics.critical.up").(*configuredProducer)
+	assert.Equal(t, "all", critical.config["acks"])
+	assert.Len(t, critical.messages, 1)
+
+	firehose := p.(*topicProducer).producerFor("metrics.firehose").(*configuredProducer)
+	assert.Equal(t, "1", firehose.config["acks"])
+	assert.Equal(t, "snappy", firehose.config["compression.codec"])
+	assert.Equal(t, "kafka:9092", firehose.config["bootstrap.servers"])
+	assert.Len(t, firehose.messages, 1)
+
+	other := p.(*topicProducer).producerFor("metrics.other").(*configuredProducer)
+	assert.Equal(t, "-1", other.config["acks"])
+	assert.Len(t, other.messages, 1)
+}
+
+func TestParseProduceOverridesInvalid(t *testing.T) {
+	_, err := parseProduceOverrides(`[{topic: 'metrics(', config: {acks: all}}]`)
+	assert.NotNil(t, err)
+
+	_, err = parseProduceOverrides(`[{topic: 'metrics'}]`)
+	assert.NotNil(t, err)
+}
+
+func TestProducerConfigTuning(t *testing.T) {
+	config := producerConfig()
+	for _, key := range []string{"max.in.flight.requests.per.connection", "queue.buffering.max.messages", "queue.buffering.max.kbytes", "linger.ms", "client.id", "topic.metadata.refresh.interval.ms"} {
+		assert.NotContains(t, config, key, "unset settings should keep the librdkafka default")
+	}
+
+	defer func() {
+		kafkaMaxInFlight, kafkaQueueMaxMessages, kafkaQueueMaxKbytes, kafkaLingerMs = 0, 0, 0, -1
+		kafkaClientID, kafkaMetadataRefreshMs = "", 0
+	}()
+	kafkaMaxInFlight, kafkaQueueMaxMessages, kafkaQueueMaxKbytes, kafkaLingerMs = 5, 200000, 65536, 0
+	kafkaClientID, kafkaMetadataRefreshMs = "prometheus-kafka-adapter", 60000
+
+	config = producerConfig()
+	assert.Equal(t, 5, config["max.in.flight.requests.per.connection"])
+	assert.Equal(t, 200000, config["queue.buffering.max.messages"])
+	assert.Equal(t, 65536, config["queue.buffering.max.kbytes"])
+	assert.Equal(t, 0, config["linger.ms"])
+	assert.Equal(t, "prometheus-kafka-adapter", config["client.id"])
+	assert.Equal(t, 60000, config["topic.metadata.refresh.interval.ms"])
+	assert.Equal(t, kafkaBrokerList, config["bootstrap.servers"])
+
+	// the settings are valid for librdkafka
+	p, err := kafka.NewProducer(&config)
+	assert.Nil(t, err)
+	p.Close()
+}
+
+// flushingProducer buffers the messages until flushed.
+type flushingProducer struct {
+	fakeProducer
+	flushed int
+}
+
+func (p *flushingProducer) Flush(timeoutMs int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushed = len(p.messages)
+	return 0
+}
+
+func TestProducerPoolRoundRobin(t *testing.T) {
+	var instances []*flushingProducer
+	newProducer := newProducerPool(4, false, func(config *kafka.ConfigMap) (Producer, error) {
+		p := &flushingProducer{}
+		instances = append(instances, p)
+		return p, nil
+	})
+
+	p, err := newTopicProducer(kafka.ConfigMap{}, nil, newProducer)
+	assert.Nil(t, err)
+	assert.Len(t, instances, 4)
+
+	topic := "metrics"
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}, nil))
+	}
+	for _, instance := range instances {
+		assert.Len(t, instance.messages, 25, "the messages should be evenly distributed")
+	}
+
+	assert.Equal(t, 0, p.(flusher).Flush(1000))
+	for _, instance := range instances {
+		assert.Equal(t, 25, instance.flushed, "all the instances should be flushed")
+	}
+}
+
+func TestProducerPoolByTopic(t *testing.T) {
+	var instances []*flushingProducer
+	newProducer := newProducerPool(3, true, func(config *kafka.ConfigMap) (Producer, error) {
+		p := &flushingProducer{}
+		instances = append(instances, p)
+		return p, nil
+	})
+
+	overrides, err := parseProduceOverrides(`[{topic: 'metrics\.critical', config: {acks: all}}]`)
+	assert.Nil(t, err)
+	p, err := newTopicProducer(kafka.ConfigMap{}, overrides, newProducer)
+	assert.Nil(t, err)
+	assert.Len(t, instances, 6, "each override should get its own instances")
+
+	topics := []string{"metrics.a", "metrics.b", "metrics.c", "metrics.critical"}
+	for i := 0; i < 10; i++ {
+		for _, topic := range topics {
+			topic := topic
+			assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}, nil))
+		}
+	}
+
+	for _, instance := range instances {
+		seen := map[string]bool{}
+		for _, msg := range instance.messages {
+			seen[*msg.TopicPartition.Topic] = true
+		}
+		for topic := range seen {
+			assert.Len(t, instance.messages, 10*len(seen), "all the messages of %s should go to the same instance", topic)
+		}
+	}
+
+	assert.Equal(t, 0, p.(flusher).Flush(1000))
+	for _, instance := range instances {
+		assert.Equal(t, len(instance.messages), instance.flushed)
+	}
+}
+
+func TestProducerPoolSingleInstance(t *testing.T) {
+	p, err := newProducerPool(1, false, newConfiguredProducer)(&kafka.ConfigMap{"acks": "all"})
+	assert.Nil(t, err)
+	assert.IsType(t, &configuredProducer{}, p, "a single instance shouldn't be pooled")
+}
+
+func TestProducerConfigOrdering(t *testing.T) {
+	defer func() { produceOrdering, kafkaMaxInFlight = "none", 0 }()
+
+	for _, tc := range []struct {
+		ordering    string
+		maxInFlight int
+		expected    kafka.ConfigMap
+	}{
+		{ordering: "none", expected: kafka.ConfigMap{}},
+		{ordering: "none", maxInFlight: 10, expected: kafka.ConfigMap{"max.in.flight.requests.per.connection": 10}},
+		{ordering: "per-partition", expected: kafka.ConfigMap{"enable.idempotence": true, "max.in.flight.requests.per.connection": 5}},
+		{ordering: "per-partition", maxInFlight: 3, expected: kafka.ConfigMap{"enable.idempotence": true, "max.in.flight.requests.per.connection": 3}},
+		{ordering: "strict", expected: kafka.ConfigMap{"enable.idempotence": true, "max.in.flight.requests.per.connection": 1}},
+	} {
+		produceOrdering, kafkaMaxInFlight = tc.ordering, tc.maxInFlight
+		config := producerConfig()
+		for _, key := range []string{"enable.idempotence", "max.in.flight.requests.per.connection"} {
+			assert.Equal(t, tc.expected[key], config[key], "%s %s", tc.ordering, key)
+		}
+		assert.Nil(t, validateOrdering(tc.ordering, tc.maxInFlight, 1, "round-robin", "reject"), tc.ordering)
+	}
+}
+
+func TestValidateOrdering(t *testing.T) {
+	assert.NotNil(t, validateOrdering("per-partition", 6, 1, "round-robin", "reject"))
+	assert.NotNil(t, validateOrdering("strict", 2, 1, "round-robin", "reject"))
+	assert.Nil(t, validateOrdering("strict", 1, 1, "round-robin", "reject"))
+	assert.NotNil(t, validateOrdering("per-partition", 0, 4, "round-robin", "reject"), "round-robin instances reorder the messages")
+	assert.Nil(t, validateOrdering("per-partition", 0, 4, "topic", "reject"))
+	assert.Nil(t, validateOrdering("none", 100, 4, "round-robin", "reject"))
+	assert.NotNil(t, validateOrdering("per-partition", 0, 1, "round-robin", "drop-oldest"), "dropped messages leave holes")
+	assert.Nil(t, validateOrdering("none", 0, 1, "round-robin", "drop-oldest"))
+}
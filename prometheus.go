@@ -15,11 +15,105 @@
 package main
 
 import (
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
 )
 
-func processWriteRequest(req *prompb.WriteRequest) (map[string][][]byte, error) {
+func processWriteRequest(req *prompb.WriteRequest, profile string, stats *filterStats, seen *dedupRecord) (map[string][]Message, error) {
 	logrus.WithField("var", req).Debugln()
-	return Serialize(serializer, req)
+	cfg := defaultSerializeConfig()
+	if profile != "" {
+		cfg.match = filterProfiles[profile]
+		// the cached decisions are those of the MATCH rules
+		cfg.filterCache = nil
+	}
+	cfg.stats = stats
+	cfg.seen = seen
+	return serializeMessages(serializer, req, cfg)
+}
+
+// setSeriesLabel sets the label on every series of the request, replacing the
+// value of the series already having it.
+func setSeriesLabel(req *prompb.WriteRequest, name, value string) {
+	for _, ts := range req.Timeseries {
+		found := false
+		for _, l := range ts.Labels {
+			if l.Name == name {
+				l.Value = value
+				found = true
+			}
+		}
+		if !found {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: name, Value: value})
+		}
+	}
+}
+
+// writeRequestTimeseriesField is the protobuf field number of the timeseries
+// of a remote write request.
+const writeRequestTimeseriesField = 1
+
+// decodeWriteRequest decodes the timeseries of a serialized remote write
+// request incrementally, passing them to fn in requests of at most batch
+// series, so only a batch of decoded series is held at once. Fields other
+// than the timeseries are skipped. Batches decoded before a malformed series
+// are passed to fn before the error is returned.
+func decodeWriteRequest(buf []byte, batch int, fn func(*prompb.WriteRequest) error) error {
+	chunk := &prompb.WriteRequest{}
+	for len(buf) > 0 {
+		key, n := proto.DecodeVarint(buf)
+		if n == 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		buf = buf[n:]
+
+		var value []byte
+		switch key & 0x7 {
+		case proto.WireVarint:
+			if _, n = proto.DecodeVarint(buf); n == 0 {
+				return fmt.Errorf("invalid varint field")
+			}
+		case proto.WireFixed64:
+			n = 8
+		case proto.WireFixed32:
+			n = 4
+		case proto.WireBytes:
+			length, m := proto.DecodeVarint(buf)
+			if m == 0 || length > uint64(len(buf)-m) {
+				return fmt.Errorf("invalid length delimited field")
+			}
+			value = buf[m : m+int(length)]
+			n = m + int(length)
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&0x7)
+		}
+		if n > len(buf) {
+			return fmt.Errorf("truncated field")
+		}
+		buf = buf[n:]
+
+		if key>>3 != writeRequestTimeseriesField || key&0x7 != proto.WireBytes {
+			continue
+		}
+
+		ts := &prompb.TimeSeries{}
+		if err := proto.Unmarshal(value, ts); err != nil {
+			return err
+		}
+		chunk.Timeseries = append(chunk.Timeseries, ts)
+		if len(chunk.Timeseries) >= batch {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			chunk = &prompb.WriteRequest{}
+		}
+	}
+
+	if len(chunk.Timeseries) > 0 {
+		return fn(chunk)
+	}
+	return nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func largeWriteRequest(series int) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	for i := 0; i < series; i++ {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: "foo"},
+				{Name: "instance", Value: fmt.Sprintf("host-%d:9100", i)},
+				{Name: "job", Value: "node"},
+			},
+			Samples: []prompb.Sample{{Timestamp: int64(i), Value: float64(i)}},
+		})
+	}
+	return req
+}
+
+// heapInUse returns the heap allocated by live objects.
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	req := largeWriteRequest(1050)
+	data, err := proto.Marshal(req)
+	assert.Nil(t, err)
+
+	var decoded []*prompb.TimeSeries
+	var sizes []int
+	err = decodeWriteRequest(data, 100, func(chunk *prompb.WriteRequest) error {
+		decoded = append(decoded, chunk.Timeseries...)
+		sizes = append(sizes, len(chunk.Timeseries))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, req.Timeseries, decoded)
+	assert.Len(t, sizes, 11)
+	assert.Equal(t, 50, sizes[10])
+
+	err = decodeWriteRequest(data[:len(data)-3], 100, func(*prompb.WriteRequest) error { return nil })
+	assert.NotNil(t, err, "truncated request should fail decoding")
+}
+
+func TestDecodeWriteRequestMemory(t *testing.T) {
+	data, err := proto.Marshal(largeWriteRequest(20000))
+	assert.Nil(t, err)
+
+	baseline := heapInUse()
+	var req prompb.WriteRequest
+	assert.Nil(t, proto.Unmarshal(data, &req))
+	full := heapInUse() - baseline
+	runtime.KeepAlive(&req)
+	req = prompb.WriteRequest{}
+
+	baseline = heapInUse()
+	var peak uint64
+	err = decodeWriteRequest(data, 100, func(chunk *prompb.WriteRequest) error {
+		if chunk.Timeseries[0].Samples[0].Timestamp%5000 == 0 {
+			if inUse := heapInUse(); inUse > baseline && inUse-baseline > peak {
+				peak = inUse - baseline
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Less(t, peak, full/10, "streaming decode should only hold a batch of series")
+}
+
+func TestReceiveStreamDecode(t *testing.T) {
+	streamDecodeBatch = 1
+	defer func() { streamDecodeBatch = 0 }()
+
+	producer := &fakeProducer{}
+	w := serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, producer.messages, 2)
+}
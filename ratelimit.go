@@ -0,0 +1,73 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the tokens left to a series, refilled at the rate of the
+// limiter up to its burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter caps the samples produced for each series to a rate, with a
+// token bucket per series. The buckets are held in an LRU cache bounded to a
+// max number of series, a series evicted starting over with a full bucket.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets *lruCache
+}
+
+func newRateLimiter(rate float64, burst, maxSeries int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: newLRUCache(maxSeries),
+	}
+}
+
+// Allow reports whether a sample of the series can be produced at now, taking
+// a token from its bucket if so.
+func (r *rateLimiter) Allow(fingerprint uint64, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var bucket *tokenBucket
+	if value, ok := r.buckets.Get(fingerprint); ok {
+		bucket = value.(*tokenBucket)
+	} else {
+		bucket = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets.Add(fingerprint, bucket)
+	}
+
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * r.rate
+		if bucket.tokens > r.burst {
+			bucket.tokens = r.burst
+		}
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
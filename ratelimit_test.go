@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newRateLimiter(2, 2, 10)
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if limiter.Allow(1, now) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 2, allowed, "a flooded series is capped to the burst")
+	assert.True(t, limiter.Allow(2, now), "other series are unaffected")
+
+	// after a second, the bucket refills at 2 samples per second
+	now = now.Add(time.Second)
+	assert.True(t, limiter.Allow(1, now))
+	assert.True(t, limiter.Allow(1, now))
+	assert.False(t, limiter.Allow(1, now))
+
+	// the refill is capped to the burst
+	now = now.Add(time.Hour)
+	assert.True(t, limiter.Allow(1, now))
+	assert.True(t, limiter.Allow(1, now))
+	assert.False(t, limiter.Allow(1, now))
+}
+
+func TestRateLimiterMaxSeries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newRateLimiter(1, 1, 2)
+
+	assert.True(t, limiter.Allow(1, now))
+	assert.False(t, limiter.Allow(1, now))
+	assert.True(t, limiter.Allow(2, now))
+	assert.True(t, limiter.Allow(3, now))
+	assert.Equal(t, 2, limiter.buckets.Len())
+
+	// series 1 was evicted and starts over with a full bucket
+	assert.True(t, limiter.Allow(1, now))
+}
+
+func TestSerializeSeriesRateLimit(t *testing.T) {
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	limited := &dto.Metric{}
+	assert.Nil(t, objectsRateLimited.Write(limited))
+	before := limited.GetCounter().GetValue()
+
+	flood := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "runaway"}}}
+	for i := 0; i < 50; i++ {
+		flood.Samples = append(flood.Samples, prompb.Sample{Value: float64(i), Timestamp: int64(i)})
+	}
+	quiet := &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "quiet"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 0}, {Value: 2, Timestamp: 1}},
+	}
+	req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{flood, quiet}}
+
+	cfg := serializeConfig{
+		topicTemplate: defaultSerializeConfig().topicTemplate,
+		rateLimit:     newRateLimiter(1, 5, 100),
+	}
+	output, err := serializeMessages(serializer, req, cfg)
+	assert.Nil(t, err)
+
+	names := map[string]int{}
+	for _, msg := range output["metrics"] {
+		var m map[string]interface{}
+		assert.Nil(t, json.Unmarshal(msg.Value, &m))
+		names[m["name"].(string)]++
+	}
+	assert.Equal(t, map[string]int{"runaway": 5, "quiet": 2}, names)
+
+	assert.Nil(t, objectsRateLimited.Write(limited))
+	assert.Equal(t, before+45, limited.GetCounter().GetValue())
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// closer is implemented by the producers holding connections to release once
+// they are replaced.
+type closer interface {
+	Close()
+}
+
+// reloadingProducer produces with a producer that can be replaced at runtime
+// by a new one built from a freshly read config, e.g. with rotated
+// credentials.
+type reloadingProducer struct {
+	newConfig   func() (kafka.ConfigMap, error)
+	newProducer func(kafka.ConfigMap) (Producer, error)
+
+	mu       sync.RWMutex
+	producer Producer
+}
+
+func newReloadingProducer(newConfig func() (kafka.ConfigMap, error), newProducer func(kafka.ConfigMap) (Producer, error)) (*reloadingProducer, error) {
+	p := &reloadingProducer{newConfig: newConfig, newProducer: newProducer}
+	producer, err := p.build()
+	if err != nil {
+		return nil, err
+	}
+	p.producer = producer
+	return p, nil
+}
+
+func (p *reloadingProducer) build() (Producer, error) {
+	config, err := p.newConfig()
+	if err != nil {
+		return nil, err
+	}
+	return p.newProducer(config)
+}
+
+func (p *reloadingProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.producer.Produce(msg, deliveryChan)
+}
+
+// Reload replaces the producer with a new one built from the current config.
+// The messages are produced with the new producer from then on, while the
+// old one delivers its buffered messages, up to the SHUTDOWN_FLUSH_TIMEOUT,
+// before being closed. The old producer is kept if the new one can't be
+// built.
+func (p *reloadingProducer) Reload() error {
+	producer, err := p.build()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	old := p.producer
+	p.producer = producer
+	p.mu.Unlock()
+
+	go retire(old, shutdownFlushTimeout)
+	return nil
+}
+
+// retire flushes the producer, up to the timeout, and closes it.
+func retire(producer Producer, timeout time.Duration) {
+	if f, ok := producer.(flusher); ok {
+		if remaining := f.Flush(int(timeout / time.Millisecond)); remaining > 0 {
+			logrus.WithField("messages", remaining).Warn("couldn't deliver all the messages of the replaced producer")
+		}
+	}
+	if c, ok := producer.(closer); ok {
+		c.Close()
+	}
+}
+
+// Flush waits for the messages buffered by the current producer to be
+// delivered, up to the timeout, returning the number of messages still
+// buffered.
+func (p *reloadingProducer) Flush(timeoutMs int) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return flushAll([]Producer{p.producer}, timeoutMs)
+}
+
+// reloadOnHangup reloads the match rules and the producer, if not nil, every
+// time the adapter receives a SIGHUP, e.g. after the MATCH_FILES are edited
+// or the kafka credentials are rotated.
+func reloadOnHangup(p *reloadingProducer) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reloadRules(); err != nil {
+			logrus.WithError(err).Error("couldn't reload the match rules, keeping the current ones")
+		} else {
+			logrus.Info("reloaded the match rules")
+		}
+
+		if p == nil {
+			continue
+		}
+		logrus.Info("reloading the kafka producer")
+		if err := p.Reload(); err != nil {
+			logrus.WithError(err).Error("couldn't reload the kafka producer, keeping the current one")
+			continue
+		}
+		logrus.Info("reloaded the kafka producer")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+// closingProducer records the config it was created with and whether it was
+// closed.
+type closingProducer struct {
+	fakeProducer
+	config kafka.ConfigMap
+	closed int32
+}
+
+func (p *closingProducer) Close() {
+	atomic.StoreInt32(&p.closed, 1)
+}
+
+func TestReloadingProducerRotatesPassword(t *testing.T) {
+	defer func(mechanism, username, protocol, file string) {
+		kafkaSaslMechanism, kafkaSaslUsername, kafkaSecurityProtocol, kafkaSaslPasswordFile = mechanism, username, protocol, file
+	}(kafkaSaslMechanism, kafkaSaslUsername, kafkaSecurityProtocol, kafkaSaslPasswordFile)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, ioutil.WriteFile(passwordFile, []byte("old-secret\n"), 0600))
+	kafkaSaslMechanism = "SCRAM-SHA-512"
+	kafkaSaslUsername = "adapter"
+	kafkaSecurityProtocol = "sasl_plaintext"
+	kafkaSaslPasswordFile = passwordFile
+
+	var created []*closingProducer
+	p, err := newReloadingProducer(kafkaClientConfig, func(config kafka.ConfigMap) (Producer, error) {
+		producer := &closingProducer{config: config}
+		created = append(created, producer)
+		return producer, nil
+	})
+	assert.Nil(t, err)
+
+	topic := "metrics"
+	assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte("before")}, nil))
+
+	assert.Nil(t, ioutil.WriteFile(passwordFile, []byte("new-secret\n"), 0600))
+	assert.Nil(t, p.Reload())
+	assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte("after")}, nil))
+
+	assert.Len(t, created, 2)
+	old, current := created[0], created[1]
+	assert.Equal(t, "old-secret", old.config["sasl.password"])
+	assert.Equal(t, "new-secret", current.config["sasl.password"])
+	assert.Equal(t, "sasl_plaintext", current.config["security.protocol"])
+
+	assert.Len(t, old.messages, 1)
+	assert.Equal(t, "before", string(old.messages[0].Value))
+	assert.Len(t, current.messages, 1)
+	assert.Equal(t, "after", string(current.messages[0].Value))
+
+	// the old producer is closed in the background
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&old.closed) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&current.closed))
+}
+
+func TestReloadingProducerKeepsCurrentOnError(t *testing.T) {
+	defer func(file string) { kafkaSaslPasswordFile = file }(kafkaSaslPasswordFile)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, ioutil.WriteFile(passwordFile, []byte("secret"), 0600))
+	kafkaSaslPasswordFile = passwordFile
+
+	current := &closingProducer{}
+	p, err := newReloadingProducer(kafkaClientConfig, func(config kafka.ConfigMap) (Producer, error) {
+		return current, nil
+	})
+	assert.Nil(t, err)
+
+	kafkaSaslPasswordFile = filepath.Join(t.TempDir(), "missing")
+	assert.NotNil(t, p.Reload())
+
+	topic := "metrics"
+	assert.Nil(t, p.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte("value")}, nil))
+	assert.Len(t, current.messages, 1)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&current.closed))
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// selfTestMetric is the name of the synthetic series of the self-test.
+const selfTestMetric = "prometheus_kafka_adapter_selftest"
+
+// selfTest serializes a synthetic sample with the serializer and, unless the
+// topic is empty (dry run), produces its messages to the topic, waiting up to
+// the timeout for their delivery. It returns the first failure, so a
+// misconfigured adapter fails on startup rather than on the first request.
+func selfTest(s Serializer, producer Producer, topic string, timeout time.Duration) error {
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: selfTestMetric},
+				{Name: "instance", Value: adapterID},
+			},
+			Samples: []prompb.Sample{{Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Value: 1}},
+		}},
+	}
+
+	// the series is serialized whatever the match rules, the time window and
+	// the empty label policy, and its messages produced to the test topic
+	tpl := template.Must(parseTopicTemplate(selfTestMetric))
+	metricsPerTopic, err := serializeMessages(s, req, serializeConfig{topicTemplate: tpl, synthetic: true})
+	if err != nil {
+		return fmt.Errorf("couldn't serialize the synthetic sample: %s", err)
+	}
+	var messages []Message
+	for _, msgs := range metricsPerTopic {
+		messages = append(messages, msgs...)
+	}
+	if len(messages) == 0 {
+		return errors.New("the synthetic sample produced no message")
+	}
+	if topic == "" {
+		return nil
+	}
+
+	deliveryChan := make(chan kafka.Event, len(messages))
+	for _, msg := range messages {
+		err := producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{
+				Partition: kafka.PartitionAny,
+				Topic:     &topic,
+			},
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: msg.Headers,
+		}, deliveryChan)
+		if err != nil {
+			return fmt.Errorf("couldn't produce the synthetic sample to %s: %s", topic, err)
+		}
+	}
+
+	deadline := time.After(timeout)
+	for range messages {
+		select {
+		case e := <-deliveryChan:
+			if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+				return fmt.Errorf("couldn't deliver the synthetic sample to %s: %s", topic, m.TopicPartition.Error)
+			}
+		case <-deadline:
+			return fmt.Errorf("the synthetic sample wasn't delivered to %s within %s", topic, timeout)
+		}
+	}
+	return nil
+}
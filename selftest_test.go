@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTestDryRun(t *testing.T) {
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	producer := &fakeProducer{}
+	assert.Nil(t, selfTest(serializer, producer, "", time.Second))
+	assert.Empty(t, producer.messages, "a dry run should not produce")
+}
+
+func TestSelfTestProduce(t *testing.T) {
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	producer := &fakeProducer{}
+	assert.Nil(t, selfTest(serializer, producer, "selftest", time.Second))
+	assert.Len(t, producer.messages, 1)
+	assert.Equal(t, "selftest", *producer.messages[0].TopicPartition.Topic)
+	assert.Contains(t, string(producer.messages[0].Value), selfTestMetric)
+}
+
+func TestSelfTestDeliveryFailure(t *testing.T) {
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	err = selfTest(serializer, &fakeProducer{err: errors.New("broker down")}, "selftest", time.Second)
+	assert.NotNil(t, err)
+
+	err = selfTest(serializer, &fakeProducer{delay: time.Second}, "selftest", 10*time.Millisecond)
+	assert.NotNil(t, err, "the self-test should time out")
+}
+
+func TestSelfTestSchemaFailure(t *testing.T) {
+	_, err := NewAvroJSONSerializer("testdata/missing.avsc")
+	assert.NotNil(t, err, "startup should fail when the schema can't be loaded")
+
+	serializer, err := NewAvroJSONSerializer("testdata/metric-incompatible.avsc")
+	assert.Nil(t, err)
+
+	producer := &fakeProducer{}
+	assert.NotNil(t, selfTest(serializer, producer, "selftest", time.Second), "startup should fail when the schema doesn't fit the samples")
+	assert.Empty(t, producer.messages)
+}
+
+func TestSelfTestBypassesWindowAndLabelPolicies(t *testing.T) {
+	// a replay of past data, only keeping the series with a job
+	timeWindowEnd = time.Now().Add(-24 * time.Hour)
+	emptyLabelPolicy, requiredLabels = "drop-series", []string{"job"}
+	defer func() {
+		timeWindowEnd = time.Time{}
+		emptyLabelPolicy, requiredLabels = "keep", nil
+	}()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	producer := &fakeProducer{}
+	assert.Nil(t, selfTest(serializer, producer, "selftest", time.Second))
+	assert.Len(t, producer.messages, 1)
+}
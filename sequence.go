@@ -0,0 +1,97 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	// sequenceHeader is the kafka header carrying the running sequence
+	// number of a message, as a decimal string.
+	sequenceHeader = "sequence"
+	// sequenceEpochHeader is the kafka header carrying the start time of the
+	// sequence, in unix nanoseconds as a decimal string. The sequence starts
+	// over from 0 with a new epoch every time the adapter starts.
+	sequenceEpochHeader = "sequence-epoch"
+)
+
+// messageSequence numbers the produced messages, nil when disabled.
+var messageSequence *sequencer
+
+type sequenceKey struct {
+	topic     string
+	partition int32
+}
+
+// sequencer numbers the messages produced to each topic, or to each topic
+// partition, so consumers can detect gaps.
+type sequencer struct {
+	perPartition bool
+	epoch        []byte
+
+	mu   sync.Mutex
+	next map[sequenceKey]uint64
+}
+
+func newSequencer(scope string, start time.Time) *sequencer {
+	return &sequencer{
+		perPartition: scope == "partition",
+		epoch:        []byte(strconv.FormatInt(start.UnixNano(), 10)),
+		next:         make(map[sequenceKey]uint64),
+	}
+}
+
+// Produce adds the sequence headers to the message and produces it. The
+// number is reserved before producing, so a blocked produce doesn't hold
+// back the other messages. It is given back if produce fails and no later
+// number was reserved meanwhile, the failure leaving a gap otherwise.
+func (s *sequencer) Produce(msg *kafka.Message, produce func() error) error {
+	if s == nil {
+		return produce()
+	}
+
+	key := sequenceKey{topic: *msg.TopicPartition.Topic, partition: kafka.PartitionAny}
+	if s.perPartition {
+		key.partition = msg.TopicPartition.Partition
+	}
+
+	s.mu.Lock()
+	seq := s.next[key]
+	s.next[key] = seq + 1
+	s.mu.Unlock()
+
+	// the serializer headers are shared by all its messages
+	headers := make([]kafka.Header, 0, len(msg.Headers)+2)
+	headers = append(headers, msg.Headers...)
+	msg.Headers = append(headers,
+		kafka.Header{Key: sequenceHeader, Value: []byte(strconv.FormatUint(seq, 10))},
+		kafka.Header{Key: sequenceEpochHeader, Value: s.epoch},
+	)
+
+	if err := produce(); err != nil {
+		s.mu.Lock()
+		if s.next[key] == seq+1 {
+			s.next[key] = seq
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func headerValue(msg *kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestReceiveSequenceHeaders(t *testing.T) {
+	defer func(previous *sequencer) { messageSequence = previous }(messageSequence)
+	messageSequence = newSequencer("topic", time.Unix(0, 42))
+
+	producer := &fakeProducer{}
+	for i := 0; i < 2; i++ {
+		w := serveReceive(t, producer, NewWriteRequest())
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	assert.Len(t, producer.messages, 4)
+	for i, msg := range producer.messages {
+		assert.Equal(t, []string{"0", "1", "2", "3"}[i], headerValue(msg, sequenceHeader))
+		assert.Equal(t, "42", headerValue(msg, sequenceEpochHeader))
+	}
+}
+
+func TestSequencerScope(t *testing.T) {
+	topic, other := "metrics", "other"
+	message := func(topic *string, partition int32) *kafka.Message {
+		return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: topic, Partition: partition}}
+	}
+	produced := func() error { return nil }
+
+	s := newSequencer("partition", time.Now())
+	for _, tc := range []struct {
+		msg      *kafka.Message
+		expected string
+	}{
+		{message(&topic, 0), "0"},
+		{message(&topic, 1), "0"},
+		{message(&topic, 0), "1"},
+		{message(&other, 0), "0"},
+		{message(&topic, kafka.PartitionAny), "0"},
+	} {
+		assert.Nil(t, s.Produce(tc.msg, produced))
+		assert.Equal(t, tc.expected, headerValue(tc.msg, sequenceHeader))
+	}
+
+	s = newSequencer("topic", time.Now())
+	assert.Nil(t, s.Produce(message(&topic, 0), produced))
+	msg := message(&topic, 1)
+	assert.Nil(t, s.Produce(msg, produced))
+	assert.Equal(t, "1", headerValue(msg, sequenceHeader))
+
+	// a message the producer didn't take doesn't consume a number
+	assert.NotNil(t, s.Produce(message(&topic, 0), func() error { return errors.New("queue full") }))
+	msg = message(&topic, 0)
+	assert.Nil(t, s.Produce(msg, produced))
+	assert.Equal(t, "2", headerValue(msg, sequenceHeader))
+}
+
+func TestSequencerSharedHeaders(t *testing.T) {
+	topic := "metrics"
+	shared := make([]kafka.Header, 1, 4)
+	shared[0] = kafka.Header{Key: avroFingerprintHeader}
+
+	s := newSequencer("topic", time.Now())
+	first := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Headers: shared}
+	second := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Headers: shared}
+	assert.Nil(t, s.Produce(first, func() error { return nil }))
+	assert.Nil(t, s.Produce(second, func() error { return nil }))
+
+	assert.Len(t, shared, 1)
+	assert.Equal(t, "0", headerValue(first, sequenceHeader))
+	assert.Equal(t, "1", headerValue(second, sequenceHeader))
+}
+
+func TestSequencerBlockedProduce(t *testing.T) {
+	topic := "metrics"
+	s := newSequencer("topic", time.Now())
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- s.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}, func() error {
+			close(blocked)
+			<-release
+			return errors.New("queue full")
+		})
+	}()
+	<-blocked
+
+	// the blocked message holds its number, not the sequencer
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	assert.Nil(t, s.Produce(msg, func() error { return nil }))
+	assert.Equal(t, "1", headerValue(msg, sequenceHeader))
+
+	// a later number was taken, the failed one is left as a gap
+	close(release)
+	assert.NotNil(t, <-done)
+	msg = &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	assert.Nil(t, s.Produce(msg, func() error { return nil }))
+	assert.Equal(t, "2", headerValue(msg, sequenceHeader))
+}
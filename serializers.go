@@ -17,15 +17,26 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
 
 	"github.com/linkedin/goavro"
+	"github.com/xitongsys/parquet-go/writer"
 )
 
 // Serializer represents an abstract metrics serializer
@@ -33,67 +44,780 @@ type Serializer interface {
 	Marshal(metric map[string]interface{}) ([]byte, error)
 }
 
+// SeriesSerializer represents a metrics serializer that writes all the
+// samples of a series in a single message
+type SeriesSerializer interface {
+	Serializer
+	MarshalSeries(name string, labels map[string]string, samples []map[string]interface{}) ([]byte, error)
+}
+
+// BatchSerializer represents a metrics serializer that writes all the
+// samples of a topic in a single message
+type BatchSerializer interface {
+	Serializer
+	MarshalBatch(metrics []map[string]interface{}) ([]byte, error)
+}
+
+// BatchSplitter represents a batch serializer limiting the samples written
+// in each message, splitting the samples of a topic in several batches
+type BatchSplitter interface {
+	BatchSerializer
+	Split(metrics []map[string]interface{}) [][]map[string]interface{}
+}
+
+// BulkSerializer represents a metrics serializer that writes all the samples
+// of a request in a single message, whatever their topic, produced to the
+// topic resolved from the labels shared by all the series of the request
+type BulkSerializer interface {
+	BatchSerializer
+	Topic(labels map[string]string) string
+}
+
+// HeadersSerializer represents a metrics serializer that attaches kafka
+// headers to every message it writes
+type HeadersSerializer interface {
+	Serializer
+	Headers() []kafka.Header
+}
+
+// OrderedLabelsSerializer represents a metrics serializer that writes the
+// labels in the order of the request, which are passed as a []labelPair
+// instead of a map when OrderedLabels is true
+type OrderedLabelsSerializer interface {
+	Serializer
+	OrderedLabels() bool
+}
+
+// Message represents a serialized metric along with the metadata used to
+// produce it in kafka.
+type Message struct {
+	Key       []byte
+	Value     []byte
+	Partition int32
+	Headers   []kafka.Header
+	Timestamp time.Time
+	// HighPriority is set for the messages of the series matching the
+	// PRIORITY_MATCH rules
+	HighPriority bool
+}
+
+const (
+	// valueNumberField is the field holding the sample value as a JSON
+	// number with JSON_VALUE_NUMBER.
+	valueNumberField = "value_num"
+	// seriesIDFieldName is the field holding the fingerprint of the series
+	// of a sample with SERIES_ID_FIELD, hex encoded.
+	seriesIDFieldName = "series_id"
+	// schemaVersionField is the field telling the SCHEMA_VERSION of the
+	// message format
+	schemaVersionField = "_schema_version"
+	// schemaVersionHeaderKey is the kafka header telling the SCHEMA_VERSION
+	// of the message format
+	schemaVersionHeaderKey = "schema-version"
+)
+
+// newMessage builds the message for a serialized payload, compressing it if
+// PAYLOAD_COMPRESSION is configured and signing it if SIGNING_KEY is.
+func newMessage(key, value []byte, partition int32, headers []kafka.Header) Message {
+	msg := Message{Key: key, Value: value, Partition: partition, Headers: headers}
+	if value == nil {
+		// tombstones must keep their null value
+		return msg
+	}
+	if payloadCompression != nil {
+		msg.Value = payloadCompression.Compress(value)
+		// the headers are shared by all the messages, append to a copy
+		msg.Headers = append(headers[:len(headers):len(headers)], kafka.Header{Key: contentEncodingHeader, Value: []byte(payloadCompression.Encoding())})
+	}
+	if signingKey != nil {
+		// the value is signed as produced, after compression
+		msg.Headers = append(msg.Headers[:len(msg.Headers):len(msg.Headers)], signatureHeader(msg.Value))
+	}
+	return msg
+}
+
+// TopicMessages represents the messages to be produced in a topic
+type TopicMessages struct {
+	Topic    string
+	Messages []Message
+}
+
+// SortedByTopic returns the messages grouped by topic, sorted by topic name,
+// so they can be produced in a stable order.
+func SortedByTopic(messages map[string][]Message) []TopicMessages {
+	result := make([]TopicMessages, 0, len(messages))
+	for t, msgs := range messages {
+		result = append(result, TopicMessages{Topic: t, Messages: msgs})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Topic < result[j].Topic
+	})
+	return result
+}
+
+// fallbackHeaderKey is the kafka header marking the messages written by the
+// fallback serializer, holding its serialization format.
+const fallbackHeaderKey = "serialization-fallback"
+
+// SerializeError represents a failure serializing the samples of a series
+type SerializeError struct {
+	Topic       string
+	Fingerprint uint64
+	Err         error
+}
+
+func (e *SerializeError) Error() string {
+	return fmt.Sprintf("couldn't serialize series %016x for topic %s: %s", e.Fingerprint, e.Topic, e.Err)
+}
+
+func (e *SerializeError) Unwrap() error {
+	return e.Err
+}
+
 // Serialize generates the JSON representation for a given Prometheus metric.
 func Serialize(s Serializer, req *prompb.WriteRequest) (map[string][][]byte, error) {
-	promBatches.Add(float64(1))
-	result := make(map[string][][]byte)
+	messages, err := SerializeMessages(s, req)
+
+	result := make(map[string][][]byte, len(messages))
+	for t, msgs := range messages {
+		for _, msg := range msgs {
+			result[t] = append(result[t], msg.Value)
+		}
+	}
+	return result, err
+}
+
+// SerializeMessages generates the messages to be produced for a given
+// Prometheus write request, grouped by topic. Samples failing serialization
+// are left out of the result, and the first failure is returned as a
+// *SerializeError.
+func SerializeMessages(s Serializer, req *prompb.WriteRequest) (map[string][]Message, error) {
+	return serializeMessages(s, req, defaultSerializeConfig())
+}
+
+// serializeConfig holds the rules deciding which samples are serialized and
+// the topic they are produced to.
+type serializeConfig struct {
+	match         map[string]*dto.MetricFamily
+	topicTemplate *template.Template
+	topicCache    *lruCache
+	filterCache   *lruCache
+	dedup         *dedupCache
+	cardinality   *cardinalityLimiter
+	rateLimit     *rateLimiter
+	aggregation   *aggregator
+	stats         *filterStats
+	// seen collects the samples recorded in the dedup cache
+	seen *dedupRecord
+	// transformed tells the values already went through VALUE_TRANSFORMS
+	transformed bool
+	// aggregated tells the series are closed aggregates, whose samples were
+	// checked against the time window and bounds when received
+	aggregated bool
+	// synthetic exempts the self-test sample from the time window and the
+	// empty label policy, which valid configs can set to drop it
+	synthetic bool
+	// dryRun serializes without counting in the metrics, advancing the
+	// partitioner nor compressing and signing the values, for /validate
+	dryRun bool
+}
+
+// filterStats counts the series of a request, and those dropped by the
+// filter rules.
+type filterStats struct {
+	received int
+	dropped  int
+	// matched counts the series reaching the filter rules and passing them
+	matched int
+}
+
+func (s *filterStats) String() string {
+	return fmt.Sprintf("received=%d, kept=%d, dropped=%d", s.received, s.received-s.dropped, s.dropped)
+}
+
+// defaultSerializeConfig returns the serialize config built from the MATCH
+// rules and the KAFKA_TOPIC template.
+func defaultSerializeConfig() serializeConfig {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	return serializeConfig{
+		match:         match,
+		topicTemplate: topicTemplate,
+		topicCache:    topicCache,
+		filterCache:   filterCache,
+		dedup:         dedup,
+		cardinality:   cardinality,
+		rateLimit:     seriesRateLimit,
+		aggregation:   aggregation,
+	}
+}
+
+// batchKey identifies the samples batched in the same messages: those of a
+// topic, partition and priority, further grouped by message key with
+// BATCH_GROUP_BY_KEY.
+type batchKey struct {
+	topic     string
+	key       string
+	partition int32
+	high      bool
+}
+
+// oldestTime returns the oldest of the record timestamps, the zero time
+// standing for none yet.
+func oldestTime(current, t time.Time) time.Time {
+	if current.IsZero() || t.Before(current) {
+		return t
+	}
+	return current
+}
+
+// serializeMessages works as SerializeMessages, with the given config.
+func serializeMessages(s Serializer, req *prompb.WriteRequest, cfg serializeConfig) (map[string][]Message, error) {
+	cfg.count(promBatches)
+	result := make(map[string][]Message)
+	var serializeErr error
+	ss, perSeries := s.(SeriesSerializer)
+	bs, perTopic := s.(BatchSerializer)
+	bulk, perRequest := s.(BulkSerializer)
+	ols, ok := s.(OrderedLabelsSerializer)
+	ordered := ok && ols.OrderedLabels()
+	var bulkMetrics []map[string]interface{}
+	var commonLabels map[string]string
+	var bulkTime time.Time
+	batches := make(map[batchKey][]map[string]interface{})
+	batchTimes := make(map[batchKey]time.Time)
+	var headers []kafka.Header
+	if hs, ok := s.(HeadersSerializer); ok {
+		headers = hs.Headers()
+	}
+	if schemaVersion != "" && schemaVersionHeader {
+		headers = append(headers[:len(headers):len(headers)], kafka.Header{Key: schemaVersionHeaderKey, Value: []byte(schemaVersion)})
+	}
+	var fallbackHeaders []kafka.Header
+	if fallbackSerializer != nil {
+		if hs, ok := fallbackSerializer.(HeadersSerializer); ok {
+			fallbackHeaders = hs.Headers()
+		}
+		fallbackHeaders = append(fallbackHeaders[:len(fallbackHeaders):len(fallbackHeaders)], kafka.Header{Key: fallbackHeaderKey, Value: []byte(fallbackFormat)})
+	}
+	var aggregated []*prompb.TimeSeries
+	if sampleConflictPolicy != "" {
+		var conflicts int
+		req, conflicts = collapseConflicts(req)
+		cfg.countN(objectsConflicting, conflicts)
+	}
 
 	for _, ts := range req.Timeseries {
+		if cfg.stats != nil {
+			cfg.stats.received++
+		}
+		if len(ts.Samples) == 0 {
+			// e.g. series only carrying labels, there is nothing to produce
+			cfg.count(seriesWithoutSamples)
+			continue
+		}
+
 		labels := make(map[string]string, len(ts.Labels))
 
 		for _, l := range ts.Labels {
 			labels[string(model.LabelName(l.Name))] = string(model.LabelValue(l.Value))
 		}
+		deriveName(labels)
+		if !cfg.validateName(labels) {
+			continue
+		}
+		if !cfg.synthetic && !applyEmptyLabelPolicy(labels) {
+			cfg.count(seriesEmptyLabelDropped)
+			continue
+		}
+		if hasDroppedSuffix(labels["__name__"]) {
+			cfg.count(seriesSuffixDropped)
+			continue
+		}
+		partitionLabels := stripPartitionLabel(labels)
 
-		t := topic(labels)
+		fp := fingerprint(labels)
+		keep := cfg.filter(labels["__name__"], labels, fp)
+		if keep && cfg.stats != nil {
+			cfg.stats.matched++
+		}
+		// with FILTERED_TOPIC, the series filtered out are produced there
+		overflow := !keep && filteredTopic != ""
+		t := cfg.topic(labels)
+		if overflow {
+			t = filteredTopic
+		}
+		fields := computeFields(labels)
+		high := len(priorityRules) > 0 && filterRules(priorityRules, labels["__name__"], labels)
+		// dry runs don't advance the round-robin partitioner
+		partition := kafka.PartitionAny
+		if !cfg.dryRun {
+			partition = partitioner.Partition(t, partitionLabels, fp)
+		}
+		// the topic, fields, fingerprint and key are computed with all the
+		// labels, before the internal ones are stripped
+		output := provenanceLabels(cfg.limitLabelValues(instanceHostLabels(outputLabels(labels))))
+		labelTime, hasLabelTime := cfg.labelTimestamp(labels)
+		var samples []map[string]interface{}
+		var firstTimestamp int64
+		bulked := false
+		filtered := false
 
-		for _, sample := range ts.Samples {
+		for _, sample := range orderedSamples(ts.Samples) {
 			name := string(labels["__name__"])
-			if !filter(name, labels) {
-				objectsFiltered.Add(float64(1))
+			if !keep {
+				cfg.count(objectsFiltered)
+				if !overflow {
+					filtered = true
+					continue
+				}
+			}
+
+			if !cfg.synthetic && !cfg.aggregated && !inTimeWindow(sample.Timestamp, time.Now()) {
+				cfg.count(objectsOutOfWindow)
+				continue
+			}
+
+			timestamp := sample.Timestamp
+			if !cfg.aggregated {
+				bounded, ok := cfg.boundTimestamp(sample.Timestamp, time.Now())
+				if !ok {
+					continue
+				}
+				timestamp = bounded
+			}
+
+			if staleTombstones && isStaleMarker(sample.Value) {
+				// the series stopped, delete its key from compacted topics
+				cfg.count(staleTombstonesProduced)
+				msg := cfg.message([]byte(seriesKey(labels)), nil, partition, headers)
+				msg.HighPriority = high
+				msg.Timestamp = recordTimestamp(timestamp)
+				result[t] = append(result[t], msg)
+				continue
+			}
+
+			value, ok := infValue(sample.Value)
+			if !ok {
+				cfg.count(objectsInfDropped)
+				continue
+			}
+			if !cfg.transformed {
+				value = transformValue(name, value)
+			}
+
+			if cfg.cardinality != nil && !cfg.cardinality.Allow(t, fp, time.Now()) {
+				cfg.count(objectsCardinalityLimited)
+				continue
+			}
+
+			if cfg.dedup != nil && cfg.dedup.Seen(fp, timestamp, time.Now()) {
+				cfg.count(objectsDeduplicated)
+				continue
+			}
+
+			// the samples dropped by the limits below are forgotten, so
+			// they aren't dropped as duplicates when prometheus resends them
+			if cfg.rateLimit != nil && !cfg.rateLimit.Allow(fp, time.Now()) {
+				cfg.count(objectsRateLimited)
+				if cfg.dedup != nil {
+					cfg.dedup.forget([]dedupKey{{fingerprint: fp, timestamp: timestamp}})
+				}
+				continue
+			}
+
+			if cfg.aggregation != nil {
+				closed, ok := cfg.aggregation.Add(fp, ts.Labels, timestamp, value)
+				if ok {
+					cfg.seen.add(fp, timestamp)
+				} else {
+					cfg.count(objectsAggregationLimited)
+					if cfg.dedup != nil {
+						cfg.dedup.forget([]dedupKey{{fingerprint: fp, timestamp: timestamp}})
+					}
+				}
+				if closed != nil {
+					aggregated = append(aggregated, closed)
+				}
 				continue
 			}
+			cfg.seen.add(fp, timestamp)
 
-			epoch := time.Unix(sample.Timestamp/1000, 0).UTC()
+			epoch := time.Unix(timestamp/1000, 0).UTC()
+			if hasLabelTime {
+				epoch = labelTime
+			}
 			m := map[string]interface{}{
-				"timestamp": epoch.Format(time.RFC3339),
-				"value":     strconv.FormatFloat(sample.Value, 'f', -1, 64),
-				"name":      name,
-				"labels":    labels,
+				"value":  formatValue(value),
+				"name":   name,
+				"labels": output,
+			}
+			if ordered {
+				m["labels"] = orderedLabels(ts.Labels, labels, output)
+			}
+			if !omitTimestamp {
+				m["timestamp"] = epoch.Format(time.RFC3339)
+			}
+			for k, v := range fields {
+				m[k] = v
+			}
+			if schemaVersion != "" && !schemaVersionHeader {
+				m[schemaVersionField] = schemaVersion
+			}
+			if seriesIDField {
+				m[seriesIDFieldName] = fmt.Sprintf("%016x", fp)
+			}
+
+			if perSeries {
+				if len(samples) == 0 {
+					firstTimestamp = timestamp
+				}
+				samples = append(samples, m)
+				continue
+			}
+			record := recordTimestamp(timestamp)
+			if hasLabelTime && timestampLabelRecord {
+				record = labelTime
+			}
+			if perRequest {
+				bulkMetrics = append(bulkMetrics, m)
+				bulkTime = oldestTime(bulkTime, record)
+				bulked = true
+				continue
+			}
+			if perTopic {
+				b := batchKey{topic: t, partition: partition, high: high}
+				if batchGroupByKey {
+					b.key = string(messageKey(labels, fp, timestamp))
+				}
+				batches[b] = append(batches[b], m)
+				batchTimes[b] = oldestTime(batchTimes[b], record)
+				continue
 			}
 
 			data, err := s.Marshal(m)
+			cfg.count(serializeTotal)
+			msgHeaders := headers
+			if err != nil && fallbackSerializer != nil {
+				logrus.WithError(err).Warnln("couldn't marshal timeseries, using the fallback serializer")
+				data, err = fallbackSerializer.Marshal(m)
+				msgHeaders = fallbackHeaders
+				if err == nil {
+					cfg.count(serializeFallback)
+				}
+			}
+			if err != nil {
+				cfg.count(serializeFailed)
+				logrus.WithError(err).Errorln("couldn't marshal timeseries")
+				if serializeErr == nil {
+					serializeErr = &SerializeError{Topic: t, Fingerprint: fp, Err: err}
+				}
+				continue
+			}
+			if data == nil {
+				// the serializer can't represent the sample
+				cfg.count(serializeDropped)
+				continue
+			}
+			key := messageKey(labels, fp, timestamp)
+			msg := cfg.message(key, data, partition, msgHeaders)
+			msg.HighPriority = high
+			msg.Timestamp = record
+			result[t] = append(result[t], msg)
+		}
+
+		if filtered && cfg.stats != nil {
+			cfg.stats.dropped++
+		}
+
+		if bulked {
+			commonLabels = intersectLabels(commonLabels, labels)
+		}
+
+		if len(samples) > 0 {
+			data, err := ss.MarshalSeries(labels["__name__"], output, samples)
+			cfg.count(serializeTotal)
+			if err != nil {
+				cfg.count(serializeFailed)
+				logrus.WithError(err).Errorln("couldn't marshal timeseries")
+				if serializeErr == nil {
+					serializeErr = &SerializeError{Topic: t, Fingerprint: fp, Err: err}
+				}
+				continue
+			}
+			key := messageKey(labels, fp, firstTimestamp)
+			msg := cfg.message(key, data, partition, headers)
+			msg.HighPriority = high
+			msg.Timestamp = recordTimestamp(firstTimestamp)
+			if hasLabelTime && timestampLabelRecord {
+				msg.Timestamp = labelTime
+			}
+			result[t] = append(result[t], msg)
+		}
+	}
+
+	if len(bulkMetrics) > 0 {
+		// the partitioner and priorities are refused with json-bulk, as the
+		// topic of the request is only known now
+		b := batchKey{topic: bulk.Topic(commonLabels), partition: kafka.PartitionAny}
+		batches[b] = bulkMetrics
+		batchTimes[b] = bulkTime
+	}
+
+	splitter, split := s.(BatchSplitter)
+	for b, metrics := range batches {
+		t := b.topic
+		var key []byte
+		if b.key != "" {
+			key = []byte(b.key)
+		}
+		chunks := [][]map[string]interface{}{metrics}
+		if split {
+			chunks = splitter.Split(metrics)
+		}
+
+		for _, chunk := range chunks {
+			data, err := bs.MarshalBatch(chunk)
+			cfg.count(serializeTotal)
 			if err != nil {
-				serializeFailed.Add(float64(1))
+				cfg.count(serializeFailed)
 				logrus.WithError(err).Errorln("couldn't marshal timeseries")
+				if serializeErr == nil {
+					serializeErr = &SerializeError{Topic: t, Err: err}
+				}
+				continue
 			}
-			serializeTotal.Add(float64(1))
-			result[t] = append(result[t], data)
+			msg := cfg.message(key, data, b.partition, headers)
+			msg.HighPriority = b.high
+			msg.Timestamp = batchTimes[b]
+			result[t] = append(result[t], msg)
+		}
+	}
+
+	if len(aggregated) > 0 {
+		closed, err := serializeAggregates(s, aggregated, cfg)
+		for t, msgs := range closed {
+			result[t] = append(result[t], msgs...)
+		}
+		if err != nil && serializeErr == nil {
+			serializeErr = err
 		}
 	}
 
-	return result, nil
+	return result, serializeErr
 }
 
 // JSONSerializer represents a metrics serializer that writes JSON
 type JSONSerializer struct {
+	labelsAsString bool
+	labelsAsArray  bool
+	indent         string
+}
+
+func (s *JSONSerializer) OrderedLabels() bool {
+	return s.labelsAsArray
 }
 
 func (s *JSONSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
-	return json.Marshal(metric)
+	metric = jsonRecord(metric)
+	if !s.labelsAsString {
+		return s.marshal(metric)
+	}
+
+	labels, _ := metric["labels"].(map[string]string)
+	m := make(map[string]interface{}, len(metric))
+	for k, v := range metric {
+		m[k] = v
+	}
+	m["labels"] = labelsString(labels, true)
+	return s.marshal(m)
+}
+
+// jsonRecord returns the metric as written by the JSON serialization
+// formats, with the JSON_VALUE_NUMBER and JSON_EXPLICIT_NULLS fields.
+func jsonRecord(metric map[string]interface{}) map[string]interface{} {
+	return withExplicitNulls(withValueNumber(metric))
+}
+
+// withValueNumber returns the metric with a value_num field holding the
+// value as a number if JSON_VALUE_NUMBER, null for non-finite values JSON
+// numbers can't represent, or the metric as is otherwise. The metric isn't
+// modified, as it may be shared with other serializers.
+func withValueNumber(metric map[string]interface{}) map[string]interface{} {
+	text, ok := metric["value"].(string)
+	if !jsonValueNumber || !ok {
+		return metric
+	}
+
+	m := make(map[string]interface{}, len(metric)+1)
+	for k, v := range metric {
+		m[k] = v
+	}
+	m[valueNumberField] = nil
+	if v, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(v, 0) && !math.IsNaN(v) {
+		m[valueNumberField] = v
+	}
+	return m
+}
+
+// jsonNullableFields are the fields the JSON serialization formats always
+// write with JSON_EXPLICIT_NULLS, as null when the sample has no data for
+// them. The adapter doesn't forward exemplars nor metadata, so exemplars and
+// unit are always null for now, reserved so consumers can rely on them.
+var jsonNullableFields = []string{"timestamp", "value", "name", "labels", "exemplars", "unit", schemaVersionField}
+
+// withExplicitNulls returns the metric with the jsonNullableFields it lacks
+// set to null if JSON_EXPLICIT_NULLS, or the metric as is otherwise. The
+// metric isn't modified, as it may be shared with other serializers.
+func withExplicitNulls(metric map[string]interface{}) map[string]interface{} {
+	if !jsonExplicitNulls {
+		return metric
+	}
+
+	m := make(map[string]interface{}, len(metric)+len(jsonNullableFields))
+	for _, field := range jsonNullableFields {
+		m[field] = nil
+	}
+	for k, v := range metric {
+		m[k] = v
+	}
+	return m
+}
+
+// marshal encodes the metric compact, or pretty-printed with the indent of
+// the serializer. Object keys are sorted either way, so the output is stable.
+func (s *JSONSerializer) marshal(metric map[string]interface{}) ([]byte, error) {
+	return marshalJSON(metric, s.indent)
+}
+
+// marshalJSON encodes the value as json.MarshalIndent does, leaving <, > and &
+// unescaped unless JSON_ESCAPE_HTML.
+func marshalJSON(v interface{}, indent string) ([]byte, error) {
+	if jsonEscapeHTML && indent == "" {
+		return json.Marshal(v)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(jsonEscapeHTML)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	// the encoder terminates each value with a newline
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
 }
 
 func NewJSONSerializer() (*JSONSerializer, error) {
 	return &JSONSerializer{}, nil
 }
 
+// NewJSONSerializerWithLabelsFormat builds a new instance of the
+// JSONSerializer writing the labels either as an object (map), as a
+// canonical label set string, without the metric name (string), or as an
+// array of {name, value} objects in the order of the request (array).
+func NewJSONSerializerWithLabelsFormat(format string) (*JSONSerializer, error) {
+	switch format {
+	case "", "map":
+		return &JSONSerializer{}, nil
+	case "string":
+		return &JSONSerializer{labelsAsString: true}, nil
+	case "array":
+		return &JSONSerializer{labelsAsArray: true}, nil
+	default:
+		return nil, fmt.Errorf("invalid json labels format %q", format)
+	}
+}
+
+// JSONArraySerializer represents a metrics serializer that writes all the
+// samples of a topic as a single JSON array
+type JSONArraySerializer struct {
+}
+
+func (s *JSONArraySerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
+	return s.MarshalBatch([]map[string]interface{}{metric})
+}
+
+func (s *JSONArraySerializer) MarshalBatch(metrics []map[string]interface{}) ([]byte, error) {
+	if jsonExplicitNulls || jsonValueNumber {
+		records := make([]map[string]interface{}, len(metrics))
+		for i, metric := range metrics {
+			records[i] = jsonRecord(metric)
+		}
+		metrics = records
+	}
+	return marshalJSON(metrics, "")
+}
+
+// NewJSONArraySerializer builds a new instance of the JSONArraySerializer
+func NewJSONArraySerializer() (*JSONArraySerializer, error) {
+	return &JSONArraySerializer{}, nil
+}
+
+// JSONBulkSerializer represents a metrics serializer that writes all the
+// samples of a request as a single JSON array, to the topic its template
+// yields for the labels shared by all the series
+type JSONBulkSerializer struct {
+	JSONArraySerializer
+	topicTemplate *template.Template
+}
+
+func (s *JSONBulkSerializer) Topic(labels map[string]string) string {
+	return topicName(s.topicTemplate, labels)
+}
+
+// NewJSONBulkSerializer builds a new instance of the JSONBulkSerializer
+func NewJSONBulkSerializer(topicTemplate *template.Template) (*JSONBulkSerializer, error) {
+	return &JSONBulkSerializer{topicTemplate: topicTemplate}, nil
+}
+
+// intersectLabels returns the labels of common with the same value in labels,
+// or a copy of labels if common is nil.
+func intersectLabels(common, labels map[string]string) map[string]string {
+	if common == nil {
+		common = make(map[string]string, len(labels))
+		for name, value := range labels {
+			common[name] = value
+		}
+		return common
+	}
+
+	for name, value := range common {
+		if labels[name] != value {
+			delete(common, name)
+		}
+	}
+	return common
+}
+
 // AvroJSONSerializer represents a metrics serializer that writes Avro-JSON
 type AvroJSONSerializer struct {
-	codec *goavro.Codec
+	codec       *goavro.Codec
+	order       *avroRecordOrder
+	headers     []kafka.Header
+	tenantLabel string
 }
 
 func (s *AvroJSONSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
-	return s.codec.TextualFromNative(nil, metric)
+	if s.tenantLabel == "" {
+		return avroTextual(s.codec, s.order, metric)
+	}
+
+	m := make(map[string]interface{}, len(metric)+1)
+	for k, v := range metric {
+		m[k] = v
+	}
+	m["tenant"] = nil
+	labels, _ := metric["labels"].(map[string]string)
+	if tenant, ok := labels[s.tenantLabel]; ok {
+		m["tenant"] = goavro.Union("string", tenant)
+	}
+	return avroTextual(s.codec, s.order, m)
+}
+
+func (s *AvroJSONSerializer) Headers() []kafka.Header {
+	return s.headers
 }
 
 // NewAvroJSONSerializer builds a new instance of the AvroJSONSerializer
@@ -104,30 +828,1060 @@ func NewAvroJSONSerializer(schemaPath string) (*AvroJSONSerializer, error) {
 		return nil, err
 	}
 
+	if seriesIDField {
+		withSeriesID, err := avroWithStringField(string(schema), seriesIDFieldName)
+		if err != nil {
+			logrus.WithError(err).Errorln("couldn't add the series id field to the avro schema")
+			return nil, err
+		}
+		schema = []byte(withSeriesID)
+	}
+
 	codec, err := goavro.NewCodec(string(schema))
 	if err != nil {
 		logrus.WithError(err).Errorln("couldn't create avro codec")
 		return nil, err
 	}
 
+	headers, err := avroSchemaHeaders(string(schema))
+	if err != nil {
+		logrus.WithError(err).Errorln("couldn't fingerprint avro schema")
+		return nil, err
+	}
+
+	order, err := avroSchemaOrder(string(schema))
+	if err != nil {
+		logrus.WithError(err).Errorln("couldn't read avro schema field order")
+		return nil, err
+	}
+
 	return &AvroJSONSerializer{
-		codec: codec,
+		codec:   codec,
+		order:   order,
+		headers: headers,
 	}, nil
 }
 
-func topic(labels map[string]string) string {
-	var buf bytes.Buffer
-	if err := topicTemplate.Execute(&buf, labels); err != nil {
-		return ""
+// NewAvroJSONSerializerWithTenant builds a new instance of the
+// AvroJSONSerializer copying the value of the tenant label to the tenant
+// field of the record, which must be a nullable string in the schema.
+func NewAvroJSONSerializerWithTenant(schemaPath, tenantLabel string) (*AvroJSONSerializer, error) {
+	s, err := NewAvroJSONSerializer(schemaPath)
+	if err != nil {
+		return nil, err
 	}
-	return buf.String()
+	s.tenantLabel = tenantLabel
+	return s, nil
 }
 
-func filter(name string, labels map[string]string) bool {
-	if len(match) == 0 {
+// fingerprint returns the identifier of the series with the given labels.
+func fingerprint(labels map[string]string) uint64 {
+	return model.LabelsToSignature(labels)
+}
+
+// AvroJSONSeriesSerializer represents a metrics serializer that writes
+// Avro-JSON, grouping all the samples of a series in a single record
+type AvroJSONSeriesSerializer struct {
+	codec   *goavro.Codec
+	order   *avroRecordOrder
+	headers []kafka.Header
+}
+
+func (s *AvroJSONSeriesSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
+	labels, _ := metric["labels"].(map[string]string)
+	name, _ := metric["name"].(string)
+	return s.MarshalSeries(name, labels, []map[string]interface{}{metric})
+}
+
+func (s *AvroJSONSeriesSerializer) MarshalSeries(name string, labels map[string]string, samples []map[string]interface{}) ([]byte, error) {
+	records := make([]interface{}, 0, len(samples))
+	for _, sample := range samples {
+		record := map[string]interface{}{"value": sample["value"]}
+		if timestamp, ok := sample["timestamp"]; ok {
+			record["timestamp"] = timestamp
+		}
+		records = append(records, record)
+	}
+
+	return avroTextual(s.codec, s.order, map[string]interface{}{
+		"name":    name,
+		"labels":  labels,
+		"samples": records,
+	})
+}
+
+func (s *AvroJSONSeriesSerializer) Headers() []kafka.Header {
+	return s.headers
+}
+
+// NewAvroJSONSeriesSerializer builds a new instance of the AvroJSONSeriesSerializer
+func NewAvroJSONSeriesSerializer(schemaPath string) (*AvroJSONSeriesSerializer, error) {
+	schema, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		logrus.WithError(err).Errorln("couldn't read avro schema")
+		return nil, err
+	}
+
+	codec, err := goavro.NewCodec(string(schema))
+	if err != nil {
+		logrus.WithError(err).Errorln("couldn't create avro codec")
+		return nil, err
+	}
+
+	headers, err := avroSchemaHeaders(string(schema))
+	if err != nil {
+		logrus.WithError(err).Errorln("couldn't fingerprint avro schema")
+		return nil, err
+	}
+
+	order, err := avroSchemaOrder(string(schema))
+	if err != nil {
+		logrus.WithError(err).Errorln("couldn't read avro schema field order")
+		return nil, err
+	}
+
+	return &AvroJSONSeriesSerializer{
+		codec:   codec,
+		order:   order,
+		headers: headers,
+	}, nil
+}
+
+// metricTypeSuffixes are the suffixes prometheus appends to the name of the
+// series of counters, summaries and histograms.
+var metricTypeSuffixes = []string{"_total", "_bucket", "_sum", "_count"}
+
+// baseName returns the metric name without its type suffix, e.g: the base
+// name of http_requests_total is http_requests.
+func baseName(name string) string {
+	for _, suffix := range metricTypeSuffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// deriveName sets the __name__ label of a series without metric name to the
+// value of the first of the NAME_FALLBACK_LABELS it has, so the topic, the
+// filters and the output all see the derived name.
+func deriveName(labels map[string]string) {
+	if labels["__name__"] != "" {
+		return
+	}
+	for _, label := range nameFallbackLabels {
+		if value := labels[label]; value != "" {
+			labels["__name__"] = value
+			return
+		}
+	}
+}
+
+// validateName checks the metric name against the Prometheus metric name
+// syntax with METRIC_NAME_VALIDATION, replacing the invalid characters with
+// underscores with sanitize. It reports false if the series has to be
+// dropped. Series without metric name are left to NAME_FALLBACK_LABELS.
+func (cfg serializeConfig) validateName(labels map[string]string) bool {
+	name := labels["__name__"]
+	if metricNameValidation == "off" || name == "" || validMetricName(name) {
+		return true
+	}
+	cfg.count(seriesInvalidName)
+	if metricNameValidation == "drop" {
+		return false
+	}
+	labels["__name__"] = sanitizeMetricName(name)
+	return true
+}
+
+// validMetricName reports whether the name matches [a-zA-Z_:][a-zA-Z0-9_:]*.
+func validMetricName(name string) bool {
+	for i, r := range name {
+		if !metricNameRune(r, i == 0) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// sanitizeMetricName replaces the characters not allowed in a metric name
+// with underscores, prefixing the names starting with a digit with one.
+func sanitizeMetricName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if i == 0 && r >= '0' && r <= '9' {
+			b.WriteByte('_')
+		}
+		if !metricNameRune(r, false) {
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func metricNameRune(r rune, first bool) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || r == ':' || !first && r >= '0' && r <= '9'
+}
+
+// hasDroppedSuffix reports whether the metric name ends with one of the
+// DROP_METRIC_SUFFIXES, e.g: the _bucket, _sum and _count series of a classic
+// histogram.
+func hasDroppedSuffix(name string) bool {
+	for _, suffix := range dropSuffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelPair is a label written as a {name, value} object.
+type labelPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// orderedLabels returns the output labels of a series in the order of the
+// request, keeping duplicated names. The labels whose value was changed on
+// the way to the output, e.g. truncated, are written with their output value,
+// and the labels added, e.g. the provenance label, follow sorted by name.
+func orderedLabels(input []*prompb.Label, labels, output map[string]string) []labelPair {
+	pairs := make([]labelPair, 0, len(output))
+	seen := make(map[string]bool, len(input))
+	for _, l := range input {
+		value, ok := output[l.Name]
+		if !ok {
+			continue
+		}
+		if l.Value != labels[l.Name] {
+			// a duplicated name, overridden in the labels by a later one
+			value = l.Value
+		}
+		pairs = append(pairs, labelPair{Name: l.Name, Value: value})
+		seen[l.Name] = true
+	}
+
+	added := make([]string, 0, len(output)-len(seen))
+	for name := range output {
+		if !seen[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		pairs = append(pairs, labelPair{Name: name, Value: output[name]})
+	}
+	return pairs
+}
+
+// labelsString renders the labels as a canonical Prometheus style label set
+// sorted by label name, e.g: {a="1",b="2"}.
+func labelsString(labels map[string]string, excludeName bool) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if excludeName && name == "__name__" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(strconv.Quote(labels[name]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// orderedSamples returns the samples of a series sorted by timestamp if
+// SORT_SAMPLES is set, or as received otherwise.
+func orderedSamples(samples []prompb.Sample) []prompb.Sample {
+	if !sortSamples || sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp }) {
+		return samples
+	}
+
+	sorted := make([]prompb.Sample, len(samples))
+	copy(sorted, samples)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp < sorted[j].Timestamp })
+	return sorted
+}
+
+// recordTimestamp returns the kafka record timestamp of a message holding a
+// sample with the timestamp, in milliseconds. It is the zero time, leaving
+// the timestamp to the producer, unless RECORD_TIMESTAMP_FROM_SAMPLE is set.
+func recordTimestamp(timestamp int64) time.Time {
+	if !sampleRecordTimestamp {
+		return time.Time{}
+	}
+	return time.Unix(0, timestamp*int64(time.Millisecond)).UTC()
+}
+
+// applyEmptyLabelPolicy applies the EMPTY_LABEL_POLICY to the labels of a
+// series, removing the labels with an empty value with drop-label. It
+// reports false if the series has to be dropped, which is the case with
+// drop-series for series with any of the REQUIRED_LABELS empty or absent, or
+// any label empty if no label is required.
+func applyEmptyLabelPolicy(labels map[string]string) bool {
+	switch emptyLabelPolicy {
+	case "drop-label":
+		for name, value := range labels {
+			if value == "" {
+				delete(labels, name)
+			}
+		}
+	case "drop-series":
+		if len(requiredLabels) == 0 {
+			for _, value := range labels {
+				if value == "" {
+					return false
+				}
+			}
+		}
+		for _, name := range requiredLabels {
+			if labels[name] == "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// limitLabelValues returns the output labels of a series with the values
+// longer than LABEL_VALUE_MAX_LENGTH characters truncated, ending with the
+// LABEL_TRUNCATION_SUFFIX so consumers can tell, or removed with the
+// drop-label policy. The metric name is left untouched. The labels aren't
+// modified, as they may be shared with the series.
+func (cfg serializeConfig) limitLabelValues(labels map[string]string) map[string]string {
+	if labelValueMaxLength == 0 {
+		return labels
+	}
+
+	var output map[string]string
+	for name, value := range labels {
+		if name == "__name__" || utf8.RuneCountInString(value) <= labelValueMaxLength {
+			continue
+		}
+		if output == nil {
+			output = make(map[string]string, len(labels))
+			for name, value := range labels {
+				output[name] = value
+			}
+		}
+
+		cfg.count(labelValuesTooLong)
+		if labelValueOverflow == "drop-label" {
+			delete(output, name)
+			continue
+		}
+		output[name] = truncateValue(value, labelValueMaxLength, labelTruncationSuffix)
+	}
+
+	if output == nil {
+		return labels
+	}
+	return output
+}
+
+// truncateValue cuts the value to at most max characters, the suffix
+// included.
+func truncateValue(value string, max int, suffix string) string {
+	keep := max - utf8.RuneCountInString(suffix)
+	if keep < 0 {
+		keep, suffix = max, ""
+	}
+	runes := []rune(value)
+	return string(runes[:keep]) + suffix
+}
+
+// provenanceLabels returns the output labels of a series with the
+// PROVENANCE_LABEL set to the ADAPTER_ID. If the series already has the
+// label, it's moved to exported_<label> with the rename policy, replaced with
+// overwrite and left untouched with keep. The labels aren't modified, as they
+// may be shared with the series.
+func provenanceLabels(labels map[string]string) map[string]string {
+	if provenanceLabel == "" {
+		return labels
+	}
+
+	existing, conflict := labels[provenanceLabel]
+	if conflict && provenanceConflict == "keep" {
+		return labels
+	}
+
+	output := make(map[string]string, len(labels)+2)
+	for name, value := range labels {
+		output[name] = value
+	}
+	if conflict && provenanceConflict == "rename" {
+		output["exported_"+provenanceLabel] = existing
+	}
+	output[provenanceLabel] = adapterID
+	return output
+}
+
+// instanceHostLabel is the label holding the host of the instance label.
+const instanceHostLabel = "instance_host"
+
+// instanceHostLabels returns the output labels of a series with the host part
+// of its instance label added as instance_host, with INSTANCE_HOST_LABEL. The
+// instance label is removed with replace. Series without an instance label,
+// or already having an instance_host label, are left untouched.
+func instanceHostLabels(labels map[string]string) map[string]string {
+	if instanceHostMode == "" {
+		return labels
+	}
+
+	instance, ok := labels["instance"]
+	if !ok {
+		return labels
+	}
+	if _, exists := labels[instanceHostLabel]; exists {
+		return labels
+	}
+
+	output := make(map[string]string, len(labels)+1)
+	for name, value := range labels {
+		output[name] = value
+	}
+	if instanceHostMode == "replace" {
+		delete(output, "instance")
+	}
+	output[instanceHostLabel] = instanceHost(instance)
+	return output
+}
+
+// instanceHost returns the host of a host:port instance, e.g: 10.0.0.1 for
+// 10.0.0.1:9100 or ::1 for [::1]:9100. Instances without a port are returned
+// as is, without the brackets of IPv6 addresses.
+func instanceHost(instance string) string {
+	if host, _, err := net.SplitHostPort(instance); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(instance, "["), "]")
+}
+
+// labelTimestamp returns the time held by the TIMESTAMP_LABEL label of the
+// series, either RFC3339 or seconds since the epoch. It reports false if the
+// label is absent or invalid, keeping the sample timestamps.
+func (cfg serializeConfig) labelTimestamp(labels map[string]string) (time.Time, bool) {
+	if timestampLabel == "" {
+		return time.Time{}, false
+	}
+
+	value, ok := labels[timestampLabel]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.UTC(), true
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(seconds) && !math.IsInf(seconds, 0) {
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), true
+	}
+
+	cfg.count(timestampLabelInvalid)
+	logrus.WithField("timestamp", value).Debugln("invalid timestamp label value, using the sample timestamp")
+	return time.Time{}, false
+}
+
+// outputLabels returns the labels written to the messages, without the
+// internal labels prefixed with __ if STRIP_INTERNAL_LABELS is set. __name__
+// is kept unless STRIP_NAME_LABEL is set too.
+func outputLabels(labels map[string]string) map[string]string {
+	if !stripInternalLabels {
+		return labels
+	}
+
+	output := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if strings.HasPrefix(name, "__") && (name != "__name__" || stripNameLabel) {
+			continue
+		}
+		output[name] = value
+	}
+	return output
+}
+
+// seriesKey returns a stable and unique identifier of the series with the
+// given labels, e.g: up{instance="host:9100",job="node"}.
+func seriesKey(labels map[string]string) string {
+	return labels["__name__"] + labelsString(labels, true)
+}
+
+// messageKey returns the kafka message key for the sample of the series with
+// the given labels and fingerprint, as configured by KEY_SOURCE. The
+// series-timestamp key is the fingerprint followed by the zero-padded
+// timestamp, so the keys of a series sort lexicographically by time. The
+// metric_name key is the __name__ label, for topics compacted by metric.
+func messageKey(labels map[string]string, fp uint64, timestamp int64) []byte {
+	switch keySource {
+	case "series":
+		return []byte(seriesKey(labels))
+	case "series-timestamp":
+		return []byte(fmt.Sprintf("%016x-%0*d", fp, keyTimestampWidth, timestamp))
+	case "metric_name":
+		return []byte(labels["__name__"])
+	default:
+		return nil
+	}
+}
+
+// parquetReservedColumns are the columns every parquet row has, that can't
+// be used as label columns
+var parquetReservedColumns = []string{"value", "timestamp", "name"}
+
+// ParquetSerializer represents a metrics serializer that writes the samples
+// of a topic as parquet files of a single row group, with the value,
+// timestamp and name columns plus a column for each configured label
+type ParquetSerializer struct {
+	labelColumns []string
+	maxRows      int
+	maxBytes     int
+	metadata     []string
+}
+
+func (s *ParquetSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
+	return s.MarshalBatch([]map[string]interface{}{metric})
+}
+
+func (s *ParquetSerializer) MarshalBatch(metrics []map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	pw, err := writer.NewCSVWriterFromWriter(s.metadata, &buf, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, metric := range metrics {
+		row, err := s.row(metric)
+		if err != nil {
+			return nil, err
+		}
+		if err := pw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := pw.WriteStop(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Split splits the samples in batches of at most maxRows samples and, when
+// set, maxBytes of estimated uncompressed data.
+func (s *ParquetSerializer) Split(metrics []map[string]interface{}) [][]map[string]interface{} {
+	var chunks [][]map[string]interface{}
+	start, size := 0, 0
+	for i, metric := range metrics {
+		rowSize := s.rowSize(metric)
+		rows := i - start
+		if rows > 0 && (rows >= s.maxRows || (s.maxBytes > 0 && size+rowSize > s.maxBytes)) {
+			chunks = append(chunks, metrics[start:i])
+			start, size = i, 0
+		}
+		size += rowSize
+	}
+	if start < len(metrics) {
+		chunks = append(chunks, metrics[start:])
+	}
+	return chunks
+}
+
+func (s *ParquetSerializer) row(metric map[string]interface{}) ([]interface{}, error) {
+	name, _ := metric["name"].(string)
+	labels, _ := metric["labels"].(map[string]string)
+	value, _ := metric["value"].(string)
+	timestamp, _ := metric["timestamp"].(string)
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	row := make([]interface{}, 0, len(parquetReservedColumns)+len(s.labelColumns))
+	row = append(row, v, ts.UnixNano()/int64(time.Millisecond), name)
+	for _, column := range s.labelColumns {
+		if label, ok := labels[column]; ok {
+			row = append(row, label)
+		} else {
+			row = append(row, nil)
+		}
+	}
+	return row, nil
+}
+
+// rowSize estimates the uncompressed size of the row of the sample.
+func (s *ParquetSerializer) rowSize(metric map[string]interface{}) int {
+	name, _ := metric["name"].(string)
+	labels, _ := metric["labels"].(map[string]string)
+
+	size := 8 + 8 + len(name)
+	for _, column := range s.labelColumns {
+		size += len(labels[column])
+	}
+	return size
+}
+
+// NewParquetSerializer builds a new instance of the ParquetSerializer,
+// writing at most maxRows samples and, when not zero, maxBytes of estimated
+// uncompressed data in each message.
+func NewParquetSerializer(labelColumns []string, maxRows, maxBytes int) (*ParquetSerializer, error) {
+	if maxRows <= 0 {
+		return nil, fmt.Errorf("invalid parquet max rows %d", maxRows)
+	}
+
+	metadata := []string{
+		"name=value, type=DOUBLE",
+		"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS",
+		"name=name, type=BYTE_ARRAY, convertedtype=UTF8",
+	}
+	seen := make(map[string]bool)
+	for _, column := range parquetReservedColumns {
+		seen[column] = true
+	}
+	for _, column := range labelColumns {
+		if !model.LabelName(column).IsValid() {
+			return nil, fmt.Errorf("invalid parquet label column %q", column)
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("duplicated parquet column %q", column)
+		}
+		seen[column] = true
+		metadata = append(metadata, fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL", column))
+	}
+
+	return &ParquetSerializer{
+		labelColumns: labelColumns,
+		maxRows:      maxRows,
+		maxBytes:     maxBytes,
+		metadata:     metadata,
+	}, nil
+}
+
+// LineProtocolSerializer represents a metrics serializer that writes
+// InfluxDB line protocol
+type LineProtocolSerializer struct {
+	nonFiniteSentinel string
+}
+
+var (
+	lineProtocolMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	lineProtocolTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// Marshal writes the metric as "measurement,tagset value=<value> <timestamp>",
+// using the metric name as the measurement and the rest of the labels as tags.
+// Non-finite values are written as the sentinel value or, if there is none,
+// the metric is dropped.
+func (s *LineProtocolSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
+	name, _ := metric["name"].(string)
+	labels, _ := metric["labels"].(map[string]string)
+	value, _ := metric["value"].(string)
+	timestamp, hasTimestamp := metric["timestamp"].(string)
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		if s.nonFiniteSentinel == "" {
+			return nil, nil
+		}
+		value = s.nonFiniteSentinel
+	}
+
+	var ts time.Time
+	if hasTimestamp {
+		ts, err = time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString(lineProtocolMeasurementEscaper.Replace(name))
+	for _, l := range names {
+		// the name is the measurement, and the line protocol has no empty tags
+		if l == "__name__" || labels[l] == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(lineProtocolTagEscaper.Replace(l))
+		buf.WriteByte('=')
+		buf.WriteString(lineProtocolTagEscaper.Replace(labels[l]))
+	}
+	buf.WriteString(" value=")
+	buf.WriteString(value)
+	if hasTimestamp {
+		// without a timestamp, the sink uses its own ingestion time
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	}
+	return buf.Bytes(), nil
+}
+
+// NewLineProtocolSerializer builds a new instance of the LineProtocolSerializer,
+// writing non-finite values as the given sentinel, or dropping them if empty.
+func NewLineProtocolSerializer(nonFiniteSentinel string) (*LineProtocolSerializer, error) {
+	if nonFiniteSentinel != "" {
+		if _, err := strconv.ParseFloat(nonFiniteSentinel, 64); err != nil {
+			return nil, fmt.Errorf("invalid non-finite sentinel %q: %s", nonFiniteSentinel, err)
+		}
+	}
+
+	return &LineProtocolSerializer{
+		nonFiniteSentinel: nonFiniteSentinel,
+	}, nil
+}
+
+// GraphiteSerializer represents a metrics serializer that writes the Graphite
+// plaintext protocol, with tags
+type GraphiteSerializer struct {
+	nonFiniteSentinel string
+}
+
+var (
+	// dots are kept in the metric path, as Graphite node separators
+	graphitePathEscaper     = strings.NewReplacer(" ", "_", ";", "_")
+	graphiteTagNameEscaper  = strings.NewReplacer(" ", "_", ";", "_", "!", "_", "^", "_", "=", "_")
+	graphiteTagValueEscaper = strings.NewReplacer(" ", "_", ";", "_")
+)
+
+// Marshal writes the metric as "path;tag=value;... <value> <timestamp>",
+// using the metric name as the path and the rest of the labels as tags, with
+// a seconds timestamp, or -1 for the receive time without one. Characters
+// Graphite doesn't accept in paths and tags are replaced with underscores.
+// Non-finite values are written as the sentinel value or, if there is none,
+// the metric is dropped.
+func (s *GraphiteSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
+	name, _ := metric["name"].(string)
+	labels, _ := metric["labels"].(map[string]string)
+	value, _ := metric["value"].(string)
+	timestamp, hasTimestamp := metric["timestamp"].(string)
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		if s.nonFiniteSentinel == "" {
+			return nil, nil
+		}
+		value = s.nonFiniteSentinel
+	}
+
+	seconds := "-1"
+	if hasTimestamp {
+		ts, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		seconds = strconv.FormatInt(ts.Unix(), 10)
+	}
+
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString(graphitePathEscaper.Replace(name))
+	for _, l := range names {
+		// the name is the path, and Graphite has no empty tags
+		if l == "__name__" || labels[l] == "" {
+			continue
+		}
+		buf.WriteByte(';')
+		buf.WriteString(graphiteTagNameEscaper.Replace(l))
+		buf.WriteByte('=')
+		// tag values can't start with a tilde
+		buf.WriteString(graphiteTagValueEscaper.Replace(strings.TrimLeft(labels[l], "~")))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(value)
+	buf.WriteByte(' ')
+	buf.WriteString(seconds)
+	return buf.Bytes(), nil
+}
+
+// NewGraphiteSerializer builds a new instance of the GraphiteSerializer,
+// writing non-finite values as the given sentinel, or dropping them if empty.
+func NewGraphiteSerializer(nonFiniteSentinel string) (*GraphiteSerializer, error) {
+	if nonFiniteSentinel != "" {
+		if _, err := strconv.ParseFloat(nonFiniteSentinel, 64); err != nil {
+			return nil, fmt.Errorf("invalid non-finite sentinel %q: %s", nonFiniteSentinel, err)
+		}
+	}
+
+	return &GraphiteSerializer{
+		nonFiniteSentinel: nonFiniteSentinel,
+	}, nil
+}
+
+func topic(labels map[string]string) string {
+	return defaultSerializeConfig().topic(labels)
+}
+
+// topic returns the topic for the series with the given labels, caching the
+// result of the topic template if the config has a topic cache.
+func (cfg serializeConfig) topic(labels map[string]string) string {
+	if cfg.topicCache == nil {
+		return cfg.resolveTopic(labels)
+	}
+
+	fp := fingerprint(labels)
+	if t, ok := cfg.topicCache.Get(fp); ok {
+		return t.(string)
+	}
+
+	t := cfg.resolveTopic(labels)
+	if cfg.topicCache.Add(fp, t) {
+		topicCacheEvictions.Add(float64(1))
+	}
+	topicCacheSize.Set(float64(cfg.topicCache.Len()))
+	return t
+}
+
+// filter returns whether the series passes the match rules, the decision
+// being cached by fingerprint with FILTER_CACHE_SIZE.
+func (cfg serializeConfig) filter(name string, labels map[string]string, fp uint64) bool {
+	if cfg.filterCache == nil {
+		return filterRules(cfg.match, name, labels)
+	}
+
+	if keep, ok := cfg.filterCache.Get(fp); ok {
+		return keep.(bool)
+	}
+	keep := filterRules(cfg.match, name, labels)
+	cfg.filterCache.Add(fp, keep)
+	return keep
+}
+
+// count increments the counter, unless serializing a dry run.
+func (cfg serializeConfig) count(counter prometheus.Counter) {
+	cfg.countN(counter, 1)
+}
+
+func (cfg serializeConfig) countN(counter prometheus.Counter, n int) {
+	if !cfg.dryRun {
+		counter.Add(float64(n))
+	}
+}
+
+// message builds the message for a serialized payload as newMessage does,
+// leaving the value as serialized in dry runs.
+func (cfg serializeConfig) message(key, value []byte, partition int32, headers []kafka.Header) Message {
+	if cfg.dryRun {
+		return Message{Key: key, Value: value, Partition: partition, Headers: headers}
+	}
+	return newMessage(key, value, partition, headers)
+}
+
+// resolveTopic returns the TOPIC_LOOKUP topic of the value of the
+// TOPIC_LOOKUP_LABEL of the series, or for unmapped values the
+// TOPIC_LOOKUP_DEFAULT topic if set, and the topic template otherwise.
+func (cfg serializeConfig) resolveTopic(labels map[string]string) string {
+	if topicLookupLabel != "" {
+		if t, ok := topicLookup[labels[topicLookupLabel]]; ok {
+			return t
+		}
+		if topicLookupDefault != "" {
+			return topicLookupDefault
+		}
+	}
+	return topicName(cfg.topicTemplate, labels)
+}
+
+// topicName returns the topic the topic template yields for the labels,
+// lowercased if TOPIC_LOWERCASE is set.
+func topicName(tpl *template.Template, labels map[string]string) string {
+	t := executeTemplate(tpl, labels)
+	if topicLowercase {
+		t = strings.ToLower(t)
+	}
+	return t
+}
+
+func executeTemplate(tpl *template.Template, labels map[string]string) string {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, labels); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+func computeFields(labels map[string]string) map[string]string {
+	fields := make(map[string]string, len(computedFields))
+	for name, tpl := range computedFields {
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, labels); err != nil {
+			logrus.WithError(err).WithField("field", name).Debugln("couldn't compute field")
+			fields[name] = ""
+			continue
+		}
+		fields[name] = buf.String()
+	}
+	return fields
+}
+
+// staleMarkerBits are the bits of the NaN value prometheus sends as the last
+// sample of a series that stopped, known as a staleness marker.
+const staleMarkerBits = 0x7ff0000000000002
+
+// isStaleMarker reports whether the sample value is a staleness marker,
+// rather than any other NaN.
+func isStaleMarker(v float64) bool {
+	return math.Float64bits(v) == staleMarkerBits
+}
+
+// infValue applies the INF_POLICY to a sample value, clamping infinite
+// values to the largest finite ones with clamp. It reports false if the
+// sample has to be dropped, which is the case of infinite values with drop.
+func infValue(v float64) (float64, bool) {
+	if !math.IsInf(v, 0) {
+		return v, true
+	}
+
+	switch infPolicy {
+	case "clamp":
+		if v > 0 {
+			return math.MaxFloat64, true
+		}
+		return -math.MaxFloat64, true
+	case "drop":
+		return v, false
+	default:
+		return v, true
+	}
+}
+
+// formatValue returns the textual representation of a sample value, rounded
+// to VALUE_ROUND decimal places when configured. Non-finite values are never
+// rounded.
+func formatValue(v float64) string {
+	if valueRound >= 0 && !math.IsInf(v, 0) && !math.IsNaN(v) {
+		rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, 'f', valueRound, 64), 64)
+		if err == nil {
+			v = rounded
+		}
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// inTimeWindow reports whether the sample timestamp, in milliseconds, falls
+// within the configured time window. Absent bounds leave the window open.
+func inTimeWindow(timestamp int64, now time.Time) bool {
+	t := time.Unix(0, timestamp*int64(time.Millisecond))
+
+	if !timeWindowStart.IsZero() && t.Before(timeWindowStart) {
+		return false
+	}
+	if !timeWindowEnd.IsZero() && t.After(timeWindowEnd) {
+		return false
+	}
+	if timeWindowLast > 0 && t.Before(now.Add(-timeWindowLast)) {
+		return false
+	}
+	return true
+}
+
+// boundTimestamp checks the sample timestamp, in milliseconds, against the
+// MAX_SAMPLE_AGE and MAX_FUTURE_SKEW bounds, returning the timestamp to use
+// and whether the sample is kept. Samples out of bounds are dropped, or
+// clamped to the bound when SAMPLE_BOUNDS_ACTION is clamp.
+func (cfg serializeConfig) boundTimestamp(timestamp int64, now time.Time) (int64, bool) {
+	t := time.Unix(0, timestamp*int64(time.Millisecond))
+
+	var bound time.Time
+	switch {
+	case maxSampleAge > 0 && t.Before(now.Add(-maxSampleAge)):
+		bound = now.Add(-maxSampleAge)
+		if !clampSampleBounds {
+			cfg.count(objectsTooOld)
+			return timestamp, false
+		}
+	case maxFutureSkew > 0 && t.After(now.Add(maxFutureSkew)):
+		bound = now.Add(maxFutureSkew)
+		if !clampSampleBounds {
+			cfg.count(objectsTooNew)
+			return timestamp, false
+		}
+	default:
+		return timestamp, true
+	}
+
+	cfg.count(objectsClamped)
+	return bound.UnixNano() / int64(time.Millisecond), true
+}
+
+func filter(name string, labels map[string]string) bool {
+	rulesMu.RLock()
+	rules := match
+	rulesMu.RUnlock()
+
+	return filterRules(rules, name, labels)
+}
+
+// matchLabel reports whether the labels satisfy an equality or numeric comparison matcher.
+func matchLabel(name, value string, labels map[string]string) bool {
+	for _, op := range []string{">=", "<=", ">", "<"} {
+		if !strings.HasSuffix(name, op) {
+			continue
+		}
+
+		val, ok := labels[strings.TrimSuffix(name, op)]
+		if !ok {
+			return false
+		}
+		actual, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return false
+		}
+		expected, _ := strconv.ParseFloat(value, 64)
+
+		switch op {
+		case ">=":
+			return actual >= expected
+		case "<=":
+			return actual <= expected
+		case ">":
+			return actual > expected
+		default:
+			return actual < expected
+		}
+	}
+
+	val, ok := labels[name]
+	return ok && val == value
+}
+
+// filterRules reports whether the metric passes the given match rules. An
+// empty set of rules lets every metric pass.
+func filterRules(rules map[string]*dto.MetricFamily, name string, labels map[string]string) bool {
+	if len(rules) == 0 {
 		return true
 	}
-	mf, ok := match[name]
+	mf, ok := rules[name]
 	if !ok {
 		return false
 	}
@@ -139,8 +1893,7 @@ func filter(name string, labels map[string]string) bool {
 
 		labelMatch := true
 		for _, label := range m.Label {
-			val, ok := labels[label.GetName()]
-			if !ok || val != label.GetValue() {
+			if !matchLabel(label.GetName(), label.GetValue(), labels) {
 				labelMatch = false
 				break
 			}
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
 )
 
 func NewWriteRequest() *prompb.WriteRequest {
@@ -55,6 +70,216 @@ func TestSerializeToJSON(t *testing.T) {
 	}
 }
 
+func TestSerializeToJSONLabelsString(t *testing.T) {
+	serializer, err := NewJSONSerializerWithLabelsFormat("string")
+	assert.Nil(t, err)
+
+	data, err := serializer.Marshal(map[string]interface{}{
+		"timestamp": "1970-01-01T00:00:00Z",
+		"value":     "1",
+		"name":      "up",
+		"labels":    map[string]string{"__name__": "up", "job": "node", "instance": `host "a":9100`},
+	})
+	assert.Nil(t, err)
+
+	var metric map[string]interface{}
+	assert.Nil(t, json.Unmarshal(data, &metric))
+	assert.Equal(t, `{instance="host \"a\":9100",job="node"}`, metric["labels"])
+	assert.Equal(t, "up", metric["name"])
+
+	_, err = NewJSONSerializerWithLabelsFormat("list")
+	assert.NotNil(t, err)
+}
+
+func TestSerializeToJSONIndent(t *testing.T) {
+	compact, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	indented, err := parseJSONSerializer("", "2")
+	assert.Nil(t, err)
+
+	metric := map[string]interface{}{
+		"timestamp": "1970-01-01T00:00:00Z",
+		"value":     "456",
+		"name":      "foo",
+		"labels":    map[string]string{"__name__": "foo", "labelfoo": "label-bar"},
+	}
+
+	compactData, err := compact.Marshal(metric)
+	assert.Nil(t, err)
+	indentedData, err := indented.Marshal(metric)
+	assert.Nil(t, err)
+	assert.Contains(t, string(indentedData), "\n  \"labels\": {\n    \"__name__\": \"foo\",")
+
+	again, err := indented.Marshal(metric)
+	assert.Nil(t, err)
+	assert.Equal(t, indentedData, again, "indented output should be byte-stable")
+
+	var fromCompact, fromIndented map[string]interface{}
+	assert.Nil(t, json.Unmarshal(compactData, &fromCompact))
+	assert.Nil(t, json.Unmarshal(indentedData, &fromIndented))
+	assert.Equal(t, fromCompact, fromIndented)
+
+	_, err = parseJSONSerializer("", "-1")
+	assert.NotNil(t, err)
+}
+
+func TestSerializeToJSONEscapeHTML(t *testing.T) {
+	defer func() { jsonEscapeHTML = true }()
+
+	metric := map[string]interface{}{
+		"name":   "foo",
+		"labels": map[string]string{"query": "a<b&c>d"},
+	}
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	array, err := NewJSONArraySerializer()
+	assert.Nil(t, err)
+
+	data, err := serializer.Marshal(metric)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"labels":{"query":"a\u003cb\u0026c\u003ed"},"name":"foo"}`, string(data))
+
+	jsonEscapeHTML = false
+	data, err = serializer.Marshal(metric)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"labels":{"query":"a<b&c>d"},"name":"foo"}`, string(data))
+
+	data, err = array.Marshal(metric)
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"labels":{"query":"a<b&c>d"},"name":"foo"}]`, string(data))
+
+	indented, err := parseJSONSerializer("", "2")
+	assert.Nil(t, err)
+	data, err = indented.Marshal(metric)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n  \"labels\": {\n    \"query\": \"a<b&c>d\"\n  },\n  \"name\": \"foo\"\n}", string(data))
+}
+
+func TestSerializeSeriesIDField(t *testing.T) {
+	seriesIDField = true
+	defer func() { seriesIDField = false }()
+
+	jsonSerializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	avroSerializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	expected := fmt.Sprintf("%016x", fingerprint(map[string]string{"__name__": "foo", "labelfoo": "label-bar"}))
+	for _, s := range []Serializer{jsonSerializer, avroSerializer} {
+		output, err := serializeMessages(s, NewWriteRequest(), serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+		assert.Nil(t, err)
+
+		var ids []string
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				var m map[string]interface{}
+				assert.Nil(t, json.Unmarshal(msg.Value, &m))
+				ids = append(ids, m["series_id"].(string))
+			}
+		}
+		assert.Equal(t, []string{expected, expected}, ids, "%T", s)
+	}
+}
+
+func TestSerializeToJSONLabelsArray(t *testing.T) {
+	provenanceLabel, adapterID = "adapter", "adapter-1"
+	defer func() { provenanceLabel, adapterID = "", "" }()
+
+	serializer, err := NewJSONSerializerWithLabelsFormat("array")
+	assert.Nil(t, err)
+
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{{
+			Labels: []*prompb.Label{
+				{Name: "zone", Value: "b"},
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "node"},
+				{Name: "zone", Value: "a"},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+		}},
+	}
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+	assert.Len(t, output["metrics"], 1)
+
+	var m struct {
+		Name   string
+		Labels []map[string]string
+	}
+	assert.Nil(t, json.Unmarshal(output["metrics"][0].Value, &m))
+	assert.Equal(t, "up", m.Name)
+	assert.Equal(t, []map[string]string{
+		{"name": "zone", "value": "b"},
+		{"name": "__name__", "value": "up"},
+		{"name": "job", "value": "node"},
+		{"name": "zone", "value": "a"},
+		{"name": "adapter", "value": "adapter-1"},
+	}, m.Labels)
+
+	_, err = NewJSONSerializerWithLabelsFormat("list")
+	assert.NotNil(t, err)
+}
+
+func TestSerializeToJSONValueNumber(t *testing.T) {
+	jsonValueNumber = true
+	defer func() { jsonValueNumber = false }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	output, err := serializeMessages(serializer, NewWriteRequest(), serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+
+	values := map[string]interface{}{}
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &m))
+			number, ok := m["value_num"]
+			assert.True(t, ok, "value_num should be present")
+			values[m["value"].(string)] = number
+		}
+	}
+	assert.Equal(t, map[string]interface{}{"456": float64(456), "+Inf": nil}, values)
+
+	array, err := NewJSONArraySerializer()
+	assert.Nil(t, err)
+	data, err := array.Marshal(map[string]interface{}{"value": "0.25"})
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"value":"0.25","value_num":0.25}]`, string(data))
+}
+
+func TestSerializeToJSONExplicitNulls(t *testing.T) {
+	jsonExplicitNulls, omitTimestamp = true, true
+	defer func() { jsonExplicitNulls, omitTimestamp = false, false }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	output, err := serializeMessages(serializer, NewWriteRequest(), serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+	assert.Len(t, output["metrics"], 2)
+
+	for _, msg := range output["metrics"] {
+		var m map[string]interface{}
+		assert.Nil(t, json.Unmarshal(msg.Value, &m))
+		assert.Len(t, m, len(jsonNullableFields))
+		for _, field := range []string{"timestamp", "exemplars", "unit", schemaVersionField} {
+			value, ok := m[field]
+			assert.True(t, ok, "field %s should be present", field)
+			assert.Nil(t, value, "field %s should be null", field)
+		}
+		assert.IsType(t, "", m["value"])
+		assert.Equal(t, "foo", m["name"])
+		assert.IsType(t, map[string]interface{}{}, m["labels"])
+	}
+
+	array, err := NewJSONArraySerializer()
+	assert.Nil(t, err)
+	data, err := array.Marshal(map[string]interface{}{"name": "foo"})
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"_schema_version":null,"exemplars":null,"labels":null,"name":"foo","timestamp":null,"unit":null,"value":null}]`, string(data))
+}
+
 func TestSerializeEmptyTimeseriesToAvroJSON(t *testing.T) {
 	request := &prompb.WriteRequest{}
 	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
@@ -85,6 +310,29 @@ func TestSerializeToAvro(t *testing.T) {
 	}
 }
 
+func TestSerializeToAvroWithTenant(t *testing.T) {
+	serializer, err := NewAvroJSONSerializerWithTenant("schemas/metric-tenant.avsc", "labelfoo")
+	assert.Nil(t, err)
+
+	data, err := serializer.Marshal(map[string]interface{}{
+		"timestamp": "1970-01-01T00:00:00Z",
+		"value":     "1",
+		"name":      "foo",
+		"labels":    map[string]string{"__name__": "foo", "labelfoo": "label-bar"},
+	})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"timestamp":"1970-01-01T00:00:00Z","value":"1","name":"foo","tenant":{"string":"label-bar"},"labels":{"__name__":"foo","labelfoo":"label-bar"}}`, string(data))
+
+	data, err = serializer.Marshal(map[string]interface{}{
+		"timestamp": "1970-01-01T00:00:00Z",
+		"value":     "1",
+		"name":      "foo",
+		"labels":    map[string]string{"__name__": "foo"},
+	})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"timestamp":"1970-01-01T00:00:00Z","value":"1","name":"foo","tenant":null,"labels":{"__name__":"foo"}}`, string(data), "missing tenant label should be null")
+}
+
 func TestTemplatedTopic(t *testing.T) {
 	var err error
 	topicTemplate, err = parseTopicTemplate("{{ index . \"labelfoo\" | replace \"bar\" \"foo\" | substring 6 -1 }}")
@@ -100,6 +348,63 @@ func TestTemplatedTopic(t *testing.T) {
 	}
 }
 
+func TestTopicLowercase(t *testing.T) {
+	topicLowercase = true
+	defer func() { topicLowercase = false }()
+
+	tpl, err := parseTopicTemplate(`Metrics.{{ index . "__name__" }}`)
+	assert.Nil(t, err)
+	cfg := serializeConfig{topicTemplate: tpl}
+
+	assert.Equal(t, "metrics.node_cpu_seconds_total", cfg.topic(map[string]string{"__name__": "Node_CPU_Seconds_Total"}))
+
+	cfg.topicCache = newLRUCache(10)
+	assert.Equal(t, "metrics.up", cfg.topic(map[string]string{"__name__": "UP"}))
+	assert.Equal(t, "metrics.up", cfg.topic(map[string]string{"__name__": "UP"}), "cached topics should be lowercased too")
+}
+
+func TestSerializeFilteredTopic(t *testing.T) {
+	filteredTopic = "metrics-filtered"
+	defer func() { filteredTopic = "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	rules, err := parseMatchList(`['up']`)
+	assert.Nil(t, err)
+	tpl, err := parseTopicTemplate("metrics")
+	assert.Nil(t, err)
+
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+			},
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "go_goroutines"}},
+				Samples: []prompb.Sample{{Value: 12, Timestamp: 0}, {Value: 13, Timestamp: 1000}},
+			},
+		},
+	}
+	stats := &filterStats{}
+	output, err := serializeMessages(serializer, req, serializeConfig{match: rules, topicTemplate: tpl, stats: stats})
+	assert.Nil(t, err)
+	assert.Len(t, output, 2)
+
+	names := func(msgs []Message) []string {
+		var result []string
+		for _, msg := range msgs {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &m))
+			result = append(result, m["name"].(string))
+		}
+		return result
+	}
+	assert.Equal(t, []string{"up"}, names(output["metrics"]))
+	assert.Equal(t, []string{"go_goroutines", "go_goroutines"}, names(output["metrics-filtered"]))
+	assert.Equal(t, "received=2, kept=2, dropped=0", stats.String())
+}
+
 func TestFilter(t *testing.T) {
 	rulesText := `['foo{y="2"}','foo', 'bar{x="1"}',
 'up{x="1",y="2"}', 'baz{key="valu
@@ -132,6 +437,175 @@ e1;value2"}','bar{y="2"}']`
 	}
 }
 
+func TestFilterNumericComparison(t *testing.T) {
+	rules, err := parseMatchList(`['http_requests_total{code>=500}', 'latency{le<1,job="api"}']`)
+	assert.Nil(t, err)
+
+	type TestCase struct {
+		Name   string
+		Labels map[string]string
+		Expect bool
+	}
+
+	testList := []TestCase{
+		{Name: "http_requests_total", Labels: map[string]string{"code": "500"}, Expect: true},
+		{Name: "http_requests_total", Labels: map[string]string{"code": "503"}, Expect: true},
+		{Name: "http_requests_total", Labels: map[string]string{"code": "404"}, Expect: false},
+		{Name: "http_requests_total", Labels: map[string]string{"code": "abc"}, Expect: false},
+		{Name: "http_requests_total", Labels: map[string]string{}, Expect: false},
+		{Name: "latency", Labels: map[string]string{"le": "0.5", "job": "api"}, Expect: true},
+		{Name: "latency", Labels: map[string]string{"le": "1", "job": "api"}, Expect: false},
+		{Name: "latency", Labels: map[string]string{"le": "+Inf", "job": "api"}, Expect: false},
+		{Name: "latency", Labels: map[string]string{"le": "0.5", "job": "web"}, Expect: false},
+	}
+
+	for _, tcase := range testList {
+		assert.Equal(t, tcase.Expect, filterRules(rules, tcase.Name, tcase.Labels), "%s %v", tcase.Name, tcase.Labels)
+	}
+}
+
+func TestFilterRuleExpressions(t *testing.T) {
+	rules, err := parseMatchList(`[
+		'up{job="node"} or up{job="blackbox"}',
+		'http_requests_total{code>=500} and http_requests_total{env="prod"}',
+		'latency{job="api"} and (latency{env="prod"} or latency{env="staging", tier="web"})',
+		'errors{msg="a and (b) or c"}',
+	]`)
+	assert.Nil(t, err)
+
+	type TestCase struct {
+		Name   string
+		Labels map[string]string
+		Expect bool
+	}
+
+	testList := []TestCase{
+		// or across rules
+		{Name: "up", Labels: map[string]string{"job": "node"}, Expect: true},
+		{Name: "up", Labels: map[string]string{"job": "blackbox"}, Expect: true},
+		{Name: "up", Labels: map[string]string{"job": "api"}, Expect: false},
+		// and of rules
+		{Name: "http_requests_total", Labels: map[string]string{"code": "503", "env": "prod"}, Expect: true},
+		{Name: "http_requests_total", Labels: map[string]string{"code": "503", "env": "dev"}, Expect: false},
+		{Name: "http_requests_total", Labels: map[string]string{"code": "200", "env": "prod"}, Expect: false},
+		// and over a group
+		{Name: "latency", Labels: map[string]string{"job": "api", "env": "prod"}, Expect: true},
+		{Name: "latency", Labels: map[string]string{"job": "api", "env": "staging", "tier": "web"}, Expect: true},
+		{Name: "latency", Labels: map[string]string{"job": "api", "env": "staging", "tier": "db"}, Expect: false},
+		{Name: "latency", Labels: map[string]string{"job": "web", "env": "prod"}, Expect: false},
+		// operators within quoted values are left alone
+		{Name: "errors", Labels: map[string]string{"msg": "a and (b) or c"}, Expect: true},
+	}
+
+	for _, tcase := range testList {
+		assert.Equal(t, tcase.Expect, filterRules(rules, tcase.Name, tcase.Labels), "%s %v", tcase.Name, tcase.Labels)
+	}
+
+	assert.Len(t, rules["latency"].Metric, 2, "the rule should be expanded to two conjunctions")
+}
+
+func TestFilterRuleSpaceBeforeBraces(t *testing.T) {
+	rules, err := parseMatchList(`['up {job="node"}', 'down {job="node"} or down  {job="api"}']`)
+	assert.Nil(t, err)
+
+	assert.True(t, filterRules(rules, "up", map[string]string{"job": "node"}))
+	assert.False(t, filterRules(rules, "up", map[string]string{"job": "api"}))
+	assert.True(t, filterRules(rules, "down", map[string]string{"job": "api"}))
+	assert.False(t, filterRules(rules, "down", map[string]string{"job": "web"}))
+}
+
+func TestParseMatchRulesInvalidExpression(t *testing.T) {
+	for _, rule := range []string{
+		`up and`,
+		`or up`,
+		`(up or down`,
+		`up or down)`,
+		`up{job="node"} and down{job="node"}`,
+		`up{job="node"`,
+	} {
+		_, err := parseMatchRules([]string{rule})
+		assert.NotNil(t, err, rule)
+	}
+}
+
+func TestParseMatchRulesInvalidComparison(t *testing.T) {
+	_, err := parseMatchList(`['http_requests_total{code>=5xx}']`)
+	assert.NotNil(t, err)
+}
+
+func TestParseMatchFiles(t *testing.T) {
+	rules, err := parseMatchList(`['up{job="web"}']`)
+	assert.Nil(t, err)
+
+	conflicts, err := parseMatchFiles([]string{"testdata/match-team-a.yaml", " testdata/match-team-b.yaml"}, rules)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`testdata/match-team-b.yaml: duplicate rule http_requests_total{code>=500}`}, conflicts)
+
+	type TestCase struct {
+		Name   string
+		Labels map[string]string
+		Expect bool
+	}
+
+	testList := []TestCase{
+		{Name: "up", Labels: map[string]string{"job": "web"}, Expect: true},
+		{Name: "up", Labels: map[string]string{"job": "node"}, Expect: true},
+		{Name: "up", Labels: map[string]string{"job": "api"}, Expect: true},
+		{Name: "up", Labels: map[string]string{"job": "db"}, Expect: false},
+		{Name: "http_requests_total", Labels: map[string]string{"code": "503"}, Expect: true},
+		{Name: "http_requests_total", Labels: map[string]string{"code": "200"}, Expect: false},
+		{Name: "node_load1", Labels: map[string]string{"instance": "host"}, Expect: true},
+		{Name: "node_load5", Labels: map[string]string{"instance": "host"}, Expect: false},
+	}
+
+	for _, tcase := range testList {
+		assert.Equal(t, tcase.Expect, filterRules(rules, tcase.Name, tcase.Labels), "%s %v", tcase.Name, tcase.Labels)
+	}
+	assert.Len(t, rules["http_requests_total"].Metric, 1, "duplicate rules should be skipped")
+
+	_, err = parseMatchFiles([]string{"testdata/missing.yaml"}, rules)
+	assert.NotNil(t, err)
+}
+
+func TestReloadRules(t *testing.T) {
+	previous := defaultSerializeConfig()
+	defer setRules(previous.match, previous.topicTemplate)
+
+	path := filepath.Join(t.TempDir(), "match.yaml")
+	t.Setenv("MATCH", "")
+	t.Setenv("MATCH_FILES", path)
+	node := map[string]string{"__name__": "up", "job": "node"}
+	api := map[string]string{"__name__": "up", "job": "api"}
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`['up{job="node"}']`), 0600))
+	assert.Nil(t, reloadRules())
+	cfg := defaultSerializeConfig()
+	assert.True(t, cfg.filter("up", node, fingerprint(node)))
+	assert.False(t, cfg.filter("up", api, fingerprint(api)))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`['up{job="api"}']`), 0600))
+	assert.Nil(t, reloadRules())
+	cfg = defaultSerializeConfig()
+	assert.False(t, cfg.filter("up", node, fingerprint(node)))
+	assert.True(t, cfg.filter("up", api, fingerprint(api)))
+	assert.Equal(t, previous.topicTemplate, cfg.topicTemplate)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`['up{job=']`), 0600))
+	assert.NotNil(t, reloadRules())
+	cfg = defaultSerializeConfig()
+	assert.True(t, cfg.filter("up", api, fingerprint(api)), "the rules should be kept on error")
+}
+
+func TestMergeMatchRulesOverlap(t *testing.T) {
+	rules, err := parseMatchList(`['up']`)
+	assert.Nil(t, err)
+	other, err := parseMatchList(`['up{job="node"}']`)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{`rule up{job="node"} overlaps with rule up`}, mergeMatchRules(rules, other))
+	assert.Len(t, rules["up"].Metric, 2)
+}
+
 func BenchmarkSerializeToAvroJSON(b *testing.B) {
 	serializer, _ := NewAvroJSONSerializer("schemas/metric.avsc")
 	writeRequest := NewWriteRequest()
@@ -149,3 +623,1272 @@ func BenchmarkSerializeToJSON(b *testing.B) {
 		Serialize(serializer, writeRequest)
 	}
 }
+
+func TestSerializeComputedFields(t *testing.T) {
+	var err error
+	computedFields, err = parseComputedFields(`{service: '{{ index . "labelfoo" | replace "label-" "" }}'}`)
+	assert.Nil(t, err)
+	defer func() { computedFields = make(map[string]*template.Template) }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := Serialize(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, output)
+
+	for _, metrics := range output {
+		for _, metric := range metrics {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(metric, &m))
+			assert.Equal(t, "bar", m["service"])
+		}
+	}
+}
+
+func TestSerializeSchemaVersion(t *testing.T) {
+	defer func() { schemaVersion = "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	for _, version := range []string{"", "2"} {
+		schemaVersion = version
+
+		output, err := SerializeMessages(serializer, NewWriteRequest())
+		assert.Nil(t, err)
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				var m map[string]interface{}
+				assert.Nil(t, json.Unmarshal(msg.Value, &m))
+				if version == "" {
+					assert.NotContains(t, m, "_schema_version", "version should only be written when enabled")
+				} else {
+					assert.Equal(t, version, m["_schema_version"])
+				}
+				assert.Empty(t, msg.Headers)
+			}
+		}
+	}
+}
+
+func TestSerializeSchemaVersionHeader(t *testing.T) {
+	schemaVersion = "2"
+	schemaVersionHeader = true
+	defer func() { schemaVersion, schemaVersionHeader = "", false }()
+
+	serializer, err := NewAvroJSONSerializer("schemas/metric.avsc")
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.NotContains(t, string(msg.Value), "_schema_version")
+			assert.Len(t, msg.Headers, 3)
+			assert.Equal(t, avroFingerprintHeader, msg.Headers[0].Key)
+			assert.Equal(t, "schema-version", msg.Headers[2].Key)
+			assert.Equal(t, "2", string(msg.Headers[2].Value))
+		}
+	}
+}
+
+func TestParseComputedFieldsReserved(t *testing.T) {
+	_, err := parseComputedFields(`{value: '{{ index . "labelfoo" }}'}`)
+	assert.NotNil(t, err)
+}
+
+func TestSerializeToAvroSeries(t *testing.T) {
+	serializer, err := NewAvroJSONSeriesSerializer("schemas/series.avsc")
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "all samples of a series should be in one message")
+
+	for _, metrics := range output {
+		native, _, err := serializer.codec.NativeFromTextual(metrics[0].Value)
+		assert.Nil(t, err)
+
+		record := native.(map[string]interface{})
+		assert.Equal(t, "foo", record["name"])
+		assert.Equal(t, map[string]interface{}{"__name__": "foo", "labelfoo": "label-bar"}, record["labels"])
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"timestamp": "1970-01-01T00:00:00Z", "value": "456"},
+			map[string]interface{}{"timestamp": "1970-01-01T00:00:10Z", "value": "+Inf"},
+		}, record["samples"])
+	}
+}
+
+func TestInTimeWindow(t *testing.T) {
+	timeWindowStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeWindowEnd = time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	defer func() { timeWindowStart, timeWindowEnd = time.Time{}, time.Time{} }()
+
+	now := time.Now()
+	before := timeWindowStart.Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	inside := timeWindowStart.Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	after := timeWindowEnd.Add(time.Second).UnixNano() / int64(time.Millisecond)
+
+	assert.False(t, inTimeWindow(before, now))
+	assert.True(t, inTimeWindow(inside, now))
+	assert.False(t, inTimeWindow(after, now))
+
+	timeWindowEnd = time.Time{}
+	assert.True(t, inTimeWindow(after, now), "absent end should leave the window open")
+}
+
+func TestInTimeWindowLast(t *testing.T) {
+	timeWindowLast = 10 * time.Minute
+	defer func() { timeWindowLast = 0 }()
+
+	now := time.Now()
+	assert.False(t, inTimeWindow(now.Add(-time.Hour).UnixNano()/int64(time.Millisecond), now))
+	assert.True(t, inTimeWindow(now.Add(-time.Minute).UnixNano()/int64(time.Millisecond), now))
+	assert.True(t, inTimeWindow(now.Add(time.Minute).UnixNano()/int64(time.Millisecond), now))
+}
+
+func TestBoundTimestamp(t *testing.T) {
+	maxSampleAge = 24 * time.Hour
+	maxFutureSkew = time.Minute
+	defer func() { maxSampleAge, maxFutureSkew = 0, 0 }()
+
+	now := time.Now()
+	millis := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+	_, ok := serializeConfig{}.boundTimestamp(millis(now.AddDate(-1, 0, 0)), now)
+	assert.False(t, ok, "a sample 1 year old should be dropped")
+
+	ts, ok := serializeConfig{}.boundTimestamp(millis(now.Add(10*time.Second)), now)
+	assert.True(t, ok, "a sample 10s in the future should be kept")
+	assert.Equal(t, millis(now.Add(10*time.Second)), ts)
+
+	_, ok = serializeConfig{}.boundTimestamp(millis(now.Add(time.Hour)), now)
+	assert.False(t, ok, "a sample 1h in the future should be dropped")
+}
+
+func TestBoundTimestampClamp(t *testing.T) {
+	maxSampleAge = 24 * time.Hour
+	maxFutureSkew = time.Minute
+	clampSampleBounds = true
+	defer func() { maxSampleAge, maxFutureSkew, clampSampleBounds = 0, 0, false }()
+
+	now := time.Now()
+	millis := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+	ts, ok := serializeConfig{}.boundTimestamp(millis(now.AddDate(-1, 0, 0)), now)
+	assert.True(t, ok)
+	assert.Equal(t, millis(now.Add(-24*time.Hour)), ts)
+
+	ts, ok = serializeConfig{}.boundTimestamp(millis(now.Add(time.Hour)), now)
+	assert.True(t, ok)
+	assert.Equal(t, millis(now.Add(time.Minute)), ts)
+}
+
+type failingSerializer struct{}
+
+func (s *failingSerializer) Marshal(metric map[string]interface{}) ([]byte, error) {
+	return nil, errors.New("forced failure")
+}
+
+func TestSerializeSeriesWithoutSamples(t *testing.T) {
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	skipped := &dto.Metric{}
+	assert.Nil(t, seriesWithoutSamples.Write(skipped))
+	before := skipped.GetCounter().GetValue()
+
+	writeRequest := NewWriteRequest()
+	writeRequest.Timeseries = append([]*prompb.TimeSeries{{
+		Labels: []*prompb.Label{{Name: "__name__", Value: "foo"}, {Name: "labelfoo", Value: "label-baz"}},
+	}}, writeRequest.Timeseries...)
+
+	output, err := SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output), "the other series should still be produced")
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.NotContains(t, string(msg.Value), "label-baz")
+		}
+	}
+
+	assert.Nil(t, seriesWithoutSamples.Write(skipped))
+	assert.Equal(t, before+1, skipped.GetCounter().GetValue())
+}
+
+func TestSerializeDropMetricSuffixes(t *testing.T) {
+	dropSuffixes = []string{"_bucket", "_sum", "_count"}
+	defer func() { dropSuffixes = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	dropped := &dto.Metric{}
+	assert.Nil(t, seriesSuffixDropped.Write(dropped))
+	before := dropped.GetCounter().GetValue()
+
+	req := &prompb.WriteRequest{}
+	for _, name := range []string{"http_request_duration_seconds_bucket", "http_request_duration_seconds_sum", "http_request_duration_seconds_count", "http_request_duration_seconds", "up", "_count"} {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: name}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+		})
+	}
+
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+	var names []string
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &m))
+			names = append(names, m["name"].(string))
+		}
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"_count", "http_request_duration_seconds", "up"}, names)
+
+	assert.Nil(t, seriesSuffixDropped.Write(dropped))
+	assert.Equal(t, before+3, dropped.GetCounter().GetValue())
+}
+
+func TestSerializeNameFallbackLabels(t *testing.T) {
+	nameFallbackLabels = []string{"metric", "job"}
+	defer func() { nameFallbackLabels = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	tpl, err := parseTopicTemplate(`metrics.{{ index . "__name__" }}`)
+	assert.Nil(t, err)
+
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			{
+				Labels:  []*prompb.Label{{Name: "job", Value: "node"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+			},
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+			},
+		},
+	}
+
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: tpl})
+	assert.Nil(t, err)
+	assert.Len(t, output["metrics.node"], 1)
+	assert.Len(t, output["metrics.up"], 1)
+
+	var m map[string]interface{}
+	assert.Nil(t, json.Unmarshal(output["metrics.node"][0].Value, &m))
+	assert.Equal(t, "node", m["name"])
+	assert.Equal(t, map[string]interface{}{"__name__": "node", "job": "node"}, m["labels"])
+}
+
+func TestSerializeProvenanceLabel(t *testing.T) {
+	provenanceLabel, adapterID = "adapter", "adapter-1"
+	defer func() { provenanceLabel, adapterID, provenanceConflict = "", "", "rename" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.Contains(t, string(msg.Value), `"adapter":"adapter-1"`)
+		}
+	}
+
+	for policy, expected := range map[string]map[string]string{
+		"rename":    {"adapter": "adapter-1", "exported_adapter": "upstream"},
+		"overwrite": {"adapter": "adapter-1"},
+		"keep":      {"adapter": "upstream"},
+	} {
+		provenanceConflict = policy
+		labels := map[string]string{"__name__": "foo", "adapter": "upstream"}
+		output := provenanceLabels(labels)
+		delete(output, "__name__")
+		assert.Equal(t, expected, output, policy)
+		assert.Equal(t, "upstream", labels["adapter"], "the series labels should not be modified")
+	}
+}
+
+func TestSerializeInstanceHostLabel(t *testing.T) {
+	instanceHostMode = "add"
+	defer func() { instanceHostMode = "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "10.0.0.1:9100"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+	}}}
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output))
+	for _, msgs := range output {
+		var m map[string]interface{}
+		assert.Nil(t, json.Unmarshal(msgs[0].Value, &m))
+		assert.Equal(t, map[string]interface{}{"__name__": "up", "instance": "10.0.0.1:9100", "instance_host": "10.0.0.1"}, m["labels"])
+	}
+
+	for instance, host := range map[string]string{
+		"10.0.0.1:9100":      "10.0.0.1",
+		"node-1.local:9100":  "node-1.local",
+		"[2001:db8::1]:9100": "2001:db8::1",
+		"node-1":             "node-1",
+		"[2001:db8::1]":      "2001:db8::1",
+	} {
+		assert.Equal(t, host, instanceHost(instance), instance)
+	}
+
+	instanceHostMode = "replace"
+	labels := map[string]string{"__name__": "up", "instance": "10.0.0.1:9100"}
+	assert.Equal(t, map[string]string{"__name__": "up", "instance_host": "10.0.0.1"}, instanceHostLabels(labels))
+	assert.Equal(t, "10.0.0.1:9100", labels["instance"], "the series labels should not be modified")
+
+	existing := map[string]string{"instance": "10.0.0.1:9100", "instance_host": "node-1"}
+	assert.Equal(t, existing, instanceHostLabels(existing), "an existing instance_host label should be kept")
+}
+
+func TestSerializeLabelValueTruncation(t *testing.T) {
+	labelValueMaxLength = 6
+	defer func() { labelValueMaxLength, labelValueOverflow, labelTruncationSuffix = 0, "truncate", "…" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.Contains(t, string(msg.Value), `"labelfoo":"label…"`, "label-bar should be truncated with the marker")
+		}
+	}
+
+	labels := map[string]string{"__name__": "a_long_metric_name", "short": "ok", "query": "a=1&b=2"}
+	assert.Equal(t, map[string]string{"__name__": "a_long_metric_name", "short": "ok", "query": "a=1&b…"}, serializeConfig{}.limitLabelValues(labels))
+	assert.Equal(t, "a=1&b=2", labels["query"], "the series labels should not be modified")
+
+	labelTruncationSuffix = "..."
+	assert.Equal(t, "a=1...", serializeConfig{}.limitLabelValues(labels)["query"])
+
+	labelValueOverflow = "drop-label"
+	assert.Equal(t, map[string]string{"__name__": "a_long_metric_name", "short": "ok"}, serializeConfig{}.limitLabelValues(labels))
+}
+
+func TestSerializeStaleTombstone(t *testing.T) {
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	cfg := serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate}
+
+	req := NewWriteRequest()
+	req.Timeseries[0].Samples = []prompb.Sample{{Timestamp: 0, Value: 456}, {Timestamp: 15000, Value: math.Float64frombits(staleMarkerBits)}}
+
+	output, err := serializeMessages(serializer, req, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+	for _, msgs := range output {
+		assert.Contains(t, string(msgs[1].Value), `"value":"NaN"`, "markers should be samples without the mode")
+	}
+
+	staleTombstones = true
+	defer func() { staleTombstones = false }()
+
+	req.Timeseries[0].Samples = append(req.Timeseries[0].Samples, prompb.Sample{Timestamp: 20000, Value: math.NaN()})
+	output, err = serializeMessages(serializer, req, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, countMessages(output))
+	for _, msgs := range output {
+		assert.NotNil(t, msgs[0].Value)
+		assert.Nil(t, msgs[1].Value, "the marker should be a tombstone")
+		assert.Equal(t, `foo{labelfoo="label-bar"}`, string(msgs[1].Key))
+		assert.Contains(t, string(msgs[2].Value), `"value":"NaN"`, "other NaN values should be kept")
+	}
+}
+
+func TestSerializeBatchGroupByKey(t *testing.T) {
+	keySource, batchGroupByKey = "series", true
+	defer func() { keySource, batchGroupByKey = "", false }()
+
+	serializer, err := NewJSONArraySerializer()
+	assert.Nil(t, err)
+
+	req := NewWriteRequest()
+	req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}, {Name: "labelfoo", Value: "label-baz"}},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+	})
+
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output), "there should be a batch per key")
+
+	counts := make(map[string]int)
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			var metrics []map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &metrics))
+			for _, metric := range metrics {
+				labels := metric["labels"].(map[string]interface{})
+				assert.Equal(t, string(msg.Key), fmt.Sprintf(`foo{labelfoo="%s"}`, labels["labelfoo"]), "a batch should only hold the samples of its key")
+			}
+			counts[string(msg.Key)] = len(metrics)
+		}
+	}
+	assert.Equal(t, map[string]int{`foo{labelfoo="label-bar"}`: 2, `foo{labelfoo="label-baz"}`: 1}, counts)
+}
+
+func TestSerializeBatchPartitionPriority(t *testing.T) {
+	rules, err := parseMatchList(`['slo_errors']`)
+	assert.Nil(t, err)
+	priorityRules, partitioner, sampleRecordTimestamp = rules, seriesPartitioner{partitions: partitionRange{first: 0, last: 1}}, true
+	defer func() { priorityRules, partitioner, sampleRecordTimestamp = nil, defaultPartitioner{}, false }()
+
+	serializer, err := NewJSONArraySerializer()
+	assert.Nil(t, err)
+	tpl, err := parseTopicTemplate("metrics")
+	assert.Nil(t, err)
+
+	req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "slo_errors"}}, Samples: []prompb.Sample{{Timestamp: 2000, Value: 1}, {Timestamp: 1000, Value: 2}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "bulk"}}, Samples: []prompb.Sample{{Timestamp: 3000, Value: 1}}},
+	}}
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: tpl})
+	assert.Nil(t, err)
+	assert.Len(t, output["metrics"], 2, "the priorities should be batched apart")
+
+	for _, msg := range output["metrics"] {
+		var metrics []map[string]interface{}
+		assert.Nil(t, json.Unmarshal(msg.Value, &metrics))
+		name := metrics[0]["name"].(string)
+		labels := map[string]string{"__name__": name}
+		assert.Equal(t, partitioner.Partition("metrics", labels, fingerprint(labels)), msg.Partition, name)
+		assert.Equal(t, name == "slo_errors", msg.HighPriority, name)
+		if name == "slo_errors" {
+			assert.Equal(t, time.Unix(1, 0).UTC(), msg.Timestamp, "a batch should take the timestamp of its oldest sample")
+		}
+	}
+}
+
+func TestSerializeError(t *testing.T) {
+	output, err := SerializeMessages(&failingSerializer{}, NewWriteRequest())
+	assert.Equal(t, 0, countMessages(output), "failed samples should not be produced")
+
+	var serializeErr *SerializeError
+	assert.True(t, errors.As(err, &serializeErr))
+
+	labels := map[string]string{"__name__": "foo", "labelfoo": "label-bar"}
+	assert.Equal(t, topic(labels), serializeErr.Topic)
+	assert.Equal(t, fingerprint(labels), serializeErr.Fingerprint)
+	assert.EqualError(t, serializeErr.Err, "forced failure")
+}
+
+func TestSortedByTopic(t *testing.T) {
+	messages := map[string][]Message{
+		"metrics.c": {{Value: []byte("c")}},
+		"metrics.a": {{Value: []byte("a1")}, {Value: []byte("a2")}},
+		"metrics.b": {{Value: []byte("b")}},
+	}
+
+	for run := 0; run < 10; run++ {
+		sorted := SortedByTopic(messages)
+		assert.Len(t, sorted, 3)
+		assert.Equal(t, "metrics.a", sorted[0].Topic)
+		assert.Equal(t, "metrics.b", sorted[1].Topic)
+		assert.Equal(t, "metrics.c", sorted[2].Topic)
+		assert.Len(t, sorted[0].Messages, 2)
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	keySource = "series"
+	defer func() { keySource = "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	writeRequest := NewWriteRequest()
+	writeRequest.Timeseries = append(writeRequest.Timeseries, &prompb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: "foo"},
+			{Name: "labelfoo", Value: "label-baz"},
+		},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}},
+	})
+
+	output, err := SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+
+	var keys []string
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			keys = append(keys, string(msg.Key))
+		}
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{`foo{labelfoo="label-bar"}`, `foo{labelfoo="label-bar"}`, `foo{labelfoo="label-baz"}`}, keys)
+}
+
+func TestSeriesTimestampKey(t *testing.T) {
+	keySource = "series-timestamp"
+	defer func() { keySource = "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	writeRequest := NewWriteRequest()
+	writeRequest.Timeseries[0].Samples = []prompb.Sample{
+		{Timestamp: 10000, Value: 1},
+		{Timestamp: 9000, Value: 2},
+	}
+
+	output, err := SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+
+	var keys []string
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			keys = append(keys, string(msg.Key))
+		}
+	}
+	sort.Strings(keys)
+
+	fp := fingerprint(map[string]string{"__name__": "foo", "labelfoo": "label-bar"})
+	assert.Equal(t, []string{
+		fmt.Sprintf("%016x-0000000009000", fp),
+		fmt.Sprintf("%016x-0000000010000", fp),
+	}, keys, "keys of a series should sort by timestamp")
+}
+
+func TestMetricNameKey(t *testing.T) {
+	keySource = "metric_name"
+	defer func() { keySource = "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.Equal(t, "foo", string(msg.Key))
+		}
+	}
+}
+
+func TestStripInternalLabels(t *testing.T) {
+	stripInternalLabels = true
+	keySource = "series"
+	defer func() { stripInternalLabels, stripNameLabel, keySource = false, false, "" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	writeRequest := NewWriteRequest()
+	writeRequest.Timeseries[0].Labels = append(writeRequest.Timeseries[0].Labels, &prompb.Label{Name: "__tmp_shard", Value: "1"})
+
+	for _, stripName := range []bool{false, true} {
+		stripNameLabel = stripName
+
+		output, err := SerializeMessages(serializer, writeRequest)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, countMessages(output))
+
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				var metric struct {
+					Name   string            `json:"name"`
+					Labels map[string]string `json:"labels"`
+				}
+				assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+				assert.Equal(t, "foo", metric.Name)
+				assert.NotContains(t, metric.Labels, "__tmp_shard")
+				assert.Equal(t, "label-bar", metric.Labels["labelfoo"])
+				if stripName {
+					assert.NotContains(t, metric.Labels, "__name__")
+				} else {
+					assert.Equal(t, "foo", metric.Labels["__name__"])
+				}
+				assert.Equal(t, `foo{__tmp_shard="1",labelfoo="label-bar"}`, string(msg.Key), "key should be computed before the strip")
+			}
+		}
+	}
+}
+
+func TestEmptyLabelPolicyDropLabel(t *testing.T) {
+	emptyLabelPolicy = "drop-label"
+	defer func() { emptyLabelPolicy = "keep" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	writeRequest := NewWriteRequest()
+	writeRequest.Timeseries[0].Labels = append(writeRequest.Timeseries[0].Labels, &prompb.Label{Name: "empty", Value: ""})
+
+	output, err := SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output), "the series should be kept")
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.NotContains(t, string(msg.Value), `"empty"`)
+			assert.Contains(t, string(msg.Value), `"labelfoo":"label-bar"`)
+		}
+	}
+}
+
+func TestEmptyLabelPolicyDropSeries(t *testing.T) {
+	emptyLabelPolicy = "drop-series"
+	defer func() {
+		emptyLabelPolicy = "keep"
+		requiredLabels = nil
+	}()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	writeRequest := NewWriteRequest()
+	writeRequest.Timeseries[0].Labels = append(writeRequest.Timeseries[0].Labels, &prompb.Label{Name: "empty", Value: ""})
+
+	output, err := SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countMessages(output), "series with an empty label should be dropped")
+
+	requiredLabels = []string{"labelfoo"}
+	output, err = SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output), "series with the required labels set should be kept")
+
+	requiredLabels = []string{"empty"}
+	output, err = SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countMessages(output), "series with an empty required label should be dropped")
+}
+
+func TestSortSamples(t *testing.T) {
+	sortSamples = true
+	defer func() { sortSamples = false }()
+
+	serializer, err := NewLineProtocolSerializer("")
+	assert.Nil(t, err)
+
+	writeRequest := NewWriteRequest()
+	writeRequest.Timeseries[0].Samples = []prompb.Sample{
+		{Timestamp: 30000, Value: 3},
+		{Timestamp: 10000, Value: 1},
+		{Timestamp: 40000, Value: 4},
+		{Timestamp: 20000, Value: 2},
+	}
+
+	output, err := SerializeMessages(serializer, writeRequest)
+	assert.Nil(t, err)
+
+	for _, msgs := range output {
+		var values []string
+		for _, msg := range msgs {
+			fields := strings.Fields(string(msg.Value))
+			values = append(values, fields[1])
+		}
+		assert.Equal(t, []string{"value=1", "value=2", "value=3", "value=4"}, values)
+	}
+	assert.Equal(t, int64(30000), writeRequest.Timeseries[0].Samples[0].Timestamp, "the request shouldn't be modified")
+}
+
+func TestLabelTimestamp(t *testing.T) {
+	timestampLabel = "event_time"
+	defer func() { timestampLabel = "" }()
+
+	parsed, ok := serializeConfig{}.labelTimestamp(map[string]string{"event_time": "2026-01-02T03:04:05Z"})
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), parsed)
+
+	parsed, ok = serializeConfig{}.labelTimestamp(map[string]string{"event_time": "1767323045.5"})
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 500000000, time.UTC), parsed)
+
+	_, ok = serializeConfig{}.labelTimestamp(map[string]string{"instance": "a"})
+	assert.False(t, ok, "series without the label should keep the sample timestamp")
+
+	for _, value := range []string{"yesterday", "NaN", ""} {
+		_, ok = serializeConfig{}.labelTimestamp(map[string]string{"event_time": value})
+		assert.False(t, ok, "invalid value %q should keep the sample timestamp", value)
+	}
+}
+
+func TestSerializeTimestampLabel(t *testing.T) {
+	timestampLabel = "event_time"
+	timestampLabelRecord = true
+	defer func() {
+		timestampLabel = ""
+		timestampLabelRecord = false
+	}()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	for value, expected := range map[string]time.Time{
+		"2026-01-02T03:04:05Z": time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		"bad-value":            {},
+	} {
+		writeRequest := NewWriteRequest()
+		writeRequest.Timeseries[0].Labels = append(writeRequest.Timeseries[0].Labels, &prompb.Label{Name: "event_time", Value: value})
+
+		output, err := SerializeMessages(serializer, writeRequest)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, countMessages(output))
+
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				var metric map[string]interface{}
+				assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+				if expected.IsZero() {
+					assert.Contains(t, metric["timestamp"], "1970-01-01T", "invalid label should fall back to the sample timestamp")
+				} else {
+					assert.Equal(t, "2026-01-02T03:04:05Z", metric["timestamp"])
+				}
+				assert.Equal(t, expected, msg.Timestamp)
+			}
+		}
+	}
+}
+
+func TestSerializeToLineProtocol(t *testing.T) {
+	serializer, err := NewLineProtocolSerializer("")
+	assert.Nil(t, err)
+
+	output, err := Serialize(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+
+	var lines []string
+	for _, metrics := range output {
+		for _, metric := range metrics {
+			lines = append(lines, string(metric))
+		}
+	}
+	assert.Equal(t, []string{"foo,labelfoo=label-bar value=456 0"}, lines, "non-finite sample should be dropped")
+}
+
+func TestSerializeToLineProtocolEscaping(t *testing.T) {
+	serializer, err := NewLineProtocolSerializer("")
+	assert.Nil(t, err)
+
+	line, err := serializer.Marshal(map[string]interface{}{
+		"timestamp": "1970-01-01T00:00:10Z",
+		"value":     "1.5",
+		"name":      "foo bar,baz",
+		"labels": map[string]string{
+			"__name__": "foo bar,baz",
+			"a b":      "x=y,z",
+			"empty":    "",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `foo\ bar\,baz,a\ b=x\=y\,z value=1.5 10000000000`, string(line))
+}
+
+func TestSerializeToLineProtocolNonFiniteSentinel(t *testing.T) {
+	serializer, err := NewLineProtocolSerializer("-1")
+	assert.Nil(t, err)
+
+	line, err := serializer.Marshal(map[string]interface{}{
+		"timestamp": "1970-01-01T00:00:10Z",
+		"value":     "+Inf",
+		"name":      "foo",
+		"labels":    map[string]string{"__name__": "foo"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "foo value=-1 10000000000", string(line))
+
+	_, err = NewLineProtocolSerializer("not-a-number")
+	assert.NotNil(t, err)
+}
+
+func TestSerializeToGraphite(t *testing.T) {
+	serializer, err := NewGraphiteSerializer("")
+	assert.Nil(t, err)
+
+	output, err := Serialize(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+
+	var lines []string
+	for _, metrics := range output {
+		for _, metric := range metrics {
+			lines = append(lines, string(metric))
+		}
+	}
+	assert.Equal(t, []string{"foo;labelfoo=label-bar 456 0"}, lines, "non-finite sample should be dropped")
+}
+
+func TestSerializeToGraphiteTags(t *testing.T) {
+	serializer, err := NewGraphiteSerializer("")
+	assert.Nil(t, err)
+
+	line, err := serializer.Marshal(map[string]interface{}{
+		"timestamp": "1970-01-01T00:00:10Z",
+		"value":     "1.5",
+		"name":      "app.requests total",
+		"labels": map[string]string{
+			"__name__": "app.requests total",
+			"job":      "api",
+			"a b=c":    "x;y z",
+			"path":     "~/home",
+			"empty":    "",
+			"host":     "10.0.0.1:9100",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `app.requests_total;a_b_c=x_y_z;host=10.0.0.1:9100;job=api;path=/home 1.5 10`, string(line))
+
+	line, err = serializer.Marshal(map[string]interface{}{
+		"value":  "2",
+		"name":   "up",
+		"labels": map[string]string{"__name__": "up"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "up 2 -1", string(line), "a missing timestamp should be left to carbon")
+}
+
+func TestSerializeToGraphiteNonFiniteSentinel(t *testing.T) {
+	serializer, err := NewGraphiteSerializer("-1")
+	assert.Nil(t, err)
+
+	for _, value := range []string{"+Inf", "-Inf", "NaN"} {
+		line, err := serializer.Marshal(map[string]interface{}{
+			"timestamp": "1970-01-01T00:00:10Z",
+			"value":     value,
+			"name":      "foo",
+			"labels":    map[string]string{"__name__": "foo"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "foo -1 10", string(line), value)
+	}
+
+	_, err = NewGraphiteSerializer("not-a-number")
+	assert.NotNil(t, err)
+}
+
+func TestFormatValueRound(t *testing.T) {
+	assert.Equal(t, "3.14159", formatValue(3.14159))
+
+	valueRound = 2
+	defer func() { valueRound = -1 }()
+
+	assert.Equal(t, "3.14", formatValue(3.14159))
+	assert.Equal(t, "2.5", formatValue(2.499))
+	assert.Equal(t, "456", formatValue(456))
+	assert.Equal(t, "+Inf", formatValue(math.Inf(1)))
+	assert.Equal(t, "NaN", formatValue(math.NaN()))
+}
+
+func TestInfPolicy(t *testing.T) {
+	defer func() { infPolicy = "text" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	for policy, expected := range map[string][]string{
+		"text":  {"+Inf", "456"},
+		"clamp": {strconv.FormatFloat(math.MaxFloat64, 'f', -1, 64), "456"},
+		"drop":  {"456"},
+	} {
+		infPolicy = policy
+
+		output, err := SerializeMessages(serializer, NewWriteRequest())
+		assert.Nil(t, err)
+
+		var values []string
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				var metric map[string]interface{}
+				assert.Nil(t, json.Unmarshal(msg.Value, &metric))
+				values = append(values, metric["value"].(string))
+			}
+		}
+		sort.Strings(values)
+		assert.Equal(t, expected, values, policy)
+	}
+}
+
+func TestBaseName(t *testing.T) {
+	assert.Equal(t, "http_requests", baseName("http_requests_total"))
+	assert.Equal(t, "request_duration_seconds", baseName("request_duration_seconds_bucket"))
+	assert.Equal(t, "request_duration_seconds", baseName("request_duration_seconds_sum"))
+	assert.Equal(t, "request_duration_seconds", baseName("request_duration_seconds_count"))
+	assert.Equal(t, "up", baseName("up"))
+	assert.Equal(t, "_total", baseName("_total"))
+}
+
+func TestBaseNameTemplate(t *testing.T) {
+	tpl, err := parseTopicTemplate(`metrics.{{ index . "__name__" | baseName }}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "metrics.http_requests", executeTemplate(tpl, map[string]string{"__name__": "http_requests_total"}))
+}
+
+func TestShardTemplate(t *testing.T) {
+	tpl, err := parseTopicTemplate(`metrics_shard_{{ mod (fingerprint .) 16 }}`)
+	assert.Nil(t, err)
+
+	labels := map[string]string{"__name__": "up", "instance": "host:9100"}
+	topic := executeTemplate(tpl, labels)
+	assert.Equal(t, fmt.Sprintf("metrics_shard_%d", fingerprint(labels)%16), topic)
+	assert.Equal(t, topic, executeTemplate(tpl, map[string]string{"instance": "host:9100", "__name__": "up"}), "a series should always map to the same shard")
+
+	shards := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		shards[executeTemplate(tpl, map[string]string{"__name__": "up", "instance": fmt.Sprint(i)})] = true
+	}
+	assert.True(t, len(shards) > 1 && len(shards) <= 16)
+
+	tpl, err = parseTopicTemplate(`metrics_shard_{{ mod (fingerprint .) 0 }}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "", executeTemplate(tpl, labels), "a zero modulus should fail")
+}
+
+func TestSerializeToJSONArray(t *testing.T) {
+	serializer, err := NewJSONArraySerializer()
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "all samples of a topic should be in one message")
+
+	for _, msgs := range output {
+		var metrics []map[string]interface{}
+		assert.Nil(t, json.Unmarshal(msgs[0].Value, &metrics))
+		assert.Len(t, metrics, 2)
+		assert.Equal(t, "456", metrics[0]["value"])
+		assert.Equal(t, "+Inf", metrics[1]["value"])
+	}
+
+	data, err := serializer.MarshalBatch([]map[string]interface{}{{"value": "456", "timestamp": "1970-01-01T00:00:00Z", "name": "foo", "labels": map[string]string{"__name__": "foo"}}})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `[{"value":"456","timestamp":"1970-01-01T00:00:00Z","name":"foo","labels":{"__name__":"foo"}}]`, string(data))
+}
+
+func TestSerializeToJSONBulk(t *testing.T) {
+	serializer, err := parseJSONBulkSerializer(`metrics.{{ index . "cluster" }}`)
+	assert.Nil(t, err)
+
+	writeRequest := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: "eu"}, {Name: "job", Value: "node"}},
+			Samples: []prompb.Sample{{Timestamp: 0, Value: 1}, {Timestamp: 1000, Value: 0}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "cluster", Value: "eu"}, {Name: "job", Value: "api"}},
+			Samples: []prompb.Sample{{Timestamp: 0, Value: 42}},
+		},
+	}}
+
+	output, err := serializeMessages(serializer, writeRequest, serializeConfig{topicTemplate: serializer.topicTemplate})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "all samples of the request should be in one message")
+	assert.Len(t, output["metrics.eu"], 1, "the topic should be resolved from the labels shared by all series")
+
+	var metrics []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(output["metrics.eu"][0].Value, &metrics))
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, "up", metrics[0]["name"])
+	assert.Equal(t, "http_requests_total", metrics[2]["name"])
+
+	output, err = serializeMessages(serializer, &prompb.WriteRequest{}, serializeConfig{topicTemplate: serializer.topicTemplate})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countMessages(output), "an empty request should produce no message")
+}
+
+func TestSetRulesConcurrentFilter(t *testing.T) {
+	previousMatch, previousTemplate := match, defaultSerializeConfig().topicTemplate
+	defer setRules(previousMatch, previousTemplate)
+
+	fooRules, err := parseMatchList(`['foo']`)
+	assert.Nil(t, err)
+	barRules, err := parseMatchList(`['bar']`)
+	assert.Nil(t, err)
+	fooTemplate, err := parseTopicTemplate("metrics.foo")
+	assert.Nil(t, err)
+	barTemplate, err := parseTopicTemplate("metrics.bar")
+	assert.Nil(t, err)
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					filter("foo", map[string]string{"__name__": "foo"})
+					Serialize(serializer, NewWriteRequest())
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			setRules(fooRules, fooTemplate)
+		} else {
+			setRules(barRules, barTemplate)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	assert.False(t, filter("foo", map[string]string{"__name__": "foo"}))
+	assert.Equal(t, "metrics.bar", topic(map[string]string{"__name__": "foo"}))
+}
+
+func TestSerializeToParquet(t *testing.T) {
+	serializer, err := NewParquetSerializer([]string{"labelfoo", "job"}, 10, 0)
+	assert.Nil(t, err)
+
+	output, err := SerializeMessages(serializer, NewWriteRequest())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countMessages(output), "all the samples of the topic should be written in a single message")
+
+	for _, msgs := range output {
+		file, err := buffer.NewBufferFile(msgs[0].Value)
+		assert.Nil(t, err)
+		pr, err := reader.NewParquetColumnReader(file, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2), pr.GetNumRows())
+
+		values, _, _, err := pr.ReadColumnByIndex(0, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{float64(456), math.Inf(1)}, values)
+
+		timestamps, _, _, err := pr.ReadColumnByIndex(1, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{int64(0), int64(10000)}, timestamps)
+
+		names, _, _, err := pr.ReadColumnByIndex(2, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{"foo", "foo"}, names)
+
+		labels, _, _, err := pr.ReadColumnByIndex(3, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{"label-bar", "label-bar"}, labels)
+
+		jobs, _, _, err := pr.ReadColumnByIndex(4, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{nil, nil}, jobs, "missing labels should be null")
+		pr.ReadStop()
+	}
+}
+
+func TestParquetSplit(t *testing.T) {
+	serializer, err := NewParquetSerializer(nil, 2, 0)
+	assert.Nil(t, err)
+
+	metrics := make([]map[string]interface{}, 5)
+	for i := range metrics {
+		metrics[i] = map[string]interface{}{"name": "up"}
+	}
+	chunks := serializer.Split(metrics)
+	assert.Len(t, chunks, 3)
+	assert.Len(t, chunks[2], 1)
+
+	serializer, err = NewParquetSerializer(nil, 10, 40)
+	assert.Nil(t, err)
+	assert.Len(t, serializer.Split(metrics), 3, "each 18 bytes row should fill a 40 bytes batch with 2 rows")
+
+	_, err = NewParquetSerializer([]string{"value"}, 10, 0)
+	assert.NotNil(t, err)
+}
+
+func TestSerializeFallback(t *testing.T) {
+	defer func(format string, previous Serializer) {
+		fallbackFormat, fallbackSerializer = format, previous
+	}(fallbackFormat, fallbackSerializer)
+
+	// the timestamp and value of the schema don't match the samples
+	serializer, err := NewAvroJSONSerializer("testdata/metric-incompatible.avsc")
+	assert.Nil(t, err)
+	fallbackFormat = "json"
+	fallbackSerializer, err = parseFallbackSerializer(fallbackFormat)
+	assert.Nil(t, err)
+
+	fallback := &dto.Metric{}
+	assert.Nil(t, serializeFallback.Write(fallback))
+	before := fallback.GetCounter().GetValue()
+
+	output, err := serializeMessages(serializer, NewWriteRequest(), serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &m))
+			assert.Equal(t, "foo", m["name"])
+			assert.Equal(t, []kafka.Header{{Key: fallbackHeaderKey, Value: []byte("json")}}, msg.Headers)
+		}
+	}
+
+	assert.Nil(t, serializeFallback.Write(fallback))
+	assert.Equal(t, before+2, fallback.GetCounter().GetValue())
+}
+
+func TestParseFallbackSerializer(t *testing.T) {
+	_, err := parseFallbackSerializer("avro-json-series")
+	assert.NotNil(t, err)
+
+	s, err := parseFallbackSerializer("line-protocol")
+	assert.Nil(t, err)
+	assert.IsType(t, &LineProtocolSerializer{}, s)
+}
+
+func TestTopicLookup(t *testing.T) {
+	defer func() { topicLookupLabel, topicLookup, topicLookupDefault = "", nil, "" }()
+
+	lookup, err := parseTopicLookup(`{payments: metrics.payments, search: metrics.search}`)
+	assert.Nil(t, err)
+	topicLookupLabel, topicLookup = "team", lookup
+
+	series := func(team string) *prompb.TimeSeries {
+		return &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "team", Value: team}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+		}
+	}
+	req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{series("payments"), series("search"), series("storage")}}
+	tpl, err := parseTopicTemplate("metrics")
+	assert.Nil(t, err)
+
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: tpl})
+	assert.Nil(t, err)
+	assert.Len(t, output["metrics.payments"], 1)
+	assert.Len(t, output["metrics.search"], 1)
+	assert.Len(t, output["metrics"], 1, "unmapped values should use the topic template")
+
+	topicLookupDefault = "metrics.unrouted"
+	output, err = serializeMessages(serializer, req, serializeConfig{topicTemplate: tpl})
+	assert.Nil(t, err)
+	assert.Len(t, output["metrics.payments"], 1)
+	assert.Len(t, output["metrics.search"], 1)
+	assert.Len(t, output["metrics.unrouted"], 1)
+	assert.Len(t, output, 3)
+
+	_, err = parseTopicLookup(`{payments: ''}`)
+	assert.NotNil(t, err)
+}
+
+func TestOmitTimestamp(t *testing.T) {
+	defer func() { omitTimestamp = false }()
+	omitTimestamp = true
+	cfg := serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate}
+
+	jsonSerializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	avroSerializer, err := NewAvroJSONSerializer(avroSchemaPath("metric"))
+	assert.Nil(t, err)
+	tenantSerializer, err := NewAvroJSONSerializerWithTenant(avroSchemaPath("metric-tenant"), "labelfoo")
+	assert.Nil(t, err)
+	seriesSerializer, err := NewAvroJSONSeriesSerializer(avroSchemaPath("series"))
+	assert.Nil(t, err)
+
+	for _, s := range []Serializer{jsonSerializer, avroSerializer, tenantSerializer, seriesSerializer} {
+		output, err := serializeMessages(s, NewWriteRequest(), cfg)
+		assert.Nil(t, err)
+		assert.NotZero(t, countMessages(output))
+		for _, msgs := range output {
+			for _, msg := range msgs {
+				var m map[string]interface{}
+				assert.Nil(t, json.Unmarshal(msg.Value, &m))
+				assert.NotContains(t, m, "timestamp", "%T shouldn't write the timestamp", s)
+				assert.Equal(t, "foo", m["name"])
+				if samples, ok := m["samples"].([]interface{}); ok {
+					for _, sample := range samples {
+						assert.NotContains(t, sample, "timestamp")
+						assert.Contains(t, sample, "value")
+					}
+				} else {
+					assert.Contains(t, m, "value")
+				}
+			}
+		}
+	}
+
+	lineSerializer, err := NewLineProtocolSerializer("")
+	assert.Nil(t, err)
+	output, err := Serialize(lineSerializer, NewWriteRequest())
+	assert.Nil(t, err)
+	for _, values := range output {
+		assert.Equal(t, [][]byte{[]byte("foo,labelfoo=label-bar value=456")}, values)
+	}
+}
+
+func TestParseTopicTemplateErrors(t *testing.T) {
+	for tpl, location := range map[string]string{
+		`metrics.{{ index . "__name__" | lower }}`:     `topic:1: function "lower" not defined`,
+		`metrics.{{ index . "__name__" }`:              `topic:1: unexpected "}" in operand`,
+		"metrics.\n{{ if .job }}{{ index . \"job\" }}": `topic:2: unexpected EOF`,
+	} {
+		_, err := parseTopicTemplate(tpl)
+		if assert.NotNil(t, err, tpl) {
+			assert.Contains(t, err.Error(), strconv.Quote(tpl), "the error should quote the template")
+			assert.Contains(t, err.Error(), location, "the error should tell where the template is invalid")
+		}
+	}
+}
+
+func TestSerializeMetricNameValidation(t *testing.T) {
+	defer func() { metricNameValidation = "off" }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	tpl, err := parseTopicTemplate("metrics")
+	assert.Nil(t, err)
+
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "http_requests:rate5m"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+			},
+			{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: "5xx.http-requests"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+			},
+		},
+	}
+	names := func(output map[string][]Message) []string {
+		var names []string
+		for _, msg := range output["metrics"] {
+			var m map[string]interface{}
+			assert.Nil(t, json.Unmarshal(msg.Value, &m))
+			names = append(names, m["name"].(string))
+		}
+		return names
+	}
+
+	metricNameValidation = "drop"
+	before := &dto.Metric{}
+	seriesInvalidName.Write(before)
+	output, err := serializeMessages(serializer, req, serializeConfig{topicTemplate: tpl})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http_requests:rate5m"}, names(output))
+	after := &dto.Metric{}
+	seriesInvalidName.Write(after)
+	assert.Equal(t, float64(1), after.GetCounter().GetValue()-before.GetCounter().GetValue())
+
+	metricNameValidation = "sanitize"
+	output, err = serializeMessages(serializer, req, serializeConfig{topicTemplate: tpl})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http_requests:rate5m", "_5xx_http_requests"}, names(output))
+	for _, name := range names(output) {
+		assert.True(t, validMetricName(name))
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// signatureHeaderKey is the kafka header carrying the HMAC-SHA256 of the
+// message value with SIGNING_KEY, hex encoded.
+const signatureHeaderKey = "hmac-sha256"
+
+// signingKey is the key messages are signed with, nil when disabled.
+var signingKey []byte
+
+// sign returns the HMAC-SHA256 of the value with the key, hex encoded.
+func sign(key, value []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(value)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature reports whether the signature is the HMAC-SHA256 of the
+// value with the key.
+func verifySignature(key, value []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(value)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// signatureHeader returns the signature header of the message value.
+func signatureHeader(value []byte) kafka.Header {
+	return kafka.Header{Key: signatureHeaderKey, Value: []byte(sign(signingKey, value))}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// verify checks the signature header of the message the way a consumer
+// would, following the README recipe.
+func verify(key []byte, msg Message) bool {
+	var signature []byte
+	for _, h := range msg.Headers {
+		if h.Key == signatureHeaderKey {
+			signature = h.Value
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg.Value)
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), signature)
+}
+
+func TestSignedMessages(t *testing.T) {
+	defer func() { signingKey = nil }()
+	signingKey = []byte("signing-secret")
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+	output, err := serializeMessages(serializer, NewWriteRequest(), serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, countMessages(output))
+
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			assert.True(t, verify(signingKey, msg), "the signature should verify")
+			assert.False(t, verify([]byte("other-secret"), msg), "the signature shouldn't verify with another key")
+
+			tampered := msg
+			tampered.Value = append([]byte{}, msg.Value...)
+			tampered.Value[0] = ' '
+			assert.False(t, verify(signingKey, tampered), "the signature shouldn't verify a changed payload")
+		}
+	}
+}
+
+func TestSignedCompressedMessages(t *testing.T) {
+	defer func() { signingKey, payloadCompression = nil, nil }()
+	signingKey = []byte("signing-secret")
+	compressor, err := newZstdCompressor(nil, 0)
+	assert.Nil(t, err)
+	payloadCompression = compressor
+
+	msg := newMessage(nil, []byte(`{"name":"up"}`), 0, nil)
+	assert.True(t, verify(signingKey, msg), "the compressed value should be signed")
+	assert.Len(t, msg.Headers, 2)
+
+	tombstone := newMessage([]byte("up"), nil, 0, nil)
+	assert.Empty(t, tombstone.Headers, "tombstones shouldn't be signed")
+}
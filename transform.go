@@ -0,0 +1,70 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// valueTransform represents the linear transform applied to the values of the
+// metrics whose name matches a pattern, e.g: a unit conversion.
+type valueTransform struct {
+	pattern    *regexp.Regexp
+	multiplier float64
+	offset     float64
+}
+
+func parseValueTransforms(text string) ([]valueTransform, error) {
+	var rules []struct {
+		Metric     string   `yaml:"metric"`
+		Multiplier *float64 `yaml:"multiplier"`
+		Offset     float64  `yaml:"offset"`
+	}
+	if err := yaml.Unmarshal([]byte(text), &rules); err != nil {
+		return nil, err
+	}
+
+	transforms := make([]valueTransform, 0, len(rules))
+	for _, rule := range rules {
+		pattern, err := regexp.Compile("^(?:" + rule.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid value transform metric pattern %q: %s", rule.Metric, err)
+		}
+		transform := valueTransform{pattern: pattern, multiplier: 1, offset: rule.Offset}
+		if rule.Multiplier != nil {
+			transform.multiplier = *rule.Multiplier
+		}
+		transforms = append(transforms, transform)
+	}
+	return transforms, nil
+}
+
+// transformValue applies to the value the first transform of VALUE_TRANSFORMS
+// matching the metric name. Non-finite values are returned untouched.
+func transformValue(name string, v float64) float64 {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return v
+	}
+	for _, transform := range valueTransforms {
+		if transform.pattern.MatchString(name) {
+			return v*transform.multiplier + transform.offset
+		}
+	}
+	return v
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseValueTransforms(t *testing.T) {
+	transforms, err := parseValueTransforms(`[{metric: ".*_seconds", multiplier: 1000}, {metric: "temp", multiplier: 1.8, offset: 32}, {metric: "up", offset: 1}]`)
+	assert.Nil(t, err)
+	assert.Len(t, transforms, 3)
+	assert.Equal(t, float64(1000), transforms[0].multiplier)
+	assert.Equal(t, float64(32), transforms[1].offset)
+	assert.Equal(t, float64(1), transforms[2].multiplier, "the multiplier should default to 1")
+
+	_, err = parseValueTransforms(`[{metric: "(", multiplier: 2}]`)
+	assert.NotNil(t, err)
+}
+
+func TestTransformValue(t *testing.T) {
+	valueTransforms, _ = parseValueTransforms(`[{metric: ".*_seconds", multiplier: 1000}, {metric: "temp", multiplier: 1.8, offset: 32}]`)
+	defer func() { valueTransforms = nil }()
+
+	assert.Equal(t, float64(1500), transformValue("request_seconds", 1.5))
+	assert.Equal(t, float64(212), transformValue("temp", 100))
+	assert.Equal(t, float64(7), transformValue("seconds_total", 7), "the pattern should match the whole name")
+	assert.True(t, math.IsInf(transformValue("request_seconds", math.Inf(1)), 1))
+	assert.True(t, math.IsNaN(transformValue("request_seconds", math.NaN())))
+}
+
+func TestSerializeValueTransform(t *testing.T) {
+	valueTransforms, _ = parseValueTransforms(`[{metric: "foo", multiplier: 1000}]`)
+	defer func() { valueTransforms = nil }()
+
+	serializer, err := NewJSONSerializer()
+	assert.Nil(t, err)
+
+	output, err := serializeMessages(serializer, NewWriteRequest(), serializeConfig{topicTemplate: defaultSerializeConfig().topicTemplate})
+	assert.Nil(t, err)
+
+	var values []string
+	for _, msgs := range output {
+		for _, msg := range msgs {
+			values = append(values, string(msg.Value))
+		}
+	}
+	assert.Len(t, values, 2)
+	assert.Contains(t, values[0], `"value":"456000"`)
+	assert.Contains(t, values[1], `"value":"+Inf"`, "non-finite values should bypass the transform")
+}
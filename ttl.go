@@ -0,0 +1,78 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	// expiresAtHeader is the kafka header carrying the time a message
+	// expires at, in unix milliseconds as a decimal string.
+	expiresAtHeader = "expires-at"
+	// ttlHeader is the kafka header carrying the time to live of a message,
+	// in milliseconds as a decimal string, counted by consumers from the
+	// message timestamp.
+	ttlHeader = "ttl"
+)
+
+// messageExpiry sets the TTL header of the produced messages, nil when
+// disabled.
+var messageExpiry *messageTTL
+
+// messageTTL sets the TTL header of the messages produced to each topic,
+// either as an absolute expiry or relative to the message timestamp.
+type messageTTL struct {
+	relative bool
+	ttl      time.Duration
+	topics   map[string]time.Duration
+}
+
+func newMessageTTL(mode string, ttl time.Duration, topics map[string]time.Duration) *messageTTL {
+	return &messageTTL{relative: mode == "relative", ttl: ttl, topics: topics}
+}
+
+// TTL returns the time to live of the messages produced to the topic, 0
+// when they don't expire.
+func (t *messageTTL) TTL(topic string) time.Duration {
+	if ttl, ok := t.topics[topic]; ok {
+		return ttl
+	}
+	return t.ttl
+}
+
+// Apply adds the TTL header of its topic to the message, produced at now.
+func (t *messageTTL) Apply(msg *kafka.Message, now time.Time) {
+	if t == nil {
+		return
+	}
+	ttl := t.TTL(*msg.TopicPartition.Topic)
+	if ttl <= 0 {
+		return
+	}
+
+	header := kafka.Header{Key: ttlHeader, Value: []byte(strconv.FormatInt(ttl.Milliseconds(), 10))}
+	if !t.relative {
+		expiry := now.Add(ttl).UnixNano() / int64(time.Millisecond)
+		header = kafka.Header{Key: expiresAtHeader, Value: []byte(strconv.FormatInt(expiry, 10))}
+	}
+	// the serializer headers are shared by all its messages
+	headers := make([]kafka.Header, 0, len(msg.Headers)+1)
+	headers = append(headers, msg.Headers...)
+	msg.Headers = append(headers, header)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageTTLApply(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ttls := map[string]time.Duration{"alerts": time.Minute, "raw": 0}
+	newMsg := func(topic string) *kafka.Message {
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic},
+			Headers:        []kafka.Header{{Key: "version", Value: []byte("1")}},
+		}
+	}
+
+	absolute := newMessageTTL("absolute", 10*time.Minute, ttls)
+	msg := newMsg("metrics")
+	absolute.Apply(msg, now)
+	assert.Equal(t, "1700000600000", headerValue(msg, expiresAtHeader))
+	assert.Equal(t, "1", headerValue(msg, "version"))
+
+	msg = newMsg("alerts")
+	absolute.Apply(msg, now)
+	assert.Equal(t, "1700000060000", headerValue(msg, expiresAtHeader))
+
+	msg = newMsg("raw")
+	absolute.Apply(msg, now)
+	assert.Len(t, msg.Headers, 1)
+
+	relative := newMessageTTL("relative", 10*time.Minute, ttls)
+	msg = newMsg("alerts")
+	relative.Apply(msg, now)
+	assert.Equal(t, "60000", headerValue(msg, ttlHeader))
+	assert.Equal(t, "", headerValue(msg, expiresAtHeader))
+
+	var disabled *messageTTL
+	msg = newMsg("metrics")
+	disabled.Apply(msg, now)
+	assert.Len(t, msg.Headers, 1)
+}
+
+func TestParseMessageTTLTopics(t *testing.T) {
+	topics, err := parseMessageTTLTopics("{alerts: 1m, raw: 0s}")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"alerts": time.Minute, "raw": 0}, topics)
+
+	_, err = parseMessageTTLTopics("{alerts: soon}")
+	assert.Error(t, err)
+}
+
+func TestReceiveMessageTTL(t *testing.T) {
+	previous := messageExpiry
+	messageExpiry = newMessageTTL("relative", 30*time.Second, nil)
+	defer func() { messageExpiry = previous }()
+
+	producer := &fakeProducer{}
+	w := serveReceive(t, producer, NewWriteRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, producer.messages)
+	for _, msg := range producer.messages {
+		assert.Equal(t, "30000", headerValue(msg, ttlHeader))
+	}
+}
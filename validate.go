@@ -0,0 +1,144 @@
+// Copyright 2018 Telefónica
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// validateRequest holds candidate match rules and topic template, along with
+// the series to run through them.
+type validateRequest struct {
+	Match      []string         `json:"match"`
+	Topic      string           `json:"topic"`
+	Timeseries []validateSeries `json:"timeseries"`
+}
+
+type validateSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Samples []validateSample  `json:"samples"`
+}
+
+type validateSample struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type validateResponse struct {
+	Errors map[string]string `json:"errors,omitempty"`
+	Series []validateResult  `json:"series,omitempty"`
+}
+
+// validateResult describes the outcome of a series: whether it passes the
+// match rules, as evaluated once its labels went through the pipeline, and if
+// so, the topic, key and messages it would produce.
+type validateResult struct {
+	Labels   map[string]string `json:"labels"`
+	Kept     bool              `json:"kept"`
+	Topic    string            `json:"topic,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	Messages []string          `json:"messages,omitempty"`
+}
+
+// validateHandler runs the series of the request through the candidate match
+// rules and topic template, without altering the running configuration. An
+// empty topic template uses the running KAFKA_TOPIC.
+func validateHandler(serializer Serializer) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req validateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validateResponse{Errors: map[string]string{"request": err.Error()}})
+			return
+		}
+
+		cfg := dryRunConfig()
+		errs := make(map[string]string)
+
+		rules, err := parseMatchRules(req.Match)
+		if err != nil {
+			errs["match"] = err.Error()
+		}
+		cfg.match = rules
+
+		if req.Topic != "" {
+			tpl, err := parseTopicTemplate(req.Topic)
+			if err != nil {
+				errs["topic"] = err.Error()
+			}
+			cfg.topicTemplate = tpl
+		}
+
+		if len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validateResponse{Errors: errs})
+			return
+		}
+
+		results := make([]validateResult, 0, len(req.Timeseries))
+		for _, series := range req.Timeseries {
+			results = append(results, validate(serializer, cfg, series))
+		}
+		c.JSON(http.StatusOK, validateResponse{Series: results})
+	}
+}
+
+// dryRunConfig returns the running serialize config without its caches and
+// limiters, serializing dry runs, so validating series leaves no trace.
+func dryRunConfig() serializeConfig {
+	cfg := defaultSerializeConfig()
+	cfg.topicCache, cfg.filterCache = nil, nil
+	cfg.dedup, cfg.cardinality, cfg.rateLimit, cfg.aggregation = nil, nil, nil, nil
+	cfg.dryRun = true
+	return cfg
+}
+
+func validate(serializer Serializer, cfg serializeConfig, series validateSeries) validateResult {
+	result := validateResult{Labels: series.Labels}
+
+	ts := &prompb.TimeSeries{}
+	names := make([]string, 0, len(series.Labels))
+	for name := range series.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ts.Labels = append(ts.Labels, &prompb.Label{Name: name, Value: series.Labels[name]})
+	}
+	for _, sample := range series.Samples {
+		ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: sample.Timestamp, Value: sample.Value})
+	}
+
+	cfg.stats = &filterStats{}
+	messages, _ := serializeMessages(serializer, &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{ts}}, cfg)
+	result.Kept = cfg.stats.matched > 0
+	if !result.Kept {
+		return result
+	}
+
+	// a kept series is produced to a single topic
+	for t, msgs := range messages {
+		result.Topic = t
+		for _, msg := range msgs {
+			if result.Key == "" {
+				result.Key = string(msg.Key)
+			}
+			result.Messages = append(result.Messages, string(msg.Value))
+		}
+	}
+	return result
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveValidate(t *testing.T, body string) (int, validateResponse) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/validate", validateHandler(serializer))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body)))
+
+	var resp validateResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return w.Code, resp
+}
+
+func TestValidate(t *testing.T) {
+	code, resp := serveValidate(t, `{
+		"match": ["foo{x=\"1\"}"],
+		"topic": "metrics.{{ index . \"__name__\" }}",
+		"timeseries": [
+			{"labels": {"__name__": "foo", "x": "1"}, "samples": [{"timestamp": 0, "value": 1}, {"timestamp": 1000, "value": 2}]},
+			{"labels": {"__name__": "foo", "x": "2"}, "samples": [{"timestamp": 0, "value": 1}]}
+		]
+	}`)
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Errors)
+	assert.Len(t, resp.Series, 2)
+
+	assert.True(t, resp.Series[0].Kept)
+	assert.Equal(t, "metrics.foo", resp.Series[0].Topic)
+	assert.Len(t, resp.Series[0].Messages, 2)
+	assert.JSONEq(t, `{"timestamp":"1970-01-01T00:00:00Z","value":"1","name":"foo","labels":{"__name__":"foo","x":"1"}}`, resp.Series[0].Messages[0])
+
+	assert.False(t, resp.Series[1].Kept)
+	assert.Empty(t, resp.Series[1].Topic)
+	assert.Empty(t, resp.Series[1].Messages)
+}
+
+func TestValidateInvalidConfig(t *testing.T) {
+	code, resp := serveValidate(t, `{
+		"match": ["foo{x=}"],
+		"topic": "metrics.{{ index . ",
+		"timeseries": [{"labels": {"__name__": "foo"}, "samples": [{"timestamp": 0, "value": 1}]}]
+	}`)
+
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Errors, "match")
+	assert.Contains(t, resp.Errors, "topic")
+	assert.Empty(t, resp.Series)
+}
+
+func TestValidateDryRun(t *testing.T) {
+	var err error
+	payloadCompression, err = parsePayloadCompression("zstd", "", 0)
+	assert.Nil(t, err)
+	nameFallbackLabels = []string{"job"}
+	roundRobin := &roundRobinPartitioner{partitions: partitionRange{first: 0, last: 3}}
+	partitioner = roundRobin
+	defer func() { payloadCompression, nameFallbackLabels, partitioner = nil, nil, defaultPartitioner{} }()
+
+	before := &dto.Metric{}
+	assert.Nil(t, serializeTotal.Write(before))
+
+	// the name is derived from the job label before the rules are matched
+	code, resp := serveValidate(t, `{
+		"match": ["node"],
+		"topic": "metrics",
+		"timeseries": [{"labels": {"job": "node"}, "samples": [{"timestamp": 0, "value": 1}]}]
+	}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp.Series, 1)
+	assert.True(t, resp.Series[0].Kept)
+	assert.Equal(t, "metrics", resp.Series[0].Topic)
+	assert.Len(t, resp.Series[0].Messages, 1)
+	assert.JSONEq(t, `{"timestamp":"1970-01-01T00:00:00Z","value":"1","name":"node","labels":{"__name__":"node","job":"node"}}`, resp.Series[0].Messages[0], "the value should be left uncompressed")
+
+	after := &dto.Metric{}
+	assert.Nil(t, serializeTotal.Write(after))
+	assert.Equal(t, before.GetCounter().GetValue(), after.GetCounter().GetValue(), "a dry run shouldn't be counted")
+	assert.Equal(t, uint64(0), roundRobin.next, "a dry run shouldn't advance the partitioner")
+}